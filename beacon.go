@@ -5,22 +5,37 @@ import (
 	"github.com/dist-ribut-us/ipcrouter"
 	"github.com/dist-ribut-us/log"
 	"github.com/dist-ribut-us/message"
+	"github.com/dist-ribut-us/overlay/overlaymessages"
 )
 
 var beaconBkt = []byte("beacon")
 
+// handleAddBeacon adds a beacon from a NodeRecord signed by the beacon.
 func (s *Server) handleAddBeacon(c ipcrouter.Command) {
-	addr := c.GetAddr()
-	if addr == nil {
-		log.Info(log.Lbl("cannot_add_beacon_addr_is_nil"))
+	r, err := overlaymessages.DeserializeNodeRecord(c.GetBody())
+	if log.Error(err) {
 		return
 	}
-	pub := crypto.SignPubFromSlice(c.GetBody())
-	s.addBeacon(pub, addr)
+	if !validRecord(r) {
+		log.Info(log.Lbl("cannot_add_beacon_invalid_record"))
+		return
+	}
+	b := s.addBeacon(r.ID.Sign, r.Addrs[0])
+	b.setRecord(r)
+	s.saveBeacon(b)
 }
 
+// saveBeacon stores the beacon's record or, if it has none, its address.
 func (s *Server) saveBeacon(b *node) {
-	buf := message.FromAddr(b.ToAddr).Marshal()
+	if s.forest == nil {
+		return
+	}
+	var buf []byte
+	if r := b.getRecord(); r != nil {
+		buf = r.Serialize()
+	} else {
+		buf = message.FromAddr(b.toAddr()).Marshal()
+	}
 	key := b.Pub.Slice()
 	s.forest.SetValue(beaconBkt, key, buf)
 }
@@ -28,6 +43,10 @@ func (s *Server) saveBeacon(b *node) {
 func (s *Server) loadBeacons() {
 	for key, val, err := s.forest.First(beaconBkt); key != nil && !log.Error(err); key, val, err = s.forest.Next(beaconBkt, key) {
 		pub := crypto.SignPubFromSlice(key)
+		if r, err := overlaymessages.DeserializeNodeRecord(val); err == nil && *r.ID.Sign == *pub && r.Verify() {
+			s.addBeacon(pub, r.Addrs[0]).setRecord(r)
+			continue
+		}
 		addr := message.UnmarshalAddrpb(val).GetAddr()
 		s.addBeacon(pub, addr)
 	}
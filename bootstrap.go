@@ -0,0 +1,84 @@
+package overlay
+
+import (
+	"github.com/dist-ribut-us/errors"
+	"github.com/dist-ribut-us/log"
+	"github.com/dist-ribut-us/overlay/overlaymessages"
+	"time"
+)
+
+// Bootstrap parameters. Bootstrap stops contacting beacons once
+// bootstrapBeacons have responded. bootstrapTimeout allows for the handshake
+// and its retries.
+var (
+	bootstrapBeacons = 3
+	bootstrapTimeout = time.Second * 5
+)
+
+// Errors from Bootstrap
+const (
+	ErrNoBeacons          = errors.String("No beacons to bootstrap from")
+	ErrBeaconsUnreachable = errors.String("No beacons could be reached")
+)
+
+func (s *Server) joinStatus(state overlaymessages.JoinState, detail string) {
+	js := &overlaymessages.JoinStatus{
+		State:  state,
+		Detail: detail,
+	}
+	if s.table != nil {
+		js.Nodes = uint32(s.table.len())
+	}
+	log.Info(log.Lbl("join_status"), state, js.Nodes, detail)
+	s.notifySubscribers(overlaymessages.JoinStatusUpdate, js.Serialize())
+}
+
+// Bootstrap joins the network. Each beacon is asked for the nodes closest to
+// this node, moving on to the next beacon when one cannot be reached. Once
+// at least one beacon has responded, a lookup for this node's own ID and a
+// refresh of every bucket fill the routing table. Progress is reported to
+// subscribed services with JoinStatusUpdate messages.
+func (s *Server) Bootstrap() error {
+	s.joinStatus(overlaymessages.JoinStarted, "")
+	s.RLock()
+	beacons := make([]*node, len(s.beacons))
+	copy(beacons, s.beacons)
+	s.RUnlock()
+	if len(beacons) == 0 {
+		s.joinStatus(overlaymessages.JoinFailed, ErrNoBeacons.Error())
+		return ErrNoBeacons
+	}
+
+	self := s.table.self
+	var reached int
+	for _, b := range beacons {
+		if reached == bootstrapBeacons {
+			break
+		}
+		cs, ok := s.queryFindNode(b, self, bootstrapTimeout)
+		if !ok {
+			s.joinStatus(overlaymessages.JoinBeaconUnreachable, b.toAddr().String())
+			continue
+		}
+		reached++
+		s.table.seen(b)
+		for _, c := range cs {
+			if c.Sign != nil && c.Addr != nil && *c.Sign.ID() != *self {
+				s.nodeFromContact(c)
+			}
+		}
+		s.joinStatus(overlaymessages.JoinBeaconReached, b.toAddr().String())
+	}
+	if reached == 0 {
+		s.joinStatus(overlaymessages.JoinFailed, ErrBeaconsUnreachable.Error())
+		return ErrBeaconsUnreachable
+	}
+
+	s.findNode(self)
+	for _, i := range s.table.stale(0) {
+		s.findNode(randomIDInBucket(self, i))
+	}
+	s.discoverAddr()
+	s.joinStatus(overlaymessages.Joined, "")
+	return nil
+}
@@ -0,0 +1,34 @@
+package overlay
+
+import (
+	"github.com/dist-ribut-us/crypto"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestBootstrap(t *testing.T) {
+	defer func(d time.Duration) { bootstrapTimeout = d }(bootstrapTimeout)
+	bootstrapTimeout = time.Millisecond * 200
+
+	srvs := newTestChain(t, 3)
+	for _, s := range srvs {
+		defer s.Close()
+	}
+	s := newTestServer(t)
+	defer s.Close()
+
+	assert.Equal(t, ErrNoBeacons, s.Bootstrap())
+
+	// the first beacon is unreachable, the second is the head of the chain
+	_, priv := crypto.GenerateSignPair()
+	s.addBeacon(priv.Pub(), getPort.Next().On("127.0.0.1"))
+	s.addBeacon(srvs[0].key.Pub(), srvs[0].addr)
+
+	assert.NoError(t, s.Bootstrap())
+	for _, other := range srvs {
+		_, ok := s.nodeByID(other.key.Pub().ID())
+		assert.True(t, ok)
+	}
+	assert.True(t, s.table.len() >= 2)
+}
@@ -0,0 +1,485 @@
+package overlay
+
+import (
+	crand "crypto/rand"
+	"encoding/binary"
+	"github.com/dist-ribut-us/crypto"
+	"github.com/dist-ribut-us/errors"
+	"github.com/dist-ribut-us/ipcrouter"
+	"github.com/dist-ribut-us/log"
+	"github.com/dist-ribut-us/message"
+	"github.com/dist-ribut-us/overlay/overlaymessages"
+	"github.com/dist-ribut-us/rnet"
+	"github.com/golang/protobuf/proto"
+	"math/big"
+	"sync"
+	"time"
+)
+
+// A circuit is a leap-frog path through the overlay network. It is set up by
+// a create onion, wrapped in one layer per hop like Russian nesting dolls. Each
+// hop peels off its layer with its static exchange key and learns the ID of
+// the circuit, a key for the circuit and the address of the next hop, which is
+// empty for the destination. The hop keeps that state and forwards the inner
+// layer.
+//
+// Messages are then sent as data onions. Each layer is the onionData tag, the
+// circuit ID and, sealed with the circuit key for the hop, a counter and the
+// inner layer. A hop only forwards data for a circuit it holds, received from
+// the address the circuit was created from, with a counter it has not seen and
+// within circuitRate. For the destination, the inner layer is a marshaled
+// message.Header which is delivered to the service in the header.
+//
+// Create layer: onionRelay | ephemeral XchgPub | sealed(id | key | len(next) |
+// next | inner)
+// Data layer: onionData | id | sealed(counter | inner)
+type circuit struct {
+	id   uint32  // handle given to the service
+	hops []*node // hops[len(hops)-1] is the destination
+	ids  []uint32
+	keys []*crypto.Symmetric
+
+	sync.Mutex
+	ctr      uint64
+	lastUsed time.Time
+}
+
+// hopCircuit is the state held by a relay or destination for a circuit.
+type hopCircuit struct {
+	prev *rnet.Addr
+	next *rnet.Addr // nil at the destination
+	key  *crypto.Symmetric
+
+	sync.Mutex
+	highest  uint64 // highest counter seen
+	seen     uint64 // bit i is set if highest-i has been seen
+	bucket   circuitBucket
+	lastUsed time.Time
+}
+
+func newHopCircuit(prev, next *rnet.Addr, key *crypto.Symmetric) *hopCircuit {
+	now := time.Now()
+	return &hopCircuit{
+		prev:     prev,
+		next:     next,
+		key:      key,
+		bucket:   circuitBucket{tokens: circuitRate, filled: now},
+		lastUsed: now,
+	}
+}
+
+// circuitBucket limits a rate. It fills at rate per second and holds at most
+// one second worth.
+type circuitBucket struct {
+	tokens float64
+	filled time.Time
+}
+
+// take removes size tokens if they are available.
+func (b *circuitBucket) take(size, rate float64, now time.Time) bool {
+	b.tokens += now.Sub(b.filled).Seconds() * rate
+	if b.tokens > rate {
+		b.tokens = rate
+	}
+	b.filled = now
+	if b.tokens < size {
+		return false
+	}
+	b.tokens -= size
+	return true
+}
+
+// Circuit limits. A hop forwards at most circuitRate bytes per second on a
+// circuit and accepts at most circuitCreateRate new circuits per second.
+// Circuits that are not used for circuitIdle are dropped by every node.
+var (
+	maxCircuitRelays  = 5
+	circuitRate       = float64(64 << 10)
+	circuitCreateRate = float64(10)
+	circuitIdle       = time.Minute * 10
+)
+
+// Errors building circuits
+const (
+	ErrNotEnoughRelays = errors.String("Not enough known nodes to build circuit")
+	ErrNoXchgKey       = errors.String("Exchange key for hop is not known")
+	ErrUnknownCircuit  = errors.String("Unknown circuit")
+	ErrBadOnion        = errors.String("Malformed onion layer")
+
+	ErrCircuitRateLimited = errors.String("Circuit is over its rate limit")
+	ErrCircuitReplay      = errors.String("Onion counter has been seen")
+)
+
+const (
+	circuitIDLen      = 4
+	circuitCounterLen = 8
+	// counters more than circuitWindow below the highest are dropped
+	circuitWindow = 64
+)
+
+func randomCircuitID() uint32 {
+	var b [circuitIDLen]byte
+	for {
+		crand.Read(b[:])
+		if id := binary.BigEndian.Uint32(b[:]); id != 0 {
+			return id
+		}
+	}
+}
+
+// addCircuit assigns a random unused ID to c and stores it.
+func (s *Server) addCircuit(c *circuit) {
+	s.circuits.Lock()
+	for c.id == 0 || s.circuits.Map[c.id] != nil {
+		c.id = randomCircuitID()
+	}
+	s.circuits.Map[c.id] = c
+	s.circuits.Unlock()
+}
+
+// buildCircuit creates a circuit to dest through the given number of relays
+// and sends the create onion. Relays are chosen at random from the routing
+// table. The exchange key of every hop must be known or be retrievable with a
+// GetID query.
+func (s *Server) buildCircuit(dest *node, relays int) (*circuit, error) {
+	if relays > maxCircuitRelays {
+		relays = maxCircuitRelays
+	}
+	candidates := s.table.closest(s.table.self, s.table.len())
+	pool := candidates[:0]
+	for _, n := range candidates {
+		if *n.id() != *dest.id() && n.toAddr() != nil {
+			pool = append(pool, n)
+		}
+	}
+	if len(pool) < relays {
+		return nil, ErrNotEnoughRelays
+	}
+
+	c := &circuit{}
+	for i := 0; i < relays; i++ {
+		j, err := crand.Int(crand.Reader, big.NewInt(int64(len(pool))))
+		if err != nil {
+			return nil, err
+		}
+		idx := int(j.Int64())
+		c.hops = append(c.hops, pool[idx])
+		pool = append(pool[:idx], pool[idx+1:]...)
+	}
+	c.hops = append(c.hops, dest)
+
+	for _, n := range c.hops {
+		if n.PubX == nil {
+			s.queryXchgPub(n)
+		}
+		if n.PubX == nil {
+			return nil, ErrNoXchgKey
+		}
+	}
+	pkt := c.create()
+	s.addCircuit(c)
+	return c, s.net.Send(pkt, c.hops[0].toAddr())
+}
+
+// queryXchgPub requests the static exchange key of a node with a GetID query.
+func (s *Server) queryXchgPub(n *node) {
+	done := make(chan bool, 1)
+	s.router.
+		Query(overlaymessages.GetID, nil).
+		SetService(overlaymessages.ServiceID).
+		SendToNet(n.toAddr(), func(r ipcrouter.NetResponse) {
+			if b := r.GetBody(); len(b) == crypto.KeyLength*2 {
+				id := overlaymessages.DeserializeID(b)
+				if *id.Sign == *n.Pub {
+					n.PubX = id.Xchng
+				}
+			}
+			done <- true
+		})
+	select {
+	case <-done:
+	case <-time.After(lookupTimeout):
+	}
+}
+
+// create picks the circuit ID and key for each hop and builds the create
+// onion. The returned packet should be sent to the first hop.
+func (c *circuit) create() []byte {
+	c.ids = make([]uint32, len(c.hops))
+	c.keys = make([]*crypto.Symmetric, len(c.hops))
+	c.lastUsed = time.Now()
+	var pkt, next []byte
+	for i := len(c.hops) - 1; i >= 0; i-- {
+		hop := c.hops[i]
+		c.ids[i], c.keys[i] = randomCircuitID(), crypto.RandomSymmetric()
+		plain := make([]byte, circuitIDLen, circuitIDLen+crypto.KeyLength+2+len(next)+len(pkt))
+		binary.BigEndian.PutUint32(plain, c.ids[i])
+		plain = append(plain, c.keys[i][:]...)
+		var l [2]byte
+		binary.BigEndian.PutUint16(l[:], uint16(len(next)))
+		plain = append(plain, l[:]...)
+		plain = append(plain, next...)
+		plain = append(plain, pkt...)
+
+		eph := crypto.GenerateXchgPair()
+		tag := append([]byte{onionRelay}, eph.Pub().Slice()...)
+		pkt = eph.Shared(hop.PubX).SealPackets(tag, [][]byte{plain}, nil, 0)[0]
+		next = message.FromAddr(hop.toAddr()).Marshal()
+	}
+	return pkt
+}
+
+// wrap builds the data onion for msg. The returned packet should be sent to
+// the first hop.
+func (c *circuit) wrap(msg []byte) []byte {
+	c.Lock()
+	c.ctr++
+	ctr := c.ctr
+	c.lastUsed = time.Now()
+	c.Unlock()
+
+	pkt := msg
+	for i := len(c.hops) - 1; i >= 0; i-- {
+		plain := make([]byte, circuitCounterLen, circuitCounterLen+len(pkt))
+		binary.BigEndian.PutUint64(plain, ctr)
+		plain = append(plain, pkt...)
+		tag := make([]byte, 1+circuitIDLen)
+		tag[0] = onionData
+		binary.BigEndian.PutUint32(tag[1:], c.ids[i])
+		pkt = c.keys[i].SealPackets(tag, [][]byte{plain}, nil, 0)[0]
+	}
+	return pkt
+}
+
+// circuitSend wraps a header in the layers of a circuit and sends it to the
+// first hop.
+func (s *Server) circuitSend(c *circuit, msg *message.Header) error {
+	b, err := proto.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return s.net.Send(c.wrap(b), c.hops[0].toAddr())
+}
+
+// peel removes one layer from a create onion. If next is nil, this node is the
+// destination.
+func (s *Server) peel(pkt []byte) (id uint32, key *crypto.Symmetric, next *rnet.Addr, inner []byte, err error) {
+	if len(pkt) < 1+crypto.KeyLength {
+		return 0, nil, nil, nil, ErrBadOnion
+	}
+	eph := crypto.XchgPubFromSlice(pkt[1 : 1+crypto.KeyLength])
+	plain, err := s.keyX.Shared(eph).Open(pkt[1+crypto.KeyLength:])
+	if err != nil {
+		return 0, nil, nil, nil, errors.Wrap("decrypting onion layer", err)
+	}
+	const hdr = circuitIDLen + crypto.KeyLength + 2
+	if len(plain) < hdr {
+		return 0, nil, nil, nil, ErrBadOnion
+	}
+	id = binary.BigEndian.Uint32(plain)
+	key = &crypto.Symmetric{}
+	copy(key[:], plain[circuitIDLen:])
+	l := int(binary.BigEndian.Uint16(plain[hdr-2:]))
+	if id == 0 || len(plain) < hdr+l {
+		return 0, nil, nil, nil, ErrBadOnion
+	}
+	inner = plain[hdr+l:]
+	if l == 0 {
+		return id, key, nil, inner, nil
+	}
+	next = message.UnmarshalAddrpb(plain[hdr : hdr+l]).GetAddr()
+	if next == nil || len(inner) < 1 || inner[0] != onionRelay {
+		return 0, nil, nil, nil, ErrBadOnion
+	}
+	return id, key, next, inner, nil
+}
+
+// handleOnion peels one layer off a create onion, stores the circuit and
+// forwards the inner layer to the next hop.
+func (s *Server) handleOnion(pkt []byte, addr *rnet.Addr) {
+	id, key, next, inner, err := s.peel(pkt)
+	if err != nil {
+		log.Info(log.Lbl("bad_onion_packet"), addr, err)
+		return
+	}
+	hc := newHopCircuit(addr, next, key)
+	s.hopCircuits.Lock()
+	_, exists := s.hopCircuits.Map[id]
+	// only layers that open are charged to the create limit
+	allowed := !exists && s.createLimit.take(1, circuitCreateRate, time.Now())
+	if allowed {
+		s.hopCircuits.Map[id] = hc
+	}
+	s.hopCircuits.Unlock()
+	if exists {
+		log.Info(log.Lbl("circuit_id_in_use"), addr)
+		return
+	}
+	if !allowed {
+		log.Info(log.Lbl("circuit_create_rate_limited"), addr)
+		return
+	}
+	if next != nil {
+		log.Error(s.net.Send(inner, next))
+	}
+}
+
+// checkCounter accepts each counter once if it is within circuitWindow of the
+// highest seen. It must be called with the lock held.
+func (hc *hopCircuit) checkCounter(ctr uint64) bool {
+	if ctr == 0 {
+		return false
+	}
+	if ctr > hc.highest {
+		if shift := ctr - hc.highest; shift < circuitWindow {
+			hc.seen = hc.seen<<shift | 1
+		} else {
+			hc.seen = 1
+		}
+		hc.highest = ctr
+		return true
+	}
+	d := hc.highest - ctr
+	if d >= circuitWindow || hc.seen&(1<<d) != 0 {
+		return false
+	}
+	hc.seen |= 1 << d
+	return true
+}
+
+// open removes the layer of a data onion for this hop and checks its counter
+// and rate.
+func (hc *hopCircuit) open(pkt []byte) ([]byte, error) {
+	plain, err := hc.key.Open(pkt[1+circuitIDLen:])
+	if err != nil {
+		return nil, errors.Wrap("decrypting onion layer", err)
+	}
+	if len(plain) < circuitCounterLen {
+		return nil, ErrBadOnion
+	}
+	now := time.Now()
+	hc.Lock()
+	defer hc.Unlock()
+	if !hc.checkCounter(binary.BigEndian.Uint64(plain)) {
+		return nil, ErrCircuitReplay
+	}
+	if !hc.bucket.take(float64(len(plain)), circuitRate, now) {
+		return nil, ErrCircuitRateLimited
+	}
+	hc.lastUsed = now
+	return plain[circuitCounterLen:], nil
+}
+
+// handleOnionData forwards a data onion on a circuit or, at the destination,
+// delivers the message to the service.
+func (s *Server) handleOnionData(pkt []byte, addr *rnet.Addr) {
+	if len(pkt) < 1+circuitIDLen {
+		return
+	}
+	hc, ok := s.hopCircuits.get(binary.BigEndian.Uint32(pkt[1:]))
+	if !ok || hc.prev.String() != addr.String() {
+		log.Info(log.Lbl("onion_on_unknown_circuit"), addr)
+		return
+	}
+	inner, err := hc.open(pkt)
+	if err != nil {
+		log.Info(log.Lbl("dropped_onion_packet"), addr, err)
+		return
+	}
+	if hc.next != nil {
+		if len(inner) < 1 || inner[0] != onionData {
+			log.Info(log.Lbl("bad_onion_packet"), addr, ErrBadOnion)
+			return
+		}
+		log.Error(s.net.Send(inner, hc.next))
+		return
+	}
+
+	h := &message.Header{}
+	if log.Error(proto.Unmarshal(inner, h)) {
+		return
+	}
+	h.SetFlag(message.FromNet)
+	port, ok := s.services.get(h.Service)
+	if !ok {
+		log.Info(log.Lbl("no_service_for_onion_msg"), h.Service)
+		return
+	}
+	s.router.Send(port, h)
+}
+
+// expireCircuits drops circuits that have not been used for circuitIdle.
+func (s *Server) expireCircuits() {
+	cutoff := time.Now().Add(-circuitIdle)
+	s.circuits.Lock()
+	for id, c := range s.circuits.Map {
+		c.Lock()
+		if c.lastUsed.Before(cutoff) {
+			delete(s.circuits.Map, id)
+		}
+		c.Unlock()
+	}
+	s.circuits.Unlock()
+	s.hopCircuits.Lock()
+	for id, hc := range s.hopCircuits.Map {
+		hc.Lock()
+		if hc.lastUsed.Before(cutoff) {
+			delete(s.hopCircuits.Map, id)
+		}
+		hc.Unlock()
+	}
+	s.hopCircuits.Unlock()
+}
+
+// handleBuildCircuitQuery builds a circuit for a service. The body of the query
+// is the number of relays followed by the ID of the destination. The response
+// is the circuit ID or 0 if the circuit could not be built.
+func (s *Server) handleBuildCircuitQuery(q ipcrouter.Query) {
+	body := q.GetBody()
+	if len(body) < 4 {
+		q.Respond(uint32(0))
+		return
+	}
+	relays := int(binary.BigEndian.Uint32(body))
+	id, err := crypto.IDFromSlice(body[4:])
+	if log.Error(err) {
+		q.Respond(uint32(0))
+		return
+	}
+	dest, ok := s.nodeByID(id)
+	if !ok {
+		log.Info(log.Lbl("circuit_to_unknown_node"), id)
+		q.Respond(uint32(0))
+		return
+	}
+	c, err := s.buildCircuit(dest, relays)
+	if log.Error(err) {
+		q.Respond(uint32(0))
+		return
+	}
+	q.Respond(c.id)
+}
+
+// handleCircuitSend sends a message on a circuit. The body of the command is
+// the circuit ID followed by the marshaled message.Header.
+func (s *Server) handleCircuitSend(cmd ipcrouter.Command) {
+	body := cmd.GetBody()
+	if len(body) < 4 {
+		log.Error(ErrUnknownCircuit)
+		return
+	}
+	c, ok := s.circuits.get(binary.BigEndian.Uint32(body))
+	if !ok {
+		log.Error(ErrUnknownCircuit)
+		return
+	}
+	h := &message.Header{}
+	if log.Error(proto.Unmarshal(body[4:], h)) {
+		return
+	}
+	log.Error(s.circuitSend(c, h))
+}
+
+func (s *Server) handleCloseCircuit(cmd ipcrouter.Command) {
+	s.circuits.delete(cmd.BodyToUint32())
+}
@@ -0,0 +1,116 @@
+package overlay
+
+import (
+	"github.com/dist-ribut-us/crypto"
+	"github.com/dist-ribut-us/rnet"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestOnionLayers(t *testing.T) {
+	srvs := make([]*Server, 3)
+	c := &circuit{}
+	for i := range srvs {
+		srvs[i] = &Server{keyX: crypto.GenerateXchgPair()}
+		c.hops = append(c.hops, &node{
+			PubX:   srvs[i].keyX.Pub(),
+			ToAddr: rnet.Port(6000 + i).On("127.0.0.1"),
+		})
+	}
+
+	pkt := c.create()
+	assert.Equal(t, onionRelay, pkt[0])
+
+	// the destination layer cannot be opened by the first relay
+	_, _, _, _, err := srvs[2].peel(pkt)
+	assert.Error(t, err)
+
+	hcs := make([]*hopCircuit, len(srvs))
+	for i, s := range srvs {
+		id, key, next, inner, err := s.peel(pkt)
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.Equal(t, c.ids[i], id)
+		assert.Equal(t, *c.keys[i], *key)
+		hcs[i] = newHopCircuit(nil, next, key)
+		if i == len(srvs)-1 {
+			assert.Nil(t, next)
+			break
+		}
+		if assert.NotNil(t, next) {
+			assert.Equal(t, c.hops[i+1].ToAddr.String(), next.String())
+		}
+		pkt = inner
+	}
+
+	msg := []byte("nesting dolls")
+	data := c.wrap(msg)
+	pkt = data
+	for i, hc := range hcs {
+		assert.Equal(t, onionData, pkt[0])
+		inner, err := hc.open(pkt)
+		if !assert.NoError(t, err) {
+			return
+		}
+		if i == len(hcs)-1 {
+			assert.Equal(t, msg, inner)
+		}
+		pkt = inner
+	}
+
+	// a replayed data onion is dropped by the first hop
+	_, err = hcs[0].open(data)
+	assert.Equal(t, ErrCircuitReplay, err)
+
+	// a data onion for a circuit that was never created is dropped
+	s := newTestServer(t)
+	defer s.Close()
+	s.handleOnionData(c.wrap(msg), s.addr)
+	assert.Equal(t, 0, len(s.hopCircuits.Map))
+}
+
+func TestOnionCreateLimit(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+
+	// layers that do not open do not use up the create limit
+	garbage := make([]byte, 100)
+	garbage[0] = onionRelay
+	for i := 0; i < int(circuitCreateRate)*2; i++ {
+		s.handleOnion(garbage, s.addr)
+	}
+	s.hopCircuits.RLock()
+	assert.True(t, s.createLimit.tokens >= circuitCreateRate-1)
+	s.hopCircuits.RUnlock()
+}
+
+func TestCircuitCounter(t *testing.T) {
+	hc := newHopCircuit(nil, nil, nil)
+	hc.Lock()
+	defer hc.Unlock()
+	assert.False(t, hc.checkCounter(0))
+	assert.True(t, hc.checkCounter(2))
+	assert.True(t, hc.checkCounter(1))
+	assert.False(t, hc.checkCounter(1))
+	assert.True(t, hc.checkCounter(circuitWindow+10))
+	assert.False(t, hc.checkCounter(2))
+	assert.True(t, hc.checkCounter(12))
+	assert.False(t, hc.checkCounter(12))
+}
+
+func TestExpireCircuits(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+	s.circuits.set(1, &circuit{id: 1, lastUsed: time.Now().Add(-circuitIdle * 2)})
+	s.circuits.set(2, &circuit{id: 2, lastUsed: time.Now()})
+	s.hopCircuits.set(3, &hopCircuit{lastUsed: time.Now().Add(-circuitIdle * 2)})
+	s.expireCircuits()
+	_, ok := s.circuits.get(1)
+	assert.False(t, ok)
+	_, ok = s.circuits.get(2)
+	assert.True(t, ok)
+	_, ok = s.hopCircuits.get(3)
+	assert.False(t, ok)
+}
@@ -0,0 +1,87 @@
+package overlay
+
+import (
+	crand "crypto/rand"
+	"encoding/binary"
+	"github.com/dist-ribut-us/rnet"
+)
+
+// Each side of a session picks the connection ID it receives on and sends it
+// in the handshake. Every encSymmetric packet carries the connection ID of the
+// receiver after the packet type, so the session is found even if the address
+// of the sender has changed. The address of the node is only updated once a
+// packet from the new address has been opened and is the newest the session
+// has seen, so a replayed or delayed packet cannot move the session.
+const connIDLen = 8
+
+func randomConnID() uint64 {
+	var b [connIDLen]byte
+	for {
+		crand.Read(b[:])
+		if id := binary.BigEndian.Uint64(b[:]); id != 0 {
+			return id
+		}
+	}
+}
+
+// packetTag is the header of a packet of the given type sent to n through the
+// session.
+func (n *node) packetTag(kind byte) []byte {
+	tag := make([]byte, 1+connIDLen)
+	tag[0] = kind
+	binary.BigEndian.PutUint64(tag[1:], n.peerConnID)
+	return tag
+}
+
+func (ns *nodes) nodeByConn(id uint64) (*node, bool) {
+	ns.RLock()
+	n, ok := ns.nByConn[id]
+	ns.RUnlock()
+	return n, ok
+}
+
+// setReceiver records n as the node whose packets are passed to the packeter
+// under addr. The node was found by the connection ID of the packet, so the
+// message is credited to it even if nByAddr holds another node for addr.
+func (ns *nodes) setReceiver(addr *rnet.Addr, n *node) {
+	if r, ok := ns.receiver(addr); ok && r == n {
+		return
+	}
+	ns.Lock()
+	ns.nByRecv[addr.String()] = n
+	ns.Unlock()
+}
+
+// receiver returns the node set by setReceiver for addr.
+func (ns *nodes) receiver(addr *rnet.Addr) (*node, bool) {
+	ns.RLock()
+	n, ok := ns.nByRecv[addr.String()]
+	ns.RUnlock()
+	return n, ok
+}
+
+// setConnIDs records the connection IDs of a new session.
+func (ns *nodes) setConnIDs(n *node, local, peer uint64) {
+	ns.Lock()
+	if n.connID != 0 && ns.nByConn[n.connID] == n {
+		delete(ns.nByConn, n.connID)
+	}
+	n.connID, n.peerConnID = local, peer
+	ns.nByConn[local] = n
+	ns.Unlock()
+}
+
+// roam moves n to addr after an authenticated packet arrives from it.
+func (ns *nodes) roam(n *node, addr *rnet.Addr) {
+	ns.Lock()
+	n.Lock()
+	if n.FromAddr != nil && ns.nByAddr[n.FromAddr.String()] == n {
+		delete(ns.nByAddr, n.FromAddr.String())
+	}
+	n.FromAddr, n.ToAddr = addr, addr
+	n.Unlock()
+	ns.nByAddr[addr.String()] = n
+	ns.Unlock()
+	n.addPath(addr, addrKind(addr))
+	n.pathSeen(addr)
+}
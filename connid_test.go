@@ -0,0 +1,108 @@
+package overlay
+
+import (
+	"github.com/dist-ribut-us/crypto"
+	"github.com/dist-ribut-us/message"
+	"github.com/dist-ribut-us/packeter"
+	"github.com/dist-ribut-us/rnet"
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestRoaming(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+
+	oldAddr := rnet.Port(7667).On("127.0.0.1")
+	newAddr := rnet.Port(7668).On("127.0.0.1")
+	_, priv := crypto.GenerateSignPair()
+	n := &node{
+		Pub:      priv.Pub(),
+		ToAddr:   oldAddr,
+		FromAddr: oldAddr,
+	}
+	n.setSession(crypto.RandomSymmetric())
+	s.addNode(n)
+	connID := randomConnID()
+	s.setConnIDs(n, connID, connID)
+	seal := func(msg string) []byte {
+		return n.Shared.SealPackets(n.packetTag(encSymmetric), n.addCounters([][]byte{[]byte(msg)}), nil, 0)[0]
+	}
+
+	delayed := seal("delayed")
+	s.message(seal("moved"), newAddr)
+	assert.Equal(t, newAddr.String(), n.fromAddr().String())
+	assert.Equal(t, newAddr.String(), n.toAddr().String())
+	found, ok := s.nodeByAddr(newAddr)
+	assert.True(t, ok)
+	assert.Equal(t, n, found)
+	_, ok = s.nodeByAddr(oldAddr)
+	assert.False(t, ok)
+
+	// an older packet does not move the node back
+	s.message(delayed, oldAddr)
+	assert.Equal(t, newAddr.String(), n.fromAddr().String())
+
+	// a packet that does not authenticate does not move the node
+	forged := crypto.RandomSymmetric().SealPackets(n.packetTag(encSymmetric), [][]byte{make([]byte, 16)}, nil, 0)[0]
+	s.message(forged, oldAddr)
+	assert.Equal(t, newAddr.String(), n.fromAddr().String())
+
+	s.removeNode(n)
+	_, ok = s.nodeByConn(connID)
+	assert.False(t, ok)
+}
+
+func TestAlternatePathMessage(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+
+	addr := rnet.Port(7667).On("127.0.0.1")
+	alt := rnet.Port(7668).On("127.0.0.1")
+	_, priv := crypto.GenerateSignPair()
+	n := &node{
+		Pub:      priv.Pub(),
+		ToAddr:   addr,
+		FromAddr: addr,
+	}
+	n.setSession(crypto.RandomSymmetric())
+	s.addNode(n)
+	connID := randomConnID()
+	s.setConnIDs(n, connID, connID)
+
+	// another node is known at the alternate address
+	_, otherPriv := crypto.GenerateSignPair()
+	other := &node{Pub: otherPriv.Pub(), ToAddr: alt, FromAddr: alt}
+	s.addNode(other)
+
+	seal := func(msg string) []byte {
+		return n.Shared.SealPackets(n.packetTag(encSymmetric), n.addCounters([][]byte{[]byte(msg)}), nil, 0)[0]
+	}
+	delayed := seal("delayed")
+	s.message(seal("newest"), addr)
+	s.message(delayed, alt)
+	assert.Equal(t, addr.String(), n.fromAddr().String())
+
+	// the older packet from the alternate path is credited to the node found by
+	// its connection ID
+	r, ok := s.receiver(addr)
+	assert.True(t, ok)
+	assert.Equal(t, n, r)
+	_, ok = s.receiver(alt)
+	assert.False(t, ok)
+
+	b, err := proto.Marshal(message.NewHeader(message.Test, "body"))
+	assert.NoError(t, err)
+	h, err := s.unmarshalNetMessage(&packeter.Package{
+		Addr: addr,
+		Body: append([]byte{NoCompression}, b...),
+	})
+	if assert.NoError(t, err) {
+		assert.Equal(t, n.id()[:], h.NodeID)
+	}
+
+	s.removeNode(n)
+	_, ok = s.receiver(addr)
+	assert.False(t, ok)
+}
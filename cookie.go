@@ -0,0 +1,157 @@
+package overlay
+
+import (
+	"crypto/hmac"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"github.com/dist-ribut-us/crypto"
+	"github.com/dist-ribut-us/log"
+	"github.com/dist-ribut-us/rnet"
+	"sync"
+	"time"
+)
+
+// When more than handshakeLoadLimit handshake requests arrive in one second,
+// the server stops doing any work for a request until the sender proves it can
+// receive at its address. It does this by replying with a cookie derived from
+// the source address and a rotating secret. The sender repeats the request
+// with the cookie appended. The reply is smaller than the request so it cannot
+// be used for amplification, and the server keeps no state for it.
+var (
+	handshakeLoadLimit = 100
+	cookieRotation     = time.Minute * 2
+)
+
+const cookieLen = 16
+
+type cookieJar struct {
+	sync.Mutex
+	secret, prev [sha256.Size]byte
+	window       time.Time
+	count        int
+}
+
+func newCookieJar() *cookieJar {
+	cj := &cookieJar{}
+	cj.rotate()
+	return cj
+}
+
+// rotate replaces the secret. Cookies made with the previous secret are still
+// accepted until the next rotation.
+func (cj *cookieJar) rotate() {
+	cj.Lock()
+	cj.prev = cj.secret
+	crand.Read(cj.secret[:])
+	cj.Unlock()
+}
+
+// underLoad counts a handshake request and returns true if the rate of
+// requests in the current one second window is over handshakeLoadLimit.
+func (cj *cookieJar) underLoad() bool {
+	now := time.Now()
+	cj.Lock()
+	defer cj.Unlock()
+	if now.Sub(cj.window) > time.Second {
+		cj.window = now
+		cj.count = 0
+	}
+	cj.count++
+	return cj.count > handshakeLoadLimit
+}
+
+func makeCookie(secret []byte, addr *rnet.Addr) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(addr.String()))
+	return mac.Sum(nil)[:cookieLen]
+}
+
+func (cj *cookieJar) cookie(addr *rnet.Addr) []byte {
+	cj.Lock()
+	defer cj.Unlock()
+	return makeCookie(cj.secret[:], addr)
+}
+
+func (cj *cookieJar) valid(cookie []byte, addr *rnet.Addr) bool {
+	if len(cookie) != cookieLen {
+		return false
+	}
+	cj.Lock()
+	defer cj.Unlock()
+	return hmac.Equal(cookie, makeCookie(cj.secret[:], addr)) ||
+		hmac.Equal(cookie, makeCookie(cj.prev[:], addr))
+}
+
+// validMAC returns true if mac is the mac2 of b made with the cookie for addr.
+func (cj *cookieJar) validMAC(mac, b []byte, addr *rnet.Addr) bool {
+	cj.Lock()
+	defer cj.Unlock()
+	return hmac.Equal(mac, hiddenMAC(makeCookie(cj.secret[:], addr), b)) ||
+		hmac.Equal(mac, hiddenMAC(makeCookie(cj.prev[:], addr), b))
+}
+
+// checkCookie is called before any other processing of a handshake request.
+// If the server is under load and the request does not carry a valid cookie, a
+// cookie reply is sent and false is returned.
+func (s *Server) checkCookie(b []byte, addr *rnet.Addr) bool {
+	if !s.cookies.underLoad() {
+		return true
+	}
+	var cookie []byte
+	if l, ok := handshakeLen(b); ok && len(b) == l+crypto.SignatureLength+cookieLen {
+		cookie = b[l+crypto.SignatureLength:]
+	}
+	if s.cookies.valid(cookie, addr) {
+		return true
+	}
+	if len(b) < hsMsgLen {
+		return false
+	}
+	s.sendCookie(b[hsNonceOffset:hsNonceOffset+hsNonceLen], addr)
+	return false
+}
+
+// sendCookie sends a cookie reply that echoes the nonce of the request, or
+// mac1 for a hidden request.
+func (s *Server) sendCookie(echo []byte, addr *rnet.Addr) {
+	reply := make([]byte, 1, 1+hsNonceLen+cookieLen)
+	reply[0] = handshakeCookie
+	reply = append(reply, echo...)
+	reply = append(reply, s.cookies.cookie(addr)...)
+	log.Info(log.Lbl("sending_handshake_cookie"), addr)
+	log.Error(s.net.Send(reply, addr))
+}
+
+// handleHandshakeCookie stores the cookie on the node and repeats the
+// handshake request with the cookie attached. The cookie is only accepted if
+// it echoes the nonce of a pending request, which also finds the node.
+func (s *Server) handleHandshakeCookie(b []byte, addr *rnet.Addr) {
+	if len(b) != 1+hsNonceLen+cookieLen {
+		log.Info(log.Lbl("bad_handshake_cookie"), addr)
+		return
+	}
+	echo := b[1 : 1+hsNonceLen]
+	var n *node
+	var hidden bool
+	s.hsCache.RLock()
+	for _, p := range s.hsCache.Map {
+		var ok bool
+		if ok, hidden = p.echoed(echo); ok {
+			n = p.node
+			break
+		}
+	}
+	s.hsCache.RUnlock()
+	if n == nil {
+		log.Info(log.Lbl("handshake_cookie_unrequested"), addr)
+		return
+	}
+	if hidden {
+		// the peer only echoes mac1 after checking it against its own
+		// exchange key
+		n.xchgVerified()
+	}
+	n.cookie = append([]byte(nil), b[1+hsNonceLen:]...)
+	n.cookieAt = time.Now()
+	log.Error(s.sendHandshakeRequest(n))
+}
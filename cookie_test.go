@@ -0,0 +1,30 @@
+package overlay
+
+import (
+	"github.com/dist-ribut-us/rnet"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestCookieJar(t *testing.T) {
+	cj := newCookieJar()
+	addr := rnet.Port(7667).On("127.0.0.1")
+	other := rnet.Port(7668).On("127.0.0.1")
+
+	c := cj.cookie(addr)
+	assert.Len(t, c, cookieLen)
+	assert.True(t, cj.valid(c, addr))
+	assert.False(t, cj.valid(c, other))
+	assert.False(t, cj.valid(nil, addr))
+
+	// a cookie survives one rotation but not two
+	cj.rotate()
+	assert.True(t, cj.valid(c, addr))
+	cj.rotate()
+	assert.False(t, cj.valid(c, addr))
+
+	for i := 0; i < handshakeLoadLimit; i++ {
+		assert.False(t, cj.underLoad())
+	}
+	assert.True(t, cj.underLoad())
+}
@@ -0,0 +1,396 @@
+package overlay
+
+import (
+	crand "crypto/rand"
+	"github.com/dist-ribut-us/crypto"
+	"github.com/dist-ribut-us/ipcrouter"
+	"github.com/dist-ribut-us/log"
+	"github.com/dist-ribut-us/overlay/overlaymessages"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Kademlia parameters. bucketSize is k, the number of nodes held per bucket
+// and returned by a FindNode query. lookupAlpha is the number of queries that
+// are in flight at once during an iterative lookup.
+var (
+	bucketSize      = 20
+	lookupAlpha     = 3
+	lookupTimeout   = time.Millisecond * 500
+	refreshInterval = time.Minute * 15
+)
+
+const idBits = len(crypto.ID{}) * 8
+
+// distance returns the XOR distance between two IDs.
+func distance(a, b *crypto.ID) crypto.ID {
+	var d crypto.ID
+	for i := range d {
+		d[i] = a[i] ^ b[i]
+	}
+	return d
+}
+
+// closer returns true if a is closer to target than b is.
+func closer(target, a, b *crypto.ID) bool {
+	for i := range target {
+		da, db := a[i]^target[i], b[i]^target[i]
+		if da != db {
+			return da < db
+		}
+	}
+	return false
+}
+
+// bucketIndex returns the index of the bucket that id belongs in relative to
+// self; this is the number of leading bits they share. If the IDs are equal,
+// -1 is returned.
+func bucketIndex(self, id *crypto.ID) int {
+	d := distance(self, id)
+	for i, b := range d {
+		if b == 0 {
+			continue
+		}
+		for j := 0; j < 8; j++ {
+			if b&(0x80>>uint(j)) != 0 {
+				return i*8 + j
+			}
+		}
+	}
+	return -1
+}
+
+// randomIDInBucket returns a random ID that would fall in bucket i relative to
+// self.
+func randomIDInBucket(self *crypto.ID, i int) *crypto.ID {
+	var id crypto.ID
+	crand.Read(id[:])
+	for j := 0; j < i; j++ {
+		mask := byte(0x80 >> uint(j%8))
+		id[j/8] = (id[j/8] &^ mask) | (self[j/8] & mask)
+	}
+	mask := byte(0x80 >> uint(i%8))
+	id[i/8] = (id[i/8] &^ mask) | (^self[i/8] & mask)
+	return &id
+}
+
+type kBucket struct {
+	nodes      []*node // least recently seen first
+	lastLookup time.Time
+}
+
+// routingTable is a Kademlia routing table of k-buckets keyed on the XOR
+// distance from self.
+type routingTable struct {
+	sync.RWMutex
+	self    *crypto.ID
+	k       int
+	buckets []*kBucket
+}
+
+func newRoutingTable(self *crypto.ID, k int) *routingTable {
+	rt := &routingTable{
+		self:    self,
+		k:       k,
+		buckets: make([]*kBucket, idBits),
+	}
+	now := time.Now()
+	for i := range rt.buckets {
+		rt.buckets[i] = &kBucket{lastLookup: now}
+	}
+	return rt
+}
+
+// seen adds a node to the table or moves it to the most recently seen
+// position in its bucket. If the bucket is full, the least recently seen node
+// is evicted only if it is no longer live. Returns true if the node is in the
+// table.
+func (rt *routingTable) seen(n *node) bool {
+	id := n.id()
+	i := bucketIndex(rt.self, id)
+	if i < 0 {
+		return false
+	}
+	rt.Lock()
+	defer rt.Unlock()
+	b := rt.buckets[i]
+	for j, bn := range b.nodes {
+		if *bn.id() == *id {
+			copy(b.nodes[j:], b.nodes[j+1:])
+			b.nodes[len(b.nodes)-1] = n
+			return true
+		}
+	}
+	if len(b.nodes) < rt.k {
+		b.nodes = append(b.nodes, n)
+		return true
+	}
+	if b.nodes[0].live() {
+		return false
+	}
+	copy(b.nodes, b.nodes[1:])
+	b.nodes[len(b.nodes)-1] = n
+	return true
+}
+
+func (rt *routingTable) remove(id *crypto.ID) {
+	i := bucketIndex(rt.self, id)
+	if i < 0 {
+		return
+	}
+	rt.Lock()
+	b := rt.buckets[i]
+	for j, bn := range b.nodes {
+		if *bn.id() == *id {
+			b.nodes = append(b.nodes[:j], b.nodes[j+1:]...)
+			break
+		}
+	}
+	rt.Unlock()
+}
+
+// closest returns up to n nodes from the table ordered by distance to target.
+func (rt *routingTable) closest(target *crypto.ID, n int) []*node {
+	rt.RLock()
+	var ns []*node
+	for _, b := range rt.buckets {
+		ns = append(ns, b.nodes...)
+	}
+	rt.RUnlock()
+	sortByDistance(target, ns)
+	if len(ns) > n {
+		ns = ns[:n]
+	}
+	return ns
+}
+
+func (rt *routingTable) len() int {
+	rt.RLock()
+	var l int
+	for _, b := range rt.buckets {
+		l += len(b.nodes)
+	}
+	rt.RUnlock()
+	return l
+}
+
+// touch records a lookup in the bucket that target falls in.
+func (rt *routingTable) touch(target *crypto.ID) {
+	i := bucketIndex(rt.self, target)
+	if i < 0 {
+		return
+	}
+	rt.Lock()
+	rt.buckets[i].lastLookup = time.Now()
+	rt.Unlock()
+}
+
+// stale returns the indexes of non-empty buckets that have not had a lookup
+// within d.
+func (rt *routingTable) stale(d time.Duration) []int {
+	cutoff := time.Now().Add(-d)
+	var idxs []int
+	rt.RLock()
+	for i, b := range rt.buckets {
+		if len(b.nodes) > 0 && b.lastLookup.Before(cutoff) {
+			idxs = append(idxs, i)
+		}
+	}
+	rt.RUnlock()
+	return idxs
+}
+
+func sortByDistance(target *crypto.ID, ns []*node) {
+	sort.Slice(ns, func(i, j int) bool {
+		return closer(target, ns[i].id(), ns[j].id())
+	})
+}
+
+// resetTable creates a new routing table for the current key and fills it
+// from the known nodes.
+func (s *Server) resetTable() {
+	s.table = newRoutingTable(s.key.Pub().ID(), bucketSize)
+	for _, n := range s.all() {
+		if n.toAddr() != nil {
+			s.table.seen(n)
+		}
+	}
+}
+
+func (s *Server) contact(n *node) *overlaymessages.Contact {
+	return &overlaymessages.Contact{
+		Sign:  n.Pub,
+		Xchng: n.PubX,
+		Addr:  n.toAddr(),
+	}
+}
+
+// nodeFromContact returns the known node for a contact or adds a new one.
+// Contacts are not signed, so the address is only where to send and the
+// exchange key is not used.
+func (s *Server) nodeFromContact(c *overlaymessages.Contact) *node {
+	id := c.Sign.ID()
+	if n, ok := s.nodeByID(id); ok {
+		return n
+	}
+	n := &node{
+		Pub:      c.Sign,
+		cachedID: id,
+		ToAddr:   c.Addr,
+	}
+	s.addNode(n)
+	return n
+}
+
+func (s *Server) handleFindNodeQuery(q ipcrouter.NetQuery) {
+	target, err := crypto.IDFromSlice(q.GetBody())
+	if log.Error(err) {
+		return
+	}
+	var from *crypto.ID
+	if from, err = crypto.IDFromSlice(q.GetNodeID()); err == nil {
+		if n, ok := s.nodeByID(from); ok {
+			s.table.seen(n)
+		}
+	}
+
+	ns := s.table.closest(target, bucketSize+1)
+	cs := make([]*overlaymessages.Contact, 0, len(ns))
+	for _, n := range ns {
+		if from != nil && *n.id() == *from {
+			continue
+		}
+		if len(cs) == bucketSize {
+			break
+		}
+		cs = append(cs, s.contact(n))
+	}
+	q.Respond(overlaymessages.SerializeContacts(cs))
+}
+
+// queryFindNode sends a FindNode query to n and returns the contacts in the
+// response. If the query does not return before timeout, ok is false.
+func (s *Server) queryFindNode(n *node, target *crypto.ID, timeout time.Duration) (cs []*overlaymessages.Contact, ok bool) {
+	resp := make(chan []*overlaymessages.Contact, 1)
+	s.router.
+		Query(overlaymessages.FindNode, target[:]).
+		SetService(overlaymessages.ServiceID).
+		SendToNet(n.toAddr(), func(r ipcrouter.NetResponse) {
+			cs, err := overlaymessages.DeserializeContacts(r.GetBody())
+			log.Error(err)
+			resp <- cs
+		})
+	select {
+	case cs = <-resp:
+		return cs, true
+	case <-time.After(timeout):
+		return nil, false
+	}
+}
+
+// findNode performs an iterative lookup for target and returns the closest
+// nodes that responded, ordered by distance.
+func (s *Server) findNode(target *crypto.ID) []*node {
+	return s.lookup(target, func(n *node) ([]*overlaymessages.Contact, bool, bool) {
+		cs, ok := s.queryFindNode(n, target, lookupTimeout)
+		return cs, ok, false
+	})
+}
+
+// lookupQuery sends a single query during an iterative lookup. It returns the
+// contacts to continue the lookup with, whether the node responded and whether
+// the lookup is done.
+type lookupQuery func(n *node) (cs []*overlaymessages.Contact, ok, done bool)
+
+// lookup performs an iterative Kademlia lookup for target, calling query on
+// up to lookupAlpha nodes at a time until the k closest nodes have all been
+// queried or query reports that the lookup is done.
+func (s *Server) lookup(target *crypto.ID, query lookupQuery) []*node {
+	s.table.touch(target)
+	self := s.table.self
+	shortlist := s.table.closest(target, bucketSize)
+	queried := make(map[crypto.ID]bool)
+	responded := make(map[crypto.ID]bool)
+
+	type result struct {
+		n        *node
+		cs       []*overlaymessages.Contact
+		ok, done bool
+	}
+
+	for done := false; !done; {
+		var batch []*node
+		for _, n := range shortlist {
+			if len(batch) == lookupAlpha {
+				break
+			}
+			if !queried[*n.id()] {
+				batch = append(batch, n)
+				queried[*n.id()] = true
+			}
+		}
+		if len(batch) == 0 {
+			break
+		}
+
+		results := make(chan result, len(batch))
+		for _, n := range batch {
+			go func(n *node) {
+				cs, ok, done := query(n)
+				results <- result{n, cs, ok, done}
+			}(n)
+		}
+
+		known := make(map[crypto.ID]bool, len(shortlist))
+		for _, n := range shortlist {
+			known[*n.id()] = true
+		}
+		for range batch {
+			r := <-results
+			done = done || r.done
+			if !r.ok {
+				continue
+			}
+			responded[*r.n.id()] = true
+			s.table.seen(r.n)
+			for _, c := range r.cs {
+				if c.Sign == nil || c.Addr == nil {
+					continue
+				}
+				id := c.Sign.ID()
+				if *id == *self || known[*id] {
+					continue
+				}
+				known[*id] = true
+				shortlist = append(shortlist, s.nodeFromContact(c))
+			}
+		}
+
+		// drop nodes that failed to respond and trim to the k closest
+		trimmed := shortlist[:0]
+		for _, n := range shortlist {
+			if !queried[*n.id()] || responded[*n.id()] {
+				trimmed = append(trimmed, n)
+			}
+		}
+		shortlist = trimmed
+		sortByDistance(target, shortlist)
+		if len(shortlist) > bucketSize {
+			shortlist = shortlist[:bucketSize]
+		}
+	}
+
+	return shortlist
+}
+
+// refreshBuckets performs a lookup for a random ID in each bucket that has not
+// had a lookup in the last refreshInterval.
+func (s *Server) refreshBuckets() {
+	if s.table == nil {
+		return
+	}
+	for _, i := range s.table.stale(refreshInterval) {
+		s.findNode(randomIDInBucket(s.table.self, i))
+	}
+}
@@ -0,0 +1,349 @@
+package overlay
+
+import (
+	"crypto/sha256"
+	"github.com/dist-ribut-us/crypto"
+	"github.com/dist-ribut-us/errors"
+	"github.com/dist-ribut-us/ipcrouter"
+	"github.com/dist-ribut-us/log"
+	"github.com/dist-ribut-us/overlay/overlaymessages"
+	"sync"
+	"time"
+)
+
+var (
+	dhtBkt    = []byte("dht")
+	dhtPubBkt = []byte("dhtpub") // records published by this node
+)
+
+// DHT storage parameters. A put with a TTL of 0 uses defaultRecordTTL. Peers
+// may store at most maxPublisherRecords records from one publisher and
+// maxStoredRecords in total.
+var (
+	defaultRecordTTL    = time.Hour
+	maxRecordTTL        = time.Hour * 24
+	republishInterval   = time.Hour
+	expireInterval      = time.Minute * 10
+	maxPublisherRecords = 256
+	maxStoredRecords    = 1 << 16
+)
+
+// Errors storing DHT records
+const (
+	ErrBadSignature  = errors.String("DHT record signature is not valid")
+	ErrRecordExpired = errors.String("DHT record is expired")
+	ErrStaleRecord   = errors.String("DHT record is older than the stored record")
+	ErrRecordTTL     = errors.String("DHT record expires too far in the future")
+	ErrStoreQuota    = errors.String("DHT storage limit reached")
+)
+
+// Tags on a FindValue response
+const (
+	foundContacts = byte(iota)
+	foundValue
+)
+
+// dhtKey returns the location in the DHT of a key. Each publisher has its own
+// namespace so a key cannot be held by one publisher to keep out others.
+func dhtKey(pub *crypto.SignPub, key []byte) *crypto.ID {
+	sum := sha256.Sum256(append(pub.Slice(), key...))
+	var id crypto.ID
+	copy(id[:], sum[:])
+	return &id
+}
+
+// getRecord returns the record stored at loc. If there is no record or it has
+// expired, nil is returned.
+func (s *Server) getRecord(bkt []byte, loc *crypto.ID) (*overlaymessages.Record, error) {
+	if s.forest == nil {
+		return nil, ErrNoForest
+	}
+	b, err := s.forest.GetValue(bkt, loc[:])
+	if err != nil || len(b) == 0 {
+		return nil, err
+	}
+	r, err := overlaymessages.DeserializeRecord(b)
+	if err != nil || r.Expired() {
+		return nil, err
+	}
+	return r, nil
+}
+
+// recordCounts tracks how many records from each publisher are stored for
+// peers. It is rebuilt by expireRecords; in between, records that replace one
+// already stored are not counted again.
+type recordCounts struct {
+	sync.Mutex
+	total int
+	byPub map[crypto.ID]int
+}
+
+func newRecordCounts() *recordCounts {
+	return &recordCounts{
+		byPub: make(map[crypto.ID]int),
+	}
+}
+
+// reserve counts a new record from pub if it is within the limits.
+func (c *recordCounts) reserve(pub *crypto.ID) bool {
+	c.Lock()
+	defer c.Unlock()
+	if c.total >= maxStoredRecords || c.byPub[*pub] >= maxPublisherRecords {
+		return false
+	}
+	c.total++
+	c.byPub[*pub]++
+	return true
+}
+
+func (c *recordCounts) reset(byPub map[crypto.ID]int, total int) {
+	c.Lock()
+	c.byPub, c.total = byPub, total
+	c.Unlock()
+}
+
+// storeRecord validates a record and saves it in bkt. A stored record is only
+// replaced by one with a higher Seq. If limit is not nil, a new record must be
+// within it.
+func (s *Server) storeRecord(bkt []byte, r *overlaymessages.Record, limit *recordCounts) error {
+	if !r.Verify() {
+		return ErrBadSignature
+	}
+	if r.Expired() {
+		return ErrRecordExpired
+	}
+	if r.Expires.After(time.Now().Add(maxRecordTTL + time.Minute)) {
+		return ErrRecordTTL
+	}
+	loc := dhtKey(r.Publisher, r.Key)
+	old, err := s.getRecord(bkt, loc)
+	if err != nil {
+		return err
+	}
+	if old != nil && old.Seq > r.Seq {
+		return ErrStaleRecord
+	}
+	if old == nil && limit != nil && !limit.reserve(r.Publisher.ID()) {
+		return ErrStoreQuota
+	}
+	return s.forest.SetValue(bkt, loc[:], r.Serialize())
+}
+
+// deleteRecords removes the records at locs by writing an empty value.
+func (s *Server) deleteRecords(bkt []byte, locs [][]byte) {
+	for _, loc := range locs {
+		log.Error(s.forest.SetValue(bkt, loc, []byte{}))
+	}
+}
+
+// records calls fn for each stored record in bkt. Records that have expired or
+// cannot be decoded are removed.
+func (s *Server) records(bkt []byte, fn func(*overlaymessages.Record)) {
+	var dead [][]byte
+	for key, val, err := s.forest.First(bkt); key != nil && !log.Error(err); key, val, err = s.forest.Next(bkt, key) {
+		if len(val) == 0 {
+			continue
+		}
+		r, err := overlaymessages.DeserializeRecord(val)
+		if log.Error(err) || r.Expired() {
+			dead = append(dead, key)
+			continue
+		}
+		fn(r)
+	}
+	s.deleteRecords(bkt, dead)
+}
+
+// put signs and stores a value locally, then replicates it to the k closest
+// nodes to the key. It returns the number of remote nodes that stored it.
+func (s *Server) put(p *overlaymessages.PutRequest) (int, error) {
+	ttl := time.Duration(p.TTL) * time.Second
+	if ttl == 0 {
+		ttl = defaultRecordTTL
+	} else if ttl > maxRecordTTL {
+		ttl = maxRecordTTL
+	}
+	r := &overlaymessages.Record{
+		Key:     p.Key,
+		Value:   p.Value,
+		Expires: time.Now().Add(ttl),
+		Seq:     uint64(time.Now().UnixNano()),
+	}
+	r.Sign(s.key)
+	if err := s.storeRecord(dhtBkt, r, nil); err != nil {
+		return 0, err
+	}
+	if err := s.storeRecord(dhtPubBkt, r, nil); err != nil {
+		return 0, err
+	}
+	return s.replicate(r), nil
+}
+
+// replicate sends a Store query for r to the k closest nodes to its key.
+func (s *Server) replicate(r *overlaymessages.Record) int {
+	ns := s.findNode(dhtKey(r.Publisher, r.Key))
+	stored := make(chan bool, len(ns))
+	body := r.Serialize()
+	for _, n := range ns {
+		s.router.
+			Query(overlaymessages.Store, body).
+			SetService(overlaymessages.ServiceID).
+			SendToNet(n.toAddr(), func(r ipcrouter.NetResponse) {
+				stored <- r.BodyToUint32() == 1
+			})
+	}
+	var count int
+	timeout := time.After(lookupTimeout)
+	for range ns {
+		select {
+		case ok := <-stored:
+			if ok {
+				count++
+			}
+		case <-timeout:
+			return count
+		}
+	}
+	return count
+}
+
+// get returns the record for key published by pub, checking the local store
+// first and then performing an iterative FindValue lookup.
+func (s *Server) get(pub *crypto.SignPub, key []byte) (*overlaymessages.Record, error) {
+	loc := dhtKey(pub, key)
+	r, err := s.getRecord(dhtBkt, loc)
+	if r != nil || (err != nil && err != ErrNoForest) {
+		return r, err
+	}
+
+	found := make(chan *overlaymessages.Record, 1)
+	s.lookup(loc, func(n *node) ([]*overlaymessages.Contact, bool, bool) {
+		cs, r, ok := s.queryFindValue(n, loc)
+		if r != nil && string(r.Key) == string(key) && *r.Publisher == *pub && r.Verify() && !r.Expired() {
+			select {
+			case found <- r:
+			default:
+			}
+			return nil, ok, true
+		}
+		return cs, ok, false
+	})
+	select {
+	case r = <-found:
+		return r, nil
+	default:
+		return nil, nil
+	}
+}
+
+func (s *Server) queryFindValue(n *node, loc *crypto.ID) ([]*overlaymessages.Contact, *overlaymessages.Record, bool) {
+	type result struct {
+		cs []*overlaymessages.Contact
+		r  *overlaymessages.Record
+	}
+	resp := make(chan result, 1)
+	s.router.
+		Query(overlaymessages.FindValue, loc[:]).
+		SetService(overlaymessages.ServiceID).
+		SendToNet(n.toAddr(), func(r ipcrouter.NetResponse) {
+			var res result
+			var err error
+			if b := r.GetBody(); len(b) > 0 && b[0] == foundValue {
+				res.r, err = overlaymessages.DeserializeRecord(b[1:])
+			} else if len(b) > 0 {
+				res.cs, err = overlaymessages.DeserializeContacts(b[1:])
+			}
+			log.Error(err)
+			resp <- res
+		})
+	select {
+	case res := <-resp:
+		return res.cs, res.r, true
+	case <-time.After(lookupTimeout):
+		return nil, nil, false
+	}
+}
+
+func (s *Server) handlePutQuery(q ipcrouter.Query) {
+	p, err := overlaymessages.DeserializePutRequest(q.GetBody())
+	if log.Error(err) {
+		q.Respond(uint32(0))
+		return
+	}
+	count, err := s.put(p)
+	log.Error(err)
+	q.Respond(uint32(count))
+}
+
+func (s *Server) handleGetQuery(q ipcrouter.Query) {
+	g, err := overlaymessages.DeserializeGetRequest(q.GetBody())
+	if log.Error(err) {
+		q.Respond([]byte{})
+		return
+	}
+	r, err := s.get(g.Publisher, g.Key)
+	log.Error(err)
+	if r == nil {
+		q.Respond([]byte{})
+		return
+	}
+	q.Respond(r.Value)
+}
+
+func (s *Server) handleStoreQuery(q ipcrouter.NetQuery) {
+	r, err := overlaymessages.DeserializeRecord(q.GetBody())
+	if err == nil {
+		err = s.storeRecord(dhtBkt, r, s.dhtCounts)
+	}
+	if log.Error(err) {
+		q.Respond(uint32(0))
+		return
+	}
+	q.Respond(uint32(1))
+}
+
+func (s *Server) handleFindValueQuery(q ipcrouter.NetQuery) {
+	loc, err := crypto.IDFromSlice(q.GetBody())
+	if log.Error(err) {
+		return
+	}
+	if r, _ := s.getRecord(dhtBkt, loc); r != nil {
+		q.Respond(append([]byte{foundValue}, r.Serialize()...))
+		return
+	}
+	var cs []*overlaymessages.Contact
+	for _, n := range s.table.closest(loc, bucketSize) {
+		cs = append(cs, s.contact(n))
+	}
+	q.Respond(append([]byte{foundContacts}, overlaymessages.SerializeContacts(cs)...))
+}
+
+// republish sends every unexpired record published by this node to the
+// current k closest nodes.
+func (s *Server) republish() {
+	if s.forest == nil {
+		return
+	}
+	var rs []*overlaymessages.Record
+	s.records(dhtPubBkt, func(r *overlaymessages.Record) {
+		rs = append(rs, r)
+	})
+	for _, r := range rs {
+		s.replicate(r)
+	}
+}
+
+// expireRecords removes expired records from the DHT store and recounts the
+// records stored for each publisher.
+func (s *Server) expireRecords() {
+	if s.forest == nil {
+		return
+	}
+	byPub := make(map[crypto.ID]int)
+	var total int
+	s.records(dhtBkt, func(r *overlaymessages.Record) {
+		byPub[*r.Publisher.ID()]++
+		total++
+	})
+	s.dhtCounts.reset(byPub, total)
+}
@@ -0,0 +1,153 @@
+package overlay
+
+import (
+	"github.com/dist-ribut-us/crypto"
+	"github.com/dist-ribut-us/overlay/overlaymessages"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestRecord(t *testing.T) {
+	_, priv := crypto.GenerateSignPair()
+	r := &overlaymessages.Record{
+		Key:     []byte("key"),
+		Value:   []byte("value"),
+		Expires: time.Now().Add(time.Minute),
+		Seq:     7,
+	}
+	r.Sign(priv)
+	assert.True(t, r.Verify())
+
+	r2, err := overlaymessages.DeserializeRecord(r.Serialize())
+	assert.NoError(t, err)
+	assert.True(t, r2.Verify())
+	assert.Equal(t, r.Key, r2.Key)
+	assert.Equal(t, r.Value, r2.Value)
+	assert.Equal(t, r.Expires.Unix(), r2.Expires.Unix())
+	assert.Equal(t, r.Seq, r2.Seq)
+
+	r2.Value = []byte("tampered")
+	assert.False(t, r2.Verify())
+
+	p := &overlaymessages.PutRequest{
+		Key:   []byte("key"),
+		Value: []byte("value"),
+		TTL:   60,
+	}
+	p2, err := overlaymessages.DeserializePutRequest(p.Serialize())
+	assert.NoError(t, err)
+	assert.Equal(t, p, p2)
+
+	g := &overlaymessages.GetRequest{
+		Publisher: priv.Pub(),
+		Key:       []byte("key"),
+	}
+	g2, err := overlaymessages.DeserializeGetRequest(g.Serialize())
+	assert.NoError(t, err)
+	assert.Equal(t, g, g2)
+}
+
+func TestPutGet(t *testing.T) {
+	srvs := make([]*Server, 3)
+	for i := range srvs {
+		srvs[i] = newTestServer(t)
+		defer srvs[i].Close()
+		dir := "testDHTDir" + strconv.Itoa(i)
+		os.RemoveAll(dir)
+		defer os.RemoveAll(dir)
+		assert.NoError(t, srvs[i].Forest(crypto.RandomSymmetric(), dir))
+	}
+
+	// A knows B, B knows C, C knows A
+	for i := range srvs {
+		to := srvs[(i+1)%len(srvs)]
+		n := &node{
+			Pub:      to.key.Pub(),
+			FromAddr: to.addr,
+			ToAddr:   to.addr,
+		}
+		srvs[i].addNode(n)
+		srvs[i].table.seen(n)
+	}
+
+	count, err := srvs[0].put(&overlaymessages.PutRequest{
+		Key:   []byte("test-key"),
+		Value: []byte("test-value"),
+		TTL:   60,
+	})
+	assert.NoError(t, err)
+	assert.True(t, count > 0)
+
+	r, err := srvs[2].get(srvs[0].key.Pub(), []byte("test-key"))
+	assert.NoError(t, err)
+	if assert.NotNil(t, r) {
+		assert.Equal(t, []byte("test-value"), r.Value)
+		assert.Equal(t, srvs[0].key.Pub(), r.Publisher)
+	}
+
+	r, err = srvs[2].get(srvs[0].key.Pub(), []byte("missing-key"))
+	assert.NoError(t, err)
+	assert.Nil(t, r)
+
+	// another publisher gets its own copy of the key
+	count, err = srvs[1].put(&overlaymessages.PutRequest{
+		Key:   []byte("test-key"),
+		Value: []byte("squatter"),
+	})
+	assert.NoError(t, err)
+	assert.True(t, count > 0)
+	r, err = srvs[2].get(srvs[0].key.Pub(), []byte("test-key"))
+	assert.NoError(t, err)
+	if assert.NotNil(t, r) {
+		assert.Equal(t, []byte("test-value"), r.Value)
+	}
+	r, err = srvs[2].get(srvs[1].key.Pub(), []byte("test-key"))
+	assert.NoError(t, err)
+	if assert.NotNil(t, r) {
+		assert.Equal(t, []byte("squatter"), r.Value)
+		assert.True(t, r.Expires.After(time.Now().Add(defaultRecordTTL-time.Minute)))
+	}
+}
+
+func TestStoreRecordLimits(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+	dir := "testDHTLimitDir"
+	os.RemoveAll(dir)
+	defer os.RemoveAll(dir)
+	assert.NoError(t, s.Forest(crypto.RandomSymmetric(), dir))
+
+	defer func(m int) { maxPublisherRecords = m }(maxPublisherRecords)
+	maxPublisherRecords = 2
+	_, priv := crypto.GenerateSignPair()
+	record := func(key string, seq uint64, ttl time.Duration) *overlaymessages.Record {
+		r := &overlaymessages.Record{
+			Key:     []byte(key),
+			Value:   []byte("value"),
+			Expires: time.Now().Add(ttl),
+			Seq:     seq,
+		}
+		r.Sign(priv)
+		return r
+	}
+
+	assert.NoError(t, s.storeRecord(dhtBkt, record("a", 2, time.Hour), s.dhtCounts))
+	assert.NoError(t, s.storeRecord(dhtBkt, record("b", 2, time.Hour), s.dhtCounts))
+	assert.Equal(t, ErrStoreQuota, s.storeRecord(dhtBkt, record("c", 2, time.Hour), s.dhtCounts))
+
+	// a newer record with a shorter TTL replaces the stored one, an older one
+	// does not
+	assert.NoError(t, s.storeRecord(dhtBkt, record("a", 3, time.Minute), s.dhtCounts))
+	assert.Equal(t, ErrStaleRecord, s.storeRecord(dhtBkt, record("a", 1, time.Hour), s.dhtCounts))
+	r, err := s.getRecord(dhtBkt, dhtKey(priv.Pub(), []byte("a")))
+	assert.NoError(t, err)
+	if assert.NotNil(t, r) {
+		assert.Equal(t, uint64(3), r.Seq)
+	}
+
+	s.expireRecords()
+	assert.Equal(t, 2, s.dhtCounts.byPub[*priv.Pub().ID()])
+}
@@ -0,0 +1,147 @@
+package overlay
+
+import (
+	"github.com/dist-ribut-us/crypto"
+	"github.com/dist-ribut-us/ipcrouter"
+	"github.com/dist-ribut-us/overlay/overlaymessages"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestBucketIndex(t *testing.T) {
+	var a, b crypto.ID
+	assert.Equal(t, -1, bucketIndex(&a, &b))
+
+	b[0] = 0x80
+	assert.Equal(t, 0, bucketIndex(&a, &b))
+
+	b[0] = 0x01
+	assert.Equal(t, 7, bucketIndex(&a, &b))
+
+	b[0], b[1] = 0, 0x40
+	assert.Equal(t, 9, bucketIndex(&a, &b))
+
+	_, priv := crypto.GenerateSignPair()
+	self := priv.Pub().ID()
+	for i := 0; i < idBits; i += 7 {
+		assert.Equal(t, i, bucketIndex(self, randomIDInBucket(self, i)))
+	}
+}
+
+func TestRoutingTable(t *testing.T) {
+	var self crypto.ID
+	rt := newRoutingTable(&self, 2)
+
+	var ns []*node
+	for i := 0; i < 10; i++ {
+		_, priv := crypto.GenerateSignPair()
+		n := &node{Pub: priv.Pub()}
+		ns = append(ns, n)
+		rt.seen(n)
+	}
+	assert.True(t, rt.len() <= 10)
+
+	target := ns[0].id()
+	closest := rt.closest(target, 3)
+	assert.True(t, len(closest) <= 3)
+	for i := 1; i < len(closest); i++ {
+		assert.False(t, closer(target, closest[i].id(), closest[i-1].id()))
+	}
+
+	rt.remove(ns[0].id())
+	for _, n := range rt.closest(target, rt.len()) {
+		assert.NotEqual(t, *ns[0].id(), *n.id())
+	}
+}
+
+func newTestServer(t *testing.T) *Server {
+	router, err := ipcrouter.New(getPort.Next())
+	assert.NoError(t, err)
+	s, err := NewServer(router, getPort.Next())
+	assert.NoError(t, err)
+	s.setIP(t, "127.0.0.1")
+	s.RandomKey()
+	go s.Run()
+	return s
+}
+
+// newTestChain creates servers where each server only knows the next server in
+// the chain.
+func newTestChain(t *testing.T, l int) []*Server {
+	srvs := make([]*Server, l)
+	for i := range srvs {
+		srvs[i] = newTestServer(t)
+	}
+	for i := 0; i < len(srvs)-1; i++ {
+		n := &node{
+			Pub:      srvs[i+1].key.Pub(),
+			FromAddr: srvs[i+1].addr,
+			ToAddr:   srvs[i+1].addr,
+		}
+		srvs[i].addNode(n)
+		srvs[i].table.seen(n)
+	}
+	return srvs
+}
+
+func TestFindNode(t *testing.T) {
+	srvs := newTestChain(t, 4)
+	for _, s := range srvs {
+		defer s.Close()
+	}
+
+	target := srvs[3].key.Pub().ID()
+	found := srvs[0].findNode(target)
+	if assert.NotEmpty(t, found) {
+		assert.Equal(t, *target, *found[0].id())
+	}
+	_, ok := srvs[0].nodeByID(target)
+	assert.True(t, ok)
+}
+
+func TestResolveNode(t *testing.T) {
+	srvs := newTestChain(t, 3)
+	for _, s := range srvs {
+		defer s.Close()
+	}
+
+	target := srvs[2].key.Pub().ID()
+	_, ok := srvs[0].nodeByID(target)
+	assert.False(t, ok)
+	n, ok := srvs[0].resolveNode(target)
+	if assert.True(t, ok) {
+		assert.Equal(t, *target, *n.id())
+	}
+
+	_, priv := crypto.GenerateSignPair()
+	_, ok = srvs[0].resolveNode(priv.Pub().ID())
+	assert.False(t, ok)
+}
+
+func TestNodeFromContact(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+	addr := getPort.Next().On("127.0.0.1")
+	knownPub, _ := crypto.GenerateSignPair()
+	known := &node{
+		Pub:      knownPub,
+		FromAddr: addr,
+		ToAddr:   addr,
+	}
+	s.addNode(known)
+
+	// an unsigned contact claiming the address of a known node does not take
+	// it over and its exchange key is not used
+	pub, _ := crypto.GenerateSignPair()
+	n := s.nodeFromContact(&overlaymessages.Contact{
+		Sign:  pub,
+		Xchng: crypto.GenerateXchgPair().Pub(),
+		Addr:  addr,
+	})
+	assert.Nil(t, n.PubX)
+	assert.Nil(t, n.fromAddr())
+	assert.Equal(t, addr.String(), n.toAddr().String())
+	found, ok := s.nodeByAddr(addr)
+	assert.True(t, ok)
+	assert.Equal(t, known, found)
+}
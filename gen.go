@@ -1,9 +1,9 @@
 package overlay
 
 import (
-  "github.com/dist-ribut-us/crypto"
   "github.com/dist-ribut-us/rnet"
   "sync"
+  "time"
 )
 
 type portmap struct {
@@ -38,31 +38,223 @@ func (t *portmap) delete(keys ...uint32) {
 	t.Unlock()
 }
 
-type xchgPairs struct {
-	Map map[string]*crypto.XchgPair
+type pendingHandshakes struct {
+	Map map[string]*pendingHandshake
 	sync.RWMutex
 }
 
-func newxchgPairs() *xchgPairs {
-	return &xchgPairs{
-		Map: make(map[string]*crypto.XchgPair),
+func newpendingHandshakes() *pendingHandshakes {
+	return &pendingHandshakes{
+		Map: make(map[string]*pendingHandshake),
 	}
 }
 
-func (t *xchgPairs) get(key string) (*crypto.XchgPair, bool) {
+func (t *pendingHandshakes) get(key string) (*pendingHandshake, bool) {
 	t.RLock()
 	k, b := t.Map[key]
 	t.RUnlock()
 	return k, b
 }
 
-func (t *xchgPairs) set(key string, val *crypto.XchgPair) {
+func (t *pendingHandshakes) set(key string, val *pendingHandshake) {
 	t.Lock()
 	t.Map[key] = val
 	t.Unlock()
 }
 
-func (t *xchgPairs) delete(keys ...string) {
+func (t *pendingHandshakes) delete(keys ...string) {
+	t.Lock()
+	for _, key := range keys {
+		delete(t.Map, key)
+	}
+	t.Unlock()
+}
+
+type hiddenHandshakes struct {
+	Map map[string]*pendingHandshake
+	sync.RWMutex
+}
+
+func newhiddenHandshakes() *hiddenHandshakes {
+	return &hiddenHandshakes{
+		Map: make(map[string]*pendingHandshake),
+	}
+}
+
+func (t *hiddenHandshakes) get(key string) (*pendingHandshake, bool) {
+	t.RLock()
+	k, b := t.Map[key]
+	t.RUnlock()
+	return k, b
+}
+
+func (t *hiddenHandshakes) set(key string, val *pendingHandshake) {
+	t.Lock()
+	t.Map[key] = val
+	t.Unlock()
+}
+
+func (t *hiddenHandshakes) delete(keys ...string) {
+	t.Lock()
+	for _, key := range keys {
+		delete(t.Map, key)
+	}
+	t.Unlock()
+}
+
+type circuits struct {
+	Map map[uint32]*circuit
+	sync.RWMutex
+}
+
+func newcircuits() *circuits {
+	return &circuits{
+		Map: make(map[uint32]*circuit),
+	}
+}
+
+func (t *circuits) get(key uint32) (*circuit, bool) {
+	t.RLock()
+	k, b := t.Map[key]
+	t.RUnlock()
+	return k, b
+}
+
+func (t *circuits) set(key uint32, val *circuit) {
+	t.Lock()
+	t.Map[key] = val
+	t.Unlock()
+}
+
+func (t *circuits) delete(keys ...uint32) {
+	t.Lock()
+	for _, key := range keys {
+		delete(t.Map, key)
+	}
+	t.Unlock()
+}
+
+type hopCircuits struct {
+	Map map[uint32]*hopCircuit
+	sync.RWMutex
+}
+
+func newhopCircuits() *hopCircuits {
+	return &hopCircuits{
+		Map: make(map[uint32]*hopCircuit),
+	}
+}
+
+func (t *hopCircuits) get(key uint32) (*hopCircuit, bool) {
+	t.RLock()
+	k, b := t.Map[key]
+	t.RUnlock()
+	return k, b
+}
+
+func (t *hopCircuits) set(key uint32, val *hopCircuit) {
+	t.Lock()
+	t.Map[key] = val
+	t.Unlock()
+}
+
+func (t *hopCircuits) delete(keys ...uint32) {
+	t.Lock()
+	for _, key := range keys {
+		delete(t.Map, key)
+	}
+	t.Unlock()
+}
+
+type replayCache struct {
+	Map map[string]time.Time
+	sync.RWMutex
+}
+
+func newreplayCache() *replayCache {
+	return &replayCache{
+		Map: make(map[string]time.Time),
+	}
+}
+
+func (t *replayCache) get(key string) (time.Time, bool) {
+	t.RLock()
+	k, b := t.Map[key]
+	t.RUnlock()
+	return k, b
+}
+
+func (t *replayCache) set(key string, val time.Time) {
+	t.Lock()
+	t.Map[key] = val
+	t.Unlock()
+}
+
+func (t *replayCache) delete(keys ...string) {
+	t.Lock()
+	for _, key := range keys {
+		delete(t.Map, key)
+	}
+	t.Unlock()
+}
+
+type pendingQueries struct {
+	Map map[uint32]*pendingQuery
+	sync.RWMutex
+}
+
+func newpendingQueries() *pendingQueries {
+	return &pendingQueries{
+		Map: make(map[uint32]*pendingQuery),
+	}
+}
+
+func (t *pendingQueries) get(key uint32) (*pendingQuery, bool) {
+	t.RLock()
+	k, b := t.Map[key]
+	t.RUnlock()
+	return k, b
+}
+
+func (t *pendingQueries) set(key uint32, val *pendingQuery) {
+	t.Lock()
+	t.Map[key] = val
+	t.Unlock()
+}
+
+func (t *pendingQueries) delete(keys ...uint32) {
+	t.Lock()
+	for _, key := range keys {
+		delete(t.Map, key)
+	}
+	t.Unlock()
+}
+
+type pendingProbes struct {
+	Map map[uint64]*sentProbe
+	sync.RWMutex
+}
+
+func newpendingProbes() *pendingProbes {
+	return &pendingProbes{
+		Map: make(map[uint64]*sentProbe),
+	}
+}
+
+func (t *pendingProbes) get(key uint64) (*sentProbe, bool) {
+	t.RLock()
+	k, b := t.Map[key]
+	t.RUnlock()
+	return k, b
+}
+
+func (t *pendingProbes) set(key uint64, val *sentProbe) {
+	t.Lock()
+	t.Map[key] = val
+	t.Unlock()
+}
+
+func (t *pendingProbes) delete(keys ...uint64) {
 	t.Lock()
 	for _, key := range keys {
 		delete(t.Map, key)
@@ -1,6 +1,8 @@
 package overlay
 
 import (
+	crand "crypto/rand"
+	"encoding/binary"
 	"github.com/dist-ribut-us/crypto"
 	"github.com/dist-ribut-us/errors"
 	"github.com/dist-ribut-us/ipcrouter"
@@ -8,106 +10,370 @@ import (
 	"github.com/dist-ribut-us/message"
 	"github.com/dist-ribut-us/overlay/overlaymessages"
 	"github.com/dist-ribut-us/rnet"
+	"sync"
 	"time"
 )
 
+// Handshake freshness. A handshake is rejected if its timestamp differs from
+// the local clock by more than handshakeMaxSkew. Nonces are remembered for
+// twice that long so a handshake cannot be replayed inside the window.
+var handshakeMaxSkew = time.Second * 30
+
 const (
-	hsMsgLen  = 1 + crypto.KeyLength*2
-	hsFullLen = hsMsgLen + crypto.SignatureLength
+	hsNonceLen    = 16
+	hsNonceOffset = 1 + crypto.KeyLength*2 + 8
+	hsMsgLen      = hsNonceOffset + hsNonceLen
+	hsRespLen     = hsMsgLen + hsNonceLen
 )
 
-func buildHandshake(kind byte, xchg *crypto.XchgPub, sign *crypto.SignPriv) []byte {
-	hs := make([]byte, hsMsgLen, hsFullLen)
-	hs[0] = kind
-	copy(hs[1:], xchg.Slice())
-	copy(hs[1+crypto.KeyLength:], sign.Pub().Slice())
-	return append(hs, sign.Sign(hs)...)
+type hsNonce [hsNonceLen]byte
+
+// handshake is the signed payload of a handshake request or response. A
+// response includes the nonce of the request it answers in peerNonce. Both
+// end with the versions and features the sender supports and the connection
+// ID the sender receives on.
+type handshake struct {
+	kind      byte
+	xchg      *crypto.XchgPub
+	sign      *crypto.SignPub
+	timestamp time.Time
+	nonce     hsNonce
+	peerNonce hsNonce
+	versions  []uint16
+	features  feature
+	connID    uint64
+}
+
+func newHandshake(kind byte, xchg *crypto.XchgPub) *handshake {
+	hs := &handshake{
+		kind:      kind,
+		xchg:      xchg,
+		timestamp: time.Now(),
+		versions:  supportedVersions,
+		features:  supportedFeatures,
+	}
+	crand.Read(hs.nonce[:])
+	return hs
+}
+
+// fixedLen is the length of the handshake before the offer.
+func (hs *handshake) fixedLen() int {
+	if hs.kind == handshakeResponse {
+		return hsRespLen
+	}
+	return hsMsgLen
+}
+
+// handshakeLen returns the length of the signed part of a handshake.
+func handshakeLen(b []byte) (int, bool) {
+	if len(b) < 1 {
+		return 0, false
+	}
+	l := (&handshake{kind: b[0]}).fixedLen()
+	if len(b) < l {
+		return 0, false
+	}
+	ol, ok := offerLen(b[l:])
+	l += ol + connIDLen
+	return l, ok && len(b) >= l
+}
+
+func buildHandshake(hs *handshake, sign *crypto.SignPriv) []byte {
+	hs.sign = sign.Pub()
+	l := hs.fixedLen()
+	b := make([]byte, l, l+1+len(hs.versions)*2+4+connIDLen+crypto.SignatureLength)
+	b[0] = hs.kind
+	copy(b[1:], hs.xchg.Slice())
+	copy(b[1+crypto.KeyLength:], hs.sign.Slice())
+	binary.BigEndian.PutUint64(b[1+crypto.KeyLength*2:], uint64(hs.timestamp.UnixNano()))
+	copy(b[hsNonceOffset:], hs.nonce[:])
+	if hs.kind == handshakeResponse {
+		copy(b[hsMsgLen:], hs.peerNonce[:])
+	}
+	b = appendOffer(b, hs.versions, hs.features)
+	var cb [connIDLen]byte
+	binary.BigEndian.PutUint64(cb[:], hs.connID)
+	b = append(b, cb[:]...)
+	return append(b, sign.Sign(b)...)
 }
 
-func validateHandshake(hs []byte, expectedSignPub *crypto.SignPub) (*crypto.SignPub, *crypto.XchgPub, bool) {
-	if len(hs) < hsFullLen {
-		return nil, nil, false
+// validateHandshake checks the signature and freshness of a handshake. It does
+// not check the replay cache.
+func validateHandshake(b []byte, expectedSignPub *crypto.SignPub) (*handshake, bool) {
+	l, ok := handshakeLen(b)
+	if !ok || len(b) < l+crypto.SignatureLength {
+		return nil, false
+	}
+	hs := &handshake{
+		kind: b[0],
+	}
+	hs.sign = crypto.SignPubFromSlice(b[1+crypto.KeyLength : 1+crypto.KeyLength*2])
+	if (expectedSignPub != nil && *hs.sign != *expectedSignPub) || !hs.sign.Verify(b[:l], b[l:l+crypto.SignatureLength]) {
+		return nil, false
 	}
-	signPub := crypto.SignPubFromSlice(hs[1+crypto.KeyLength : hsMsgLen])
-	if (expectedSignPub != nil && *signPub != *expectedSignPub) || !signPub.Verify(hs[:hsMsgLen], hs[hsMsgLen:]) {
-		return nil, nil, false
+	hs.xchg = crypto.XchgPubFromSlice(b[1 : 1+crypto.KeyLength])
+	hs.timestamp = time.Unix(0, int64(binary.BigEndian.Uint64(b[1+crypto.KeyLength*2:])))
+	if skew := time.Since(hs.timestamp); skew > handshakeMaxSkew || skew < -handshakeMaxSkew {
+		return nil, false
 	}
+	copy(hs.nonce[:], b[hsNonceOffset:])
+	if hs.kind == handshakeResponse {
+		copy(hs.peerNonce[:], b[hsMsgLen:])
+	}
+	hs.versions, hs.features = readOffer(b[hs.fixedLen():])
+	hs.connID = binary.BigEndian.Uint64(b[l-connIDLen:])
+	return hs, true
+}
+
+// ErrReplayedHandshake is logged when a handshake nonce has already been seen
+const ErrReplayedHandshake = errors.String("Handshake has been replayed")
 
-	xchgPub := crypto.XchgPubFromSlice(hs[1 : crypto.KeyLength+1])
-	return signPub, xchgPub, true
+// checkReplay returns false if the nonce has been seen inside the freshness
+// window, otherwise it records the nonce.
+func (s *Server) checkReplay(hs *handshake) bool {
+	key := string(hs.nonce[:])
+	s.replayCache.Lock()
+	defer s.replayCache.Unlock()
+	if _, seen := s.replayCache.Map[key]; seen {
+		return false
+	}
+	s.replayCache.Map[key] = hs.timestamp
+	return true
+}
+
+// expireReplayCache removes nonces that are old enough that validateHandshake
+// would reject them on timestamp alone.
+func (s *Server) expireReplayCache() {
+	cutoff := time.Now().Add(-2 * handshakeMaxSkew)
+	s.replayCache.Lock()
+	for key, ts := range s.replayCache.Map {
+		if ts.Before(cutoff) {
+			delete(s.replayCache.Map, key)
+		}
+	}
+	s.replayCache.Unlock()
+}
+
+// pendingHandshake holds the ephemeral key of a handshake attempt. The key is
+// kept for the whole attempt and a response to any request sent in it is
+// accepted, so a slow response is not lost to a retransmit.
+type pendingHandshake struct {
+	node    *node
+	keypair *crypto.XchgPair
+	connID  uint64
+
+	sync.Mutex
+	nonces []hsNonce
+	offer  *handshake        // last request sent
+	hidden *crypto.Symmetric // set if the request was sent hidden
+	mac1   []byte            // mac1 of the last hidden request
+}
+
+// sent records a request sent for the handshake.
+func (p *pendingHandshake) sent(req *handshake) {
+	p.Lock()
+	p.nonces = append(p.nonces, req.nonce)
+	p.offer = req
+	p.Unlock()
+}
+
+// answers returns the request sent for the handshake that has the nonce.
+func (p *pendingHandshake) answers(nonce hsNonce) (*handshake, bool) {
+	p.Lock()
+	defer p.Unlock()
+	for _, n := range p.nonces {
+		if n == nonce {
+			return p.offer, true
+		}
+	}
+	return nil, false
+}
+
+// echoed returns true if echo is the nonce of a request sent for the
+// handshake or the mac1 of the last hidden request. hidden is true for mac1.
+func (p *pendingHandshake) echoed(echo []byte) (ok, hidden bool) {
+	p.Lock()
+	defer p.Unlock()
+	if p.mac1 != nil && string(echo) == string(p.mac1) {
+		return true, true
+	}
+	for _, n := range p.nonces {
+		if string(echo) == string(n[:]) {
+			return true, false
+		}
+	}
+	return false, false
+}
+
+func (p *pendingHandshake) hiddenKey() *crypto.Symmetric {
+	p.Lock()
+	defer p.Unlock()
+	return p.hidden
 }
 
 // ErrBadSignPub is returned if a node id does not match
 var ErrBadSignPub = errors.String("Public Signature Key does not match")
 
-func (s *Server) handleHandshakeRequest(hs []byte, addr *rnet.Addr) {
-	signPub, xchgPub, ok := validateHandshake(hs, nil)
-	if !ok {
-		log.Info(log.Lbl("handshake_validation_failed"), addr)
+func (s *Server) handleHandshakeRequest(b []byte, addr *rnet.Addr) {
+	if !s.checkCookie(b, addr) {
 		return
 	}
-	log.Info(log.Lbl("handshake_request_success"), addr)
+	if resp, _ := s.acceptHandshake(b, addr, nil, nil); resp != nil {
+		log.Info(log.Lbl("sending_handshake_resp"), addr)
+		log.Error(s.net.Send(resp, addr))
+	}
+}
 
-	id := signPub.ID()
+// acceptHandshake validates a handshake request, sets up the session and
+// returns the response to send and the ID that signed the request. If eph is
+// not nil, the request must use it as its exchange key. If relay is not nil,
+// the request was passed on by it and addr is only a candidate path.
+func (s *Server) acceptHandshake(b []byte, addr *rnet.Addr, eph *crypto.XchgPub, relay *node) ([]byte, *crypto.ID) {
+	req, ok := validateHandshake(b, nil)
+	if !ok || (eph != nil && *req.xchg != *eph) {
+		log.Info(log.Lbl("handshake_validation_failed"), addr)
+		return nil, nil
+	}
+	if !s.checkReplay(req) {
+		log.Info(log.Lbl("handshake_replayed"), addr)
+		return nil, nil
+	}
+	resp := newHandshake(handshakeResponse, nil)
+	version, features, ok := negotiate(req, resp)
+	if !ok {
+		log.Info(log.Lbl("handshake_rejected"), addr, ErrNoCommonVersion)
+		return nil, nil
+	}
+	log.Info(log.Lbl("handshake_request_success"), addr, version)
+
+	id := req.sign.ID()
 	// in the unlikely case that we both made the request at the same time
-	keypair, _ := s.xchgCache.get(id.String())
-	if keypair == nil {
-		keypair = crypto.GenerateXchgPair()
+	var keypair *crypto.XchgPair
+	var connID uint64
+	if p, ok := s.hsCache.get(id.String()); ok {
+		keypair, connID = p.keypair, p.connID
+	} else {
+		keypair, connID = crypto.GenerateXchgPair(), randomConnID()
 	}
 
-	if n, ok := s.nodeByAddr(addr); ok {
-		if n.Pub != nil && *n.Pub != *signPub {
-			log.Error(ErrBadSignPub)
-			return
+	// the node is found by the ID that signed the request; the address may be
+	// stale or held by another node
+	n, ok := s.nodeByID(id)
+	if ok && n.Pub != nil && *n.Pub != *req.sign {
+		log.Error(ErrBadSignPub)
+		return nil, nil
+	}
+	if !ok {
+		from := addr
+		if relay != nil {
+			// the relay chooses addr, so it must not take over a node
+			if _, taken := s.nodeByAddr(addr); taken {
+				from = nil
+			}
 		}
-		n.Shared = keypair.Shared(xchgPub)
-		n.liveTil = time.Now().Add(time.Duration(s.NodeTTL) * time.Second)
-	} else {
-		n := &node{
+		s.addNode(&node{
 			cachedID: id,
-			Pub:      signPub,
-			Shared:   keypair.Shared(xchgPub),
-			FromAddr: addr,
-			ToAddr:   addr, // This may not be right, but it's a good guess
-			liveTil:  time.Now().Add(time.Duration(s.NodeTTL) * time.Second),
+			Pub:      req.sign,
+			FromAddr: from,
+			ToAddr:   addr, // A good guess, probing finds other paths
+		})
+		if n, ok = s.nodeByID(id); !ok {
+			return nil, nil
 		}
-		s.addNode(n)
 	}
+	if relay == nil {
+		// the request was signed by n and sent from addr
+		s.roam(n, addr)
+	}
+	n.setSession(keypair.Shared(req.xchg))
+	n.version, n.features = version, features
+	n.liveTil = time.Now().Add(time.Duration(s.NodeTTL) * time.Second)
+	s.table.seen(n)
+	if relay != nil {
+		n.addPath(addr, addrKind(addr))
+		n.addRelayPath(relay)
+		n.relaySeen(relay)
+	}
+	s.selectPath(n)
+	s.setConnIDs(n, connID, req.connID)
+	s.handshakeComplete(n)
 
-	resp := buildHandshake(handshakeResponse, keypair.Pub(), s.key)
-	log.Info(log.Lbl("sending_handshake_resp"), addr)
-	log.Error(s.net.Send(resp, addr))
+	resp.xchg = keypair.Pub()
+	resp.peerNonce = req.nonce
+	resp.connID = connID
+	return buildHandshake(resp, s.key), id
 }
 
 // how long a node stays live after a handshake regardless of TTL
 var handshakeLiveBuffer = time.Second * 10
 
-func (s *Server) handleHandshakeResponse(hs []byte, addr *rnet.Addr) {
+func (s *Server) handleHandshakeResponse(b []byte, addr *rnet.Addr) {
+	s.completeHandshake(b, addr, nil)
+}
+
+// completeHandshake sets up the session from a handshake response. If relay is
+// not nil, the response was passed on by it and it must have been selected as
+// a relay for the node.
+func (s *Server) completeHandshake(b []byte, addr *rnet.Addr, relay *node) {
 	// TODO: validate addr matches node
-	signPub, xchgPub, ok := validateHandshake(hs, nil)
+	resp, ok := validateHandshake(b, nil)
 	if !ok {
 		log.Info(log.Lbl("handshake_validation_failed"), addr)
 		return
 	}
-	log.Info(log.Lbl("handshake_response_success"), addr)
-	id := signPub.ID()
+	id := resp.sign.ID()
 	idStr := id.String()
-	keypair, ok := s.xchgCache.get(idStr)
+	pending, ok := s.hsCache.get(idStr)
+	var offer *handshake
+	if ok {
+		offer, ok = pending.answers(resp.peerNonce)
+	}
 	if !ok {
 		log.Info(log.Lbl("handshake_response_from_unrequested"), addr)
+		return
+	}
+	version, features, ok := negotiate(offer, resp)
+	if !ok {
+		log.Info(log.Lbl("handshake_rejected"), addr, ErrNoCommonVersion)
+		return
 	}
 	n, ok := s.nodeByID(id)
 	if !ok {
 		log.Info(log.Lbl("handshake_response_from_unknown"), addr)
+		return
 	}
-	n.Shared = keypair.Shared(xchgPub)
+	if relay != nil && !n.relayed(relay) {
+		log.Info(log.Lbl("relay_not_selected"), addr)
+		return
+	}
+	if !s.checkReplay(resp) {
+		log.Info(log.Lbl("handshake_replayed"), addr)
+		return
+	}
+	s.hsCache.delete(idStr)
+	s.hsHidden.delete(string(pending.keypair.Pub().Slice()))
+	log.Info(log.Lbl("handshake_response_success"), addr)
+	n.setSession(pending.keypair.Shared(resp.xchg))
+	n.version, n.features = version, features
+	s.setConnIDs(n, pending.connID, resp.connID)
+	if relay != nil {
+		n.relaySeen(relay)
+	} else if from := n.fromAddr(); from == nil || from.String() != addr.String() {
+		// the response is signed, so the node is at addr
+		s.roam(n, addr)
+	} else {
+		n.addPath(addr, addrKind(addr))
+		n.pathSeen(addr)
+	}
+	s.selectPath(n)
 
 	n.liveTil = time.Now().Add(time.Duration(s.NodeTTL) * time.Second)
+	s.table.seen(n)
 
 	s.router.
 		Query(message.SessionData, s.NodeTTL).
 		SetService(overlaymessages.ServiceID).
-		SendToNet(n.ToAddr, func(r ipcrouter.NetResponse) {
+		SendToNet(n.toAddr(), func(r ipcrouter.NetResponse) {
 			ttl := r.BodyToUint32()
 			if ttl > s.NodeTTL {
 				ttl = s.NodeTTL
@@ -116,36 +382,83 @@ func (s *Server) handleHandshakeResponse(hs []byte, addr *rnet.Addr) {
 			n.liveTil = time.Now().Add(n.TTL)
 		})
 
-	if n.hsCallback != nil {
-		go n.hsCallback()
-		n.hsCallback = nil
-	}
+	s.handshakeComplete(n)
 }
 
-func (s *Server) sendHandshakeRequest(n *node, callback func()) error {
+func (s *Server) sendHandshakeRequest(n *node) error {
 	id := n.id()
 	idStr := id.String()
 
-	keypair, ok := s.xchgCache.get(idStr)
+	p, ok := s.hsCache.get(idStr)
 	if !ok {
-		keypair = crypto.GenerateXchgPair()
-		s.xchgCache.set(idStr, keypair)
-		go s.removeXchgPair(idStr)
+		p = &pendingHandshake{
+			node:    n,
+			keypair: crypto.GenerateXchgPair(),
+			connID:  randomConnID(),
+		}
+		s.hsCache.set(idStr, p)
+		n.Lock()
+		deadline := n.hsDeadline
+		n.Unlock()
+		if time.Until(deadline) <= 0 {
+			deadline = time.Now().Add(handshakeTimeout)
+		}
+		time.AfterFunc(time.Until(deadline), func() { s.removePendingHandshake(idStr, p) })
 	}
 
-	hs := buildHandshake(handshakeRequest, keypair.Pub(), s.key)
-	n.hsCallback = callback
+	req := newHandshake(handshakeRequest, p.keypair.Pub())
+	req.connID = p.connID
+	p.sent(req)
+	hs := buildHandshake(req, s.key)
+	var cookie []byte
+	if n.cookie != nil && time.Since(n.cookieAt) < cookieRotation {
+		cookie = n.cookie
+	}
+	if s.sendHidden(n, p) {
+		key := p.keypair.Shared(n.PubX)
+		hs = sealHidden(hiddenHandshakeRequest, p.keypair.Pub(), key, hs)
+		hs = addHiddenMACs(hs, n.PubX, cookie)
+		p.Lock()
+		p.hidden = key
+		p.mac1 = hs[len(hs)-2*hiddenMACLen : len(hs)-hiddenMACLen]
+		p.Unlock()
+		s.hsHidden.set(string(p.keypair.Pub().Slice()), p)
+	} else if cookie != nil {
+		hs = append(hs, cookie...)
+	}
 
-	log.Info(log.Lbl("sending_handshake_request"), n.ToAddr)
-	err := s.net.Send(hs, n.ToAddr)
-	return err
+	log.Info(log.Lbl("sending_handshake_request"), n.toAddr())
+	n.Lock()
+	punch := n.hsPunchAddr
+	n.Unlock()
+	if punch != nil {
+		log.Error(s.net.Send(hs, punch))
+	}
+	return s.sendTo(n, hs)
 }
 
-var removeKeyDelay = time.Second * 2
+// sendHidden returns true if the next request for the attempt should be hidden.
+// Only the first request is hidden unless PubX is known to be right, so a wrong
+// key costs one retry rather than the whole attempt.
+func (s *Server) sendHidden(n *node, p *pendingHandshake) bool {
+	if !hideIdentity || n.PubX == nil {
+		return false
+	}
+	n.Lock()
+	ok := n.hsXchgOK
+	n.Unlock()
+	return ok || p.hiddenKey() == nil
+}
 
-func (s *Server) removeXchgPair(id string) {
-	time.Sleep(removeKeyDelay)
-	s.xchgCache.delete(id)
+// removePendingHandshake drops the pending handshake at the end of the
+// attempt.
+func (s *Server) removePendingHandshake(id string, p *pendingHandshake) {
+	s.hsCache.Lock()
+	if s.hsCache.Map[id] == p {
+		delete(s.hsCache.Map, id)
+	}
+	s.hsCache.Unlock()
+	s.hsHidden.delete(string(p.keypair.Pub().Slice()))
 }
 
 func (s *Server) handleSessionDataQuery(q ipcrouter.NetQuery) {
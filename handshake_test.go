@@ -4,30 +4,126 @@ import (
 	"github.com/dist-ribut-us/crypto"
 	"github.com/stretchr/testify/assert"
 	"testing"
+	"time"
 )
 
 func TestHandshakeFormat(t *testing.T) {
 	ax := crypto.GenerateXchgPair()
 	_, as := crypto.GenerateSignPair()
 
-	hs := buildHandshake(handshakeRequest, ax.Pub(), as)
-	assert.Equal(t, hs[0], handshakeRequest)
+	req := newHandshake(handshakeRequest, ax.Pub())
+	b := buildHandshake(req, as)
+	assert.Equal(t, b[0], handshakeRequest)
 
-	s, x, ok := validateHandshake(hs, nil)
+	hs, ok := validateHandshake(b, nil)
 	assert.True(t, ok)
-	if assert.NotNil(t, s) && assert.NotNil(t, x) {
-		assert.Equal(t, as.Pub(), s)
-		assert.Equal(t, ax.Pub(), x)
+	if assert.NotNil(t, hs) {
+		assert.Equal(t, as.Pub(), hs.sign)
+		assert.Equal(t, ax.Pub(), hs.xchg)
+		assert.Equal(t, req.nonce, hs.nonce)
 	}
 
-	s, x, ok = validateHandshake(hs, as.Pub())
+	hs, ok = validateHandshake(b, as.Pub())
 	assert.True(t, ok)
-	if assert.NotNil(t, s) && assert.NotNil(t, x) {
-		assert.Equal(t, as.Pub(), s)
-		assert.Equal(t, ax.Pub(), x)
+	if assert.NotNil(t, hs) {
+		assert.Equal(t, as.Pub(), hs.sign)
+		assert.Equal(t, ax.Pub(), hs.xchg)
 	}
 
 	_, other := crypto.GenerateSignPair()
-	_, _, ok = validateHandshake(hs, other.Pub())
+	_, ok = validateHandshake(b, other.Pub())
 	assert.False(t, ok)
+
+	resp := newHandshake(handshakeResponse, ax.Pub())
+	resp.peerNonce = req.nonce
+	hs, ok = validateHandshake(buildHandshake(resp, as), nil)
+	assert.True(t, ok)
+	if assert.NotNil(t, hs) {
+		assert.Equal(t, req.nonce, hs.peerNonce)
+	}
+}
+
+func TestHandshakeFreshness(t *testing.T) {
+	ax := crypto.GenerateXchgPair()
+	_, as := crypto.GenerateSignPair()
+
+	old := newHandshake(handshakeRequest, ax.Pub())
+	old.timestamp = time.Now().Add(-2 * handshakeMaxSkew)
+	_, ok := validateHandshake(buildHandshake(old, as), nil)
+	assert.False(t, ok)
+
+	s := &Server{replayCache: newreplayCache()}
+	hs, ok := validateHandshake(buildHandshake(newHandshake(handshakeRequest, ax.Pub()), as), nil)
+	assert.True(t, ok)
+	assert.True(t, s.checkReplay(hs))
+	assert.False(t, s.checkReplay(hs))
+
+	s.replayCache.Map[string(hs.nonce[:])] = time.Now().Add(-3 * handshakeMaxSkew)
+	s.expireReplayCache()
+	assert.Len(t, s.replayCache.Map, 0)
+}
+
+func TestHandshakeNegotiation(t *testing.T) {
+	ax := crypto.GenerateXchgPair()
+	_, as := crypto.GenerateSignPair()
+
+	req := newHandshake(handshakeRequest, ax.Pub())
+	req.versions = []uint16{1, 2, 3}
+	req.features = featGZip | featRelay
+	b := buildHandshake(req, as)
+	hs, ok := validateHandshake(b, nil)
+	assert.True(t, ok)
+	if assert.NotNil(t, hs) {
+		assert.Equal(t, req.versions, hs.versions)
+		assert.Equal(t, req.features, hs.features)
+	}
+
+	// removing a version from a signed offer invalidates it
+	l, ok := handshakeLen(b)
+	assert.True(t, ok)
+	b[l-connIDLen-6]++
+	_, ok = validateHandshake(b, nil)
+	assert.False(t, ok)
+
+	resp := newHandshake(handshakeResponse, ax.Pub())
+	resp.versions = []uint16{2, 4}
+	resp.features = featGZip
+	v, f, ok := negotiate(req, resp)
+	assert.True(t, ok)
+	assert.Equal(t, uint16(2), v)
+	assert.Equal(t, featGZip, f)
+	v2, f2, _ := negotiate(resp, req)
+	assert.Equal(t, v, v2)
+	assert.Equal(t, f, f2)
+
+	resp.versions = []uint16{4}
+	_, _, ok = negotiate(req, resp)
+	assert.False(t, ok)
+}
+
+func TestHandshakeEarlierResponse(t *testing.T) {
+	a, b := newTestServer(t), newTestServer(t)
+	defer a.Close()
+	defer b.Close()
+
+	// the requests go nowhere, the response to the first one arrives after
+	// the request has been sent again
+	n := &node{
+		Pub:    b.key.Pub(),
+		ToAddr: getPort.Next().On("127.0.0.1"),
+	}
+	a.addNode(n)
+	assert.NoError(t, a.sendHandshakeRequest(n))
+	p, ok := a.hsCache.get(n.id().String())
+	if !assert.True(t, ok) {
+		return
+	}
+	first := buildHandshake(p.offer, a.key)
+	assert.NoError(t, a.sendHandshakeRequest(n))
+
+	resp, _ := b.acceptHandshake(first, a.addr, nil, nil)
+	if assert.NotNil(t, resp) {
+		a.completeHandshake(resp, b.addr, nil)
+	}
+	assert.NotNil(t, n.sessionKey())
 }
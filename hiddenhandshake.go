@@ -0,0 +1,167 @@
+package overlay
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"github.com/dist-ribut-us/crypto"
+	"github.com/dist-ribut-us/log"
+	"github.com/dist-ribut-us/rnet"
+)
+
+// hideIdentity sends handshakes with the identity of both nodes encrypted when
+// the exchange key of the peer is known, following the Noise IK pattern. The
+// request is sealed with a key derived from the ephemeral key of the initiator
+// and the static exchange key of the responder, so only the ephemeral key is
+// visible on the wire. The response is sealed with the same key. If the
+// exchange key of the peer is not known, the cleartext handshake is used. A key
+// from a stored node or a stale record may be wrong, so until the peer has
+// answered a hidden request or echoed its mac1 in a cookie only the first
+// request of an attempt is hidden and the retries are sent in cleartext.
+var hideIdentity = true
+
+// A hidden request ends with two MACs over the rest of the packet so it can be
+// rejected before the exchange with the static key is done. mac1 is keyed with
+// the static exchange key of the responder so only requests meant for this
+// node are opened. mac2 is keyed with a cookie from the responder and is only
+// checked under load, see checkCookie. A cookie reply to a hidden request
+// echoes mac1 in place of the nonce.
+const hiddenMACLen = cookieLen
+
+func hiddenMAC(key, b []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(b)
+	return mac.Sum(nil)[:hiddenMACLen]
+}
+
+// addHiddenMACs appends mac1 and mac2 to a sealed hidden request. mac2 is
+// zero if there is no cookie.
+func addHiddenMACs(pkt []byte, pubX *crypto.XchgPub, cookie []byte) []byte {
+	pkt = append(pkt, hiddenMAC(pubX.Slice(), pkt)...)
+	if cookie == nil {
+		return append(pkt, make([]byte, hiddenMACLen)...)
+	}
+	return append(pkt, hiddenMAC(cookie, pkt)...)
+}
+
+// validMAC1 checks mac1 on a hidden handshake request.
+func (s *Server) validMAC1(pkt []byte, addr *rnet.Addr) bool {
+	if len(pkt) < 1+crypto.KeyLength+2*hiddenMACLen {
+		return false
+	}
+	m1 := len(pkt) - 2*hiddenMACLen
+	if !hmac.Equal(pkt[m1:m1+hiddenMACLen], hiddenMAC(s.keyX.Pub().Slice(), pkt[:m1])) {
+		log.Info(log.Lbl("bad_hidden_handshake_mac"), addr)
+		return false
+	}
+	return true
+}
+
+// checkHiddenMACs checks mac1 and, under load, mac2. If mac2 is not valid a
+// cookie reply is sent and false is returned.
+func (s *Server) checkHiddenMACs(pkt []byte, addr *rnet.Addr) bool {
+	if !s.validMAC1(pkt, addr) {
+		return false
+	}
+	m1 := len(pkt) - 2*hiddenMACLen
+	m2 := m1 + hiddenMACLen
+	if !s.cookies.underLoad() || s.cookies.validMAC(pkt[m2:], pkt[:m2], addr) {
+		return true
+	}
+	s.sendCookie(pkt[m1:m2], addr)
+	return false
+}
+
+// xchgVerified records that PubX is the exchange key the node holds.
+func (n *node) xchgVerified() {
+	n.Lock()
+	n.hsXchgOK = true
+	n.Unlock()
+}
+
+// sealHidden seals a handshake. The packet is the packet type, the ephemeral
+// key if there is one, then the ciphertext.
+func sealHidden(kind byte, eph *crypto.XchgPub, key *crypto.Symmetric, hs []byte) []byte {
+	tag := []byte{kind}
+	if eph != nil {
+		tag = append(tag, eph.Slice()...)
+	}
+	return key.SealPackets(tag, [][]byte{hs}, nil, 0)[0]
+}
+
+func (s *Server) handleHiddenHandshakeRequest(pkt []byte, addr *rnet.Addr) {
+	if resp := s.hiddenHandshakeResponse(pkt, addr); resp != nil {
+		log.Info(log.Lbl("sending_hidden_handshake_resp"), addr)
+		log.Error(s.net.Send(resp, addr))
+	}
+}
+
+// hiddenHandshakeResponse checks the MACs on a hidden handshake request, opens
+// it and returns the sealed response.
+func (s *Server) hiddenHandshakeResponse(pkt []byte, addr *rnet.Addr) []byte {
+	if !s.checkHiddenMACs(pkt, addr) {
+		return nil
+	}
+	resp, _ := s.acceptHiddenHandshake(pkt, addr, nil)
+	return resp
+}
+
+// acceptHiddenHandshake opens a hidden handshake request whose MACs have been
+// checked and returns the sealed response and the ID that signed the request.
+// The request must use the ephemeral key it was sealed with. The response
+// carries the same ephemeral key so the initiator can find the pending
+// handshake.
+func (s *Server) acceptHiddenHandshake(pkt []byte, addr *rnet.Addr, relay *node) ([]byte, *crypto.ID) {
+	end := len(pkt) - 2*hiddenMACLen
+	if end < 1+crypto.KeyLength {
+		return nil, nil
+	}
+	eph := crypto.XchgPubFromSlice(pkt[1 : 1+crypto.KeyLength])
+	key := s.keyX.Shared(eph)
+	b, err := key.Open(pkt[1+crypto.KeyLength : end])
+	if err != nil || len(b) < 1 || b[0] != handshakeRequest {
+		log.Info(log.Lbl("hidden_handshake_open_failed"), addr)
+		return nil, nil
+	}
+	resp, id := s.acceptHandshake(b, addr, eph, relay)
+	if resp == nil {
+		return nil, nil
+	}
+	return sealHidden(hiddenHandshakeResponse, eph, key, resp), id
+}
+
+func (s *Server) handleHiddenHandshakeResponse(pkt []byte, addr *rnet.Addr) {
+	s.completeHiddenHandshake(pkt, addr, nil)
+}
+
+// completeHiddenHandshake opens a hidden handshake response and completes the
+// handshake, see completeHandshake.
+func (s *Server) completeHiddenHandshake(pkt []byte, addr *rnet.Addr, relay *node) {
+	b, ok := s.openHiddenResponse(pkt)
+	if !ok || len(b) < 1 || b[0] != handshakeResponse {
+		log.Info(log.Lbl("hidden_handshake_response_from_unrequested"), addr)
+		return
+	}
+	s.completeHandshake(b, addr, relay)
+}
+
+// openHiddenResponse finds the pending request by the ephemeral key the
+// response carries and opens the response with its key.
+func (s *Server) openHiddenResponse(pkt []byte) ([]byte, bool) {
+	if len(pkt) < 1+crypto.KeyLength {
+		return nil, false
+	}
+	p, ok := s.hsHidden.get(string(pkt[1 : 1+crypto.KeyLength]))
+	if !ok {
+		return nil, false
+	}
+	key := p.hiddenKey()
+	if key == nil {
+		return nil, false
+	}
+	b, err := key.Open(pkt[1+crypto.KeyLength:])
+	if err != nil {
+		return nil, false
+	}
+	p.node.xchgVerified()
+	return b, true
+}
@@ -0,0 +1,133 @@
+package overlay
+
+import (
+	"bytes"
+	"github.com/dist-ribut-us/crypto"
+	"github.com/dist-ribut-us/rnet"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestHiddenHandshakeFormat(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+	addr := rnet.Port(7667).On("127.0.0.1")
+
+	_, as := crypto.GenerateSignPair()
+	eph := crypto.GenerateXchgPair()
+	key := eph.Shared(s.keyX.Pub())
+	req := newHandshake(handshakeRequest, eph.Pub())
+	pkt := sealHidden(hiddenHandshakeRequest, eph.Pub(), key, buildHandshake(req, as))
+	pkt = addHiddenMACs(pkt, s.keyX.Pub(), nil)
+	assert.False(t, bytes.Contains(pkt, as.Pub().Slice()))
+
+	resp := s.hiddenHandshakeResponse(pkt, addr)
+	if assert.NotNil(t, resp) {
+		assert.Equal(t, hiddenHandshakeResponse, resp[0])
+		assert.Equal(t, eph.Pub().Slice(), resp[1:1+crypto.KeyLength])
+		assert.False(t, bytes.Contains(resp, s.key.Pub().Slice()))
+		b, err := key.Open(resp[1+crypto.KeyLength:])
+		assert.NoError(t, err)
+		hs, ok := validateHandshake(b, s.key.Pub())
+		assert.True(t, ok)
+		if assert.NotNil(t, hs) {
+			assert.Equal(t, req.nonce, hs.peerNonce)
+		}
+	}
+
+	// the inner request must use the ephemeral key it was sealed with
+	other := crypto.GenerateXchgPair()
+	req = newHandshake(handshakeRequest, other.Pub())
+	pkt = sealHidden(hiddenHandshakeRequest, eph.Pub(), key, buildHandshake(req, as))
+	pkt = addHiddenMACs(pkt, s.keyX.Pub(), nil)
+	assert.Nil(t, s.hiddenHandshakeResponse(pkt, addr))
+}
+
+func TestHiddenHandshakeMACs(t *testing.T) {
+	defer func(l int) { handshakeLoadLimit = l }(handshakeLoadLimit)
+	s := newTestServer(t)
+	defer s.Close()
+	addr := rnet.Port(7667).On("127.0.0.1")
+
+	_, as := crypto.GenerateSignPair()
+	request := func(cookie []byte) []byte {
+		eph := crypto.GenerateXchgPair()
+		req := newHandshake(handshakeRequest, eph.Pub())
+		pkt := sealHidden(hiddenHandshakeRequest, eph.Pub(), eph.Shared(s.keyX.Pub()), buildHandshake(req, as))
+		return addHiddenMACs(pkt, s.keyX.Pub(), cookie)
+	}
+
+	// mac1 made for another node is rejected
+	pkt := request(nil)
+	pkt[len(pkt)-2*hiddenMACLen] ^= 1
+	assert.False(t, s.checkHiddenMACs(pkt, addr))
+
+	// under load mac2 needs the cookie for the address
+	handshakeLoadLimit = 0
+	assert.True(t, s.checkHiddenMACs(request(s.cookies.cookie(addr)), addr))
+	assert.False(t, s.checkHiddenMACs(request(nil), addr))
+	other := rnet.Port(7668).On("127.0.0.1")
+	assert.False(t, s.checkHiddenMACs(request(s.cookies.cookie(other)), addr))
+}
+
+func TestHiddenHandshake(t *testing.T) {
+	a, b := newTestServer(t), newTestServer(t)
+	defer a.Close()
+	defer b.Close()
+
+	n := &node{
+		Pub:      b.key.Pub(),
+		PubX:     b.keyX.Pub(),
+		FromAddr: b.addr,
+		ToAddr:   b.addr,
+	}
+	a.addNode(n)
+	assert.NoError(t, a.sendHandshakeRequest(n))
+
+	p, ok := a.hsCache.get(n.id().String())
+	if assert.True(t, ok) {
+		assert.NotNil(t, p.hiddenKey())
+	}
+	for i := 0; i < 20 && n.Shared == nil; i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+	assert.NotNil(t, n.Shared)
+	_, ok = b.nodeByID(a.key.Pub().ID())
+	assert.True(t, ok)
+}
+
+func TestHiddenHandshakeWrongKey(t *testing.T) {
+	a, b := newTestServer(t), newTestServer(t)
+	defer a.Close()
+	defer b.Close()
+
+	// a stale exchange key; b drops the hidden request as not meant for it
+	n := &node{
+		Pub:      b.key.Pub(),
+		PubX:     crypto.GenerateXchgPair().Pub(),
+		FromAddr: b.addr,
+		ToAddr:   b.addr,
+	}
+	a.addNode(n)
+	assert.NoError(t, a.sendHandshakeRequest(n))
+	p, ok := a.hsCache.get(n.id().String())
+	if !assert.True(t, ok) {
+		return
+	}
+	assert.NotNil(t, p.hiddenKey())
+	time.Sleep(time.Millisecond * 20)
+	assert.Nil(t, n.sessionKey())
+
+	// the retry falls back to the cleartext handshake
+	assert.False(t, a.sendHidden(n, p))
+	assert.NoError(t, a.sendHandshakeRequest(n))
+	for i := 0; i < 20 && n.sessionKey() == nil; i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+	assert.NotNil(t, n.sessionKey())
+
+	// a key proven by a hidden handshake is used for every request
+	n.xchgVerified()
+	assert.True(t, a.sendHidden(n, p))
+}
@@ -24,6 +24,14 @@ func (s *Server) QueryHandler(q ipcrouter.Query) {
 				Xchng: s.keyX.Pub(),
 			}).Serialize(),
 		)
+	case overlaymessages.Put:
+		go s.handlePutQuery(q)
+	case overlaymessages.Get:
+		go s.handleGetQuery(q)
+	case overlaymessages.BuildCircuit:
+		go s.handleBuildCircuitQuery(q)
+	case overlaymessages.PortMappingStatus:
+		q.Respond(s.portMaps.status().Serialize())
 	default:
 		log.Info(log.Lbl("unknown_query_type"), t)
 	}
@@ -39,9 +47,22 @@ func (s *Server) CommandHandler(c ipcrouter.Command) {
 	case message.Die:
 		os.Exit(0)
 	case message.StaticKey:
-		s.LoadKey()
+		if !log.Error(s.LoadKey()) {
+			go s.Bootstrap()
+		}
 	case message.RandomKey:
 		s.RandomKey()
+		go s.Bootstrap()
+	case overlaymessages.Bootstrap:
+		go s.Bootstrap()
+	case overlaymessages.CircuitSend:
+		s.handleCircuitSend(c)
+	case overlaymessages.CloseCircuit:
+		s.handleCloseCircuit(c)
+	case overlaymessages.SubscribeNodeEvents:
+		s.handleSubscribeNodeEvents(c)
+	case overlaymessages.Nack:
+		s.handleNack(c)
 	default:
 		log.Info(log.Lbl("unknown_type"), t)
 	}
@@ -52,3 +73,11 @@ func (s *Server) handleRegisterService(c ipcrouter.Command) {
 	log.Info(log.Lbl("registered_service"), id, c.Port())
 	s.services.set(id, c.Port())
 }
+
+func (s *Server) handleNack(c ipcrouter.Command) {
+	n, err := overlaymessages.DeserializeNack(c.GetBody())
+	if log.Error(err) {
+		return
+	}
+	log.Info(log.Lbl("overlay_send_failed"), n.ID, n.Reason, n.Detail)
+}
@@ -0,0 +1,237 @@
+package overlay
+
+import (
+	"github.com/dist-ribut-us/crypto"
+	"github.com/dist-ribut-us/errors"
+	"github.com/dist-ribut-us/log"
+	"github.com/dist-ribut-us/overlay/overlaymessages"
+	"github.com/dist-ribut-us/rnet"
+	"golang.org/x/net/ipv4"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// LAN discovery parameters. When enabled, a lanAnnounce packet is sent to
+// lanGroup every lanAnnounceInterval. It carries a node record signed by the
+// sender listing its LAN addresses. A node that receives an announcement adds
+// the sender with the address from the record that matches the source of the
+// packet and answers, at most once per lanAnswerInterval, with its own
+// announcement sent from the overlay port. Records are only accepted for LAN
+// addresses and are not kept, so they are never passed on by peer exchange.
+var (
+	lanGroup            = &net.UDPAddr{IP: net.IPv4(239, 255, 70, 77), Port: 7668}
+	lanAnnounceInterval = time.Second * 30
+	lanAnswerInterval   = time.Second * 10
+)
+
+const (
+	// set in the flags byte of an announcement that answers another
+	lanAnswer    = 1
+	lanMaxPacket = 2048
+)
+
+type lanDiscovery struct {
+	conn *net.UDPConn
+	sync.Mutex
+	answered map[crypto.ID]time.Time
+}
+
+// shouldAnswer returns false if the node was answered within
+// lanAnswerInterval.
+func (l *lanDiscovery) shouldAnswer(id *crypto.ID) bool {
+	now := time.Now()
+	l.Lock()
+	defer l.Unlock()
+	if t, ok := l.answered[*id]; ok && now.Sub(t) < lanAnswerInterval {
+		return false
+	}
+	for i, t := range l.answered {
+		if now.Sub(t) >= lanAnswerInterval {
+			delete(l.answered, i)
+		}
+	}
+	l.answered[*id] = now
+	return true
+}
+
+// ErrLANEnabled is returned if LAN discovery is enabled a second time
+const ErrLANEnabled = errors.String("LAN discovery is already enabled")
+
+// EnableLANDiscovery joins the LAN discovery group on iface, or the default
+// multicast interface if iface is nil, and announces this node until the
+// server is closed. It can only be enabled once.
+func (s *Server) EnableLANDiscovery(iface *net.Interface) error {
+	if s.getLAN() != nil {
+		return ErrLANEnabled
+	}
+	conn, err := net.ListenMulticastUDP("udp4", iface, lanGroup)
+	if err != nil {
+		return err
+	}
+	p := ipv4.NewPacketConn(conn)
+	if err = p.SetMulticastLoopback(true); err == nil && iface != nil {
+		err = p.SetMulticastInterface(iface)
+	}
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	l := &lanDiscovery{
+		conn:     conn,
+		answered: make(map[crypto.ID]time.Time),
+	}
+	s.lanLock.Lock()
+	if s.lan != nil {
+		s.lanLock.Unlock()
+		conn.Close()
+		return ErrLANEnabled
+	}
+	s.lan = l
+	s.lanLock.Unlock()
+	go s.readLAN(l)
+	go func() {
+		<-s.closed
+		conn.Close()
+	}()
+	s.announceLAN()
+	go s.every(lanAnnounceInterval, s.announceLAN)
+	return nil
+}
+
+// getLAN returns the LAN discovery or nil if it is not enabled.
+func (s *Server) getLAN() *lanDiscovery {
+	s.lanLock.Lock()
+	defer s.lanLock.Unlock()
+	return s.lan
+}
+
+// lanAddrs returns the IPv4 LAN addresses of this host on the overlay port.
+func (s *Server) lanAddrs() []*rnet.Addr {
+	var ips []string
+	for ip := range localIPs() {
+		if i := net.ParseIP(ip); i != nil && i.To4() != nil {
+			ips = append(ips, ip)
+		}
+	}
+	sort.Strings(ips)
+	var addrs []*rnet.Addr
+	for _, ip := range ips {
+		addr := s.net.Port().On(ip)
+		if addr.Err == nil && addrKind(addr) == pathLAN && len(addrs) < overlaymessages.MaxRecordAddrs {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
+
+// lanAnnouncement builds an announcement: type | flags | node record
+func (s *Server) lanAnnouncement(flags byte) []byte {
+	addrs := s.lanAddrs()
+	if len(addrs) == 0 || s.key == nil {
+		return nil
+	}
+	r := &overlaymessages.NodeRecord{
+		ID:       &overlaymessages.ID{Xchng: s.keyX.Pub()},
+		Addrs:    addrs,
+		Versions: []uint16{overlaymessages.ProtocolVersion},
+		Roles:    s.getRoles(),
+		Seq:      uint64(time.Now().UnixNano()),
+		Expires:  time.Now().Add(lanAnnounceInterval * 2),
+	}
+	r.Sign(s.key)
+	return append([]byte{lanAnnounce, flags}, r.Serialize()...)
+}
+
+func (s *Server) announceLAN() {
+	l := s.getLAN()
+	if l == nil {
+		return
+	}
+	if pkt := s.lanAnnouncement(0); pkt != nil {
+		_, err := l.conn.WriteToUDP(pkt, lanGroup)
+		log.Error(err)
+	}
+}
+
+// readLAN reads announcements from the group and answers them at the matched
+// LAN address, never at an address the node was known by before.
+func (s *Server) readLAN(l *lanDiscovery) {
+	buf := make([]byte, lanMaxPacket)
+	for {
+		ln, from, err := l.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		addr := rnet.Port(from.Port).On(from.IP.String())
+		if addr.Err != nil || ln < 2 || buf[0] != lanAnnounce {
+			continue
+		}
+		n, to, ok := s.acceptAnnouncement(buf[:ln], addr)
+		if !ok || buf[1]&lanAnswer != 0 || !l.shouldAnswer(n.id()) {
+			continue
+		}
+		if pkt := s.lanAnnouncement(lanAnswer); pkt != nil {
+			log.Error(s.net.Send(pkt, to))
+		}
+	}
+}
+
+// handleLANAnnounce handles an answer sent to the overlay port.
+func (s *Server) handleLANAnnounce(pkt []byte, addr *rnet.Addr) {
+	if s.getLAN() == nil || len(pkt) < 2 || pkt[1]&lanAnswer == 0 {
+		return
+	}
+	s.acceptAnnouncement(pkt, addr)
+}
+
+// acceptAnnouncement adds the sender of an announcement with the address from
+// its record that matches the address the announcement came from. It returns
+// the node and the matched address.
+func (s *Server) acceptAnnouncement(pkt []byte, from *rnet.Addr) (*node, *rnet.Addr, bool) {
+	if len(pkt) < 2 || s.key == nil {
+		return nil, nil, false
+	}
+	r, err := overlaymessages.DeserializeNodeRecord(pkt[2:])
+	if err != nil || !validRecord(r) || *r.ID.Sign == *s.key.Pub() {
+		return nil, nil, false
+	}
+	ip := addrIP(from)
+	var addr *rnet.Addr
+	for _, a := range r.Addrs {
+		if aip := addrIP(a); aip != nil && aip.Equal(ip) && addrKind(a) == pathLAN {
+			addr = a
+			break
+		}
+	}
+	if addr == nil {
+		log.Info(log.Lbl("lan_announcement_addr_mismatch"), from)
+		return nil, nil, false
+	}
+
+	id := r.ID.Sign.ID()
+	n, ok := s.nodeByID(id)
+	if !ok {
+		log.Info(log.Lbl("lan_peer_found"), addr)
+		n = &node{
+			Pub:      r.ID.Sign,
+			PubX:     r.ID.Xchng,
+			cachedID: id,
+			FromAddr: addr,
+			ToAddr:   addr,
+		}
+		s.addNode(n)
+		if s.table != nil {
+			s.table.seen(n)
+		}
+	} else {
+		n.Lock()
+		if n.PubX == nil {
+			n.PubX = r.ID.Xchng
+		}
+		n.Unlock()
+	}
+	n.addPath(addr, pathLAN)
+	return n, addr, true
+}
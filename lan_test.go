@@ -0,0 +1,81 @@
+package overlay
+
+import (
+	"github.com/dist-ribut-us/overlay/overlaymessages"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"testing"
+	"time"
+)
+
+func loopbackInterface(t *testing.T) *net.Interface {
+	ifaces, err := net.Interfaces()
+	assert.NoError(t, err)
+	for i := range ifaces {
+		if ifaces[i].Flags&net.FlagLoopback != 0 {
+			return &ifaces[i]
+		}
+	}
+	t.Skip("no loopback interface")
+	return nil
+}
+
+func TestLANDiscovery(t *testing.T) {
+	lo := loopbackInterface(t)
+	defer func(g *net.UDPAddr) { lanGroup = g }(lanGroup)
+	lanGroup = &net.UDPAddr{IP: lanGroup.IP, Port: int(getPort.Next())}
+
+	a, b := newTestServer(t), newTestServer(t)
+	defer a.Close()
+	defer b.Close()
+	if err := a.EnableLANDiscovery(lo); err != nil {
+		t.Skip("loopback multicast not available: ", err)
+	}
+	assert.NoError(t, b.EnableLANDiscovery(lo))
+	assert.Equal(t, ErrLANEnabled, a.EnableLANDiscovery(lo))
+
+	var na, nb *node
+	for i := 0; i < 50 && (na == nil || nb == nil); i++ {
+		time.Sleep(time.Millisecond * 10)
+		na, _ = b.nodeByID(a.key.Pub().ID())
+		nb, _ = a.nodeByID(b.key.Pub().ID())
+	}
+	if assert.NotNil(t, na) && assert.NotNil(t, nb) {
+		assert.Equal(t, a.net.Port().On("127.0.0.1").String(), na.toAddr().String())
+		assert.Equal(t, b.net.Port().On("127.0.0.1").String(), nb.toAddr().String())
+	}
+
+	// a record for an address other than the one the announcement came from is
+	// rejected
+	pkt := a.lanAnnouncement(0)
+	_, _, ok := b.acceptAnnouncement(pkt, a.net.Port().On("10.9.9.9"))
+	assert.False(t, ok)
+
+	// the announcement carries the roles set after discovery was enabled
+	a.EnableRelay()
+	r, err := overlaymessages.DeserializeNodeRecord(a.lanAnnouncement(0)[2:])
+	if assert.NoError(t, err) {
+		assert.True(t, r.Roles.Has(overlaymessages.RoleRelay))
+	}
+}
+
+func TestLANAnswerAddr(t *testing.T) {
+	a, b := newTestServer(t), newTestServer(t)
+	defer a.Close()
+	defer b.Close()
+
+	// b already knows a by a WAN address, the answer goes to the LAN address
+	wan := a.net.Port().On("203.0.113.7")
+	b.addNode(&node{
+		Pub:      a.key.Pub(),
+		FromAddr: wan,
+		ToAddr:   wan,
+	})
+	lan := a.net.Port().On("127.0.0.1")
+	pkt := a.lanAnnouncement(0)
+	n, to, ok := b.acceptAnnouncement(pkt, lan)
+	if assert.True(t, ok) {
+		assert.Equal(t, lan.String(), to.String())
+		assert.Equal(t, wan.String(), n.toAddr().String())
+	}
+}
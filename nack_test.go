@@ -0,0 +1,40 @@
+package overlay
+
+import (
+	"github.com/dist-ribut-us/crypto"
+	"github.com/dist-ribut-us/message"
+	"github.com/dist-ribut-us/overlay/overlaymessages"
+	"github.com/dist-ribut-us/rnet"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestTransportFailureNack(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+	origin := newNackCatcher(t)
+	defer origin.router.Close()
+
+	// sending to the broadcast address without SO_BROADCAST is refused by the
+	// socket
+	addr := rnet.Port(7667).On("255.255.255.255")
+	_, priv := crypto.GenerateSignPair()
+	n := &node{
+		Pub:      priv.Pub(),
+		Shared:   crypto.RandomSymmetric(),
+		FromAddr: addr,
+		ToAddr:   addr,
+		liveTil:  time.Now().Add(time.Minute),
+	}
+
+	h := message.NewHeader(message.Test, "undeliverable")
+	h.Id = 7
+	s.netSend(h, n, false, origin.router.Port())
+
+	if nack := origin.next(t); assert.NotNil(t, nack) {
+		assert.Equal(t, uint32(7), nack.ID)
+		assert.Equal(t, overlaymessages.NackTransport, nack.Reason)
+		assert.NotEmpty(t, nack.Detail)
+	}
+}
@@ -3,15 +3,19 @@ package overlay
 import (
 	"bytes"
 	"compress/gzip"
+	"encoding/binary"
 	"github.com/dist-ribut-us/bufpool"
+	"github.com/dist-ribut-us/crypto"
 	"github.com/dist-ribut-us/errors"
 	"github.com/dist-ribut-us/ipcrouter"
 	"github.com/dist-ribut-us/log"
 	"github.com/dist-ribut-us/message"
+	"github.com/dist-ribut-us/overlay/overlaymessages"
 	"github.com/dist-ribut-us/packeter"
 	"github.com/dist-ribut-us/rnet"
 	"github.com/golang/protobuf/proto"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -21,14 +25,104 @@ const (
 	GZipped
 )
 
-// NetSend service via Overlay
+// NetSend service via Overlay. If the header has a NodeID, the node is found by
+// ID; if it is not already known, it is resolved with resolveNode. Otherwise
+// the node is found by address.
 func (s *Server) NetSend(msg ipcrouter.NetSendRequest) {
-	n, ok := s.nByAddr[msg.GetAddr().String()]
+	h := msg.GetHeader()
+	if len(h.NodeID) > 0 {
+		id, err := crypto.IDFromSlice(h.NodeID)
+		if err != nil {
+			s.nack(msg.Port(), h.Id, overlaymessages.NackUnknownNode, err)
+			return
+		}
+		h.NodeID = nil
+		if n, ok := s.nodeByID(id); ok {
+			s.netSend(h, n, true, msg.Port())
+			return
+		}
+		go s.resolveAndSend(id, h, msg.Port())
+		return
+	}
+
+	n, ok := s.nodeByAddr(msg.GetAddr())
 	if !ok {
 		log.Info(log.Lbl("send_to_unknown_node"), msg.GetAddr().String(), msg.GetType32(), msg.GetRouterPort())
+		s.nack(msg.Port(), h.Id, overlaymessages.NackUnknownNode, ErrUnknonNode)
 		return
 	}
-	s.netSend(msg.GetHeader(), n, true, msg.Port())
+	s.netSend(h, n, true, msg.Port())
+}
+
+// ErrNodeNotFound is reported when a node cannot be found by ID
+const ErrNodeNotFound = errors.String("Node not found by ID")
+
+// resolveNode finds a node by ID, first in the node table and then with a DHT
+// lookup. If the lookup fails, the beacons are asked directly and then the
+// stored nodes are searched for a known address.
+func (s *Server) resolveNode(id *crypto.ID) (*node, bool) {
+	if n, ok := s.nodeByID(id); ok {
+		return n, true
+	}
+	for _, n := range s.findNode(id) {
+		if *n.id() == *id {
+			return n, true
+		}
+	}
+	if n, ok := s.askBeacons(id); ok {
+		return n, true
+	}
+	if n, ok := s.storedNode(id); ok {
+		s.addNode(n)
+		s.table.seen(n)
+		return n, true
+	}
+	return nil, false
+}
+
+// askBeacons sends a FindNode query for id to each beacon and returns the node
+// if a beacon knows it.
+func (s *Server) askBeacons(id *crypto.ID) (*node, bool) {
+	s.RLock()
+	beacons := make([]*node, len(s.beacons))
+	copy(beacons, s.beacons)
+	s.RUnlock()
+	for _, b := range beacons {
+		cs, ok := s.queryFindNode(b, id, lookupTimeout)
+		if !ok {
+			continue
+		}
+		for _, c := range cs {
+			if c.Sign != nil && *c.Sign.ID() == *id {
+				return s.nodeFromContact(c), true
+			}
+		}
+	}
+	return nil, false
+}
+
+func (s *Server) resolveAndSend(id *crypto.ID, msg *message.Header, origin rnet.Port) {
+	n, ok := s.resolveNode(id)
+	if !ok {
+		log.Info(log.Lbl("send_to_unknown_node_id"), id)
+		s.nack(origin, msg.Id, overlaymessages.NackUnknownNode, ErrNodeNotFound)
+		return
+	}
+	s.netSend(msg, n, true, origin)
+}
+
+// nack notifies the origin service that the message with the given ID could
+// not be sent.
+func (s *Server) nack(origin rnet.Port, id uint32, reason overlaymessages.NackReason, err error) {
+	log.Info(log.Lbl("net_send_failed"), id, reason, err)
+	n := &overlaymessages.Nack{
+		ID:     id,
+		Reason: reason,
+	}
+	if err != nil {
+		n.Detail = err.Error()
+	}
+	s.router.Send(origin, message.NewHeader(overlaymessages.Nack, n.Serialize()))
 }
 
 // NetQueryHandler for Overlay service
@@ -36,20 +130,90 @@ func (s *Server) NetQueryHandler(q ipcrouter.NetQuery) {
 	switch t := q.GetType(); t {
 	case message.SessionData:
 		s.handleSessionDataQuery(q)
+	case overlaymessages.FindNode:
+		s.handleFindNodeQuery(q)
+	case overlaymessages.Store:
+		s.handleStoreQuery(q)
+	case overlaymessages.FindValue:
+		s.handleFindValueQuery(q)
+	case overlaymessages.PeerExchange:
+		s.handlePeerExchangeQuery(q)
+	case overlaymessages.Rekey:
+		s.handleRekeyQuery(q)
+	case overlaymessages.Rendezvous:
+		s.handleRendezvousQuery(q)
+	case overlaymessages.PunchRequest:
+		s.handlePunchRequestQuery(q)
+	case overlaymessages.RendezvousRegister:
+		s.handleRendezvousRegisterQuery(q)
+	case overlaymessages.ObservedAddr:
+		s.handleObservedAddrQuery(q)
+	case overlaymessages.GetID:
+		q.Respond(
+			(&overlaymessages.ID{
+				Sign:  s.key.Pub(),
+				Xchng: s.keyX.Pub(),
+			}).Serialize(),
+		)
 	}
 }
 
 func (s *Server) message(cPkt []byte, addr *rnet.Addr) {
-	n, ok := s.nodeByAddr(addr)
+	s.openMessage(cPkt, addr, nil)
+}
+
+// openMessage opens a session packet. If relay is not nil, the packet was
+// passed on by it and the node keeps its address. A newer direct packet lets
+// selectPath move the node off its relay.
+func (s *Server) openMessage(cPkt []byte, addr *rnet.Addr, relay *node) {
+	if len(cPkt) < 1+connIDLen {
+		log.Info(log.Lbl("short_packet"), addr)
+		return
+	}
+	n, ok := s.nodeByConn(binary.BigEndian.Uint64(cPkt[1:]))
 	if !ok {
-		log.Info(log.Lbl("unknown_node"), addr)
+		log.Info(log.Lbl("unknown_connection"), addr)
+		return
+	}
+	if relay != nil && !n.relayed(relay) {
+		log.Info(log.Lbl("relay_not_selected"), addr)
 		return
 	}
 
-	pPkt, err := n.Shared.Open(cPkt[1:])
+	pPkt, err := n.open(cPkt[1+connIDLen:])
 	if log.Error(errors.Wrap("decrypting overly message", err)) {
 		return
 	}
+	pPkt, newest, err := n.checkCounter(pPkt)
+	if err == ErrReplayedPacket {
+		atomic.AddUint64(&s.replayed, 1)
+		log.Info(log.Lbl("dropped_replayed_packet"), addr)
+		return
+	} else if log.Error(err) {
+		return
+	}
+	if relay != nil {
+		n.relaySeen(relay)
+		if n.fromAddr() == nil {
+			return
+		}
+	} else if from := n.fromAddr(); newest && (from == nil || from.String() != addr.String()) {
+		log.Info(log.Lbl("node_roamed"), from, addr)
+		s.roam(n, addr)
+	} else {
+		if newest && n.getRelay() != nil {
+			n.addPath(addr, addrKind(addr))
+		}
+		n.pathSeen(addr)
+	}
+	if relay == nil && newest && n.getRelay() != nil {
+		s.selectPath(n)
+	}
+	// packets from every path of the node are put together under one address
+	if from := n.fromAddr(); from != nil {
+		addr = from
+	}
+	s.setReceiver(addr, n)
 	s.packeter.Receive(pPkt, addr)
 }
 
@@ -66,24 +230,22 @@ func (s *Server) handleNetMessage(msg *packeter.Package) {
 	}
 
 	var port rnet.Port
-	originPort, ok := s.callbacks.get(h.Id)
-	if ok {
-		port = originPort
-	} else {
-		servicePort, ok := s.services.get(h.Service)
-		if ok {
-			port = servicePort
-		} else {
-			log.Info(log.Lbl("no_service_or_callback_for_msg"), h.Id, h.Service)
+	var ok bool
+	if h.IsResponse() {
+		if port, ok = s.responseOrigin(h); !ok {
+			log.Info(log.Lbl("dropped_unexpected_response"), h.Id)
 			return
 		}
+	} else if port, ok = s.services.get(h.Service); !ok {
+		log.Info(log.Lbl("no_service_for_msg"), h.Id, h.Service)
+		return
 	}
 	s.router.Send(port, h)
 }
 
 // ErrUnknonNode will occure if a message is received from an unknown address.
-// This shouldn't happen because the packets need to know the node to be
-// decrypted.
+// This shouldn't happen because the node is recorded as the receiver for the
+// address when its packet is opened.
 const ErrUnknonNode = errors.String("Unknown node by address")
 
 func (s *Server) unmarshalNetMessage(msg *packeter.Package) (*message.Header, error) {
@@ -104,13 +266,14 @@ func (s *Server) unmarshalNetMessage(msg *packeter.Package) (*message.Header, er
 		return nil, err
 	}
 	h.SetFlag(message.FromNet)
-	n, ok := s.nodeByAddr(msg.Addr)
+	n, ok := s.receiver(msg.Addr)
 	if !ok {
 		return nil, ErrUnknonNode
 	}
 	h.NodeID = n.id()[:]
 	h.Id = msg.ID
 	h.SetAddr(msg.Addr)
+	n.lastSeen = time.Now()
 	if n.TTL > 0 {
 		n.liveTil = time.Now().Add(n.TTL)
 	}
@@ -118,8 +281,6 @@ func (s *Server) unmarshalNetMessage(msg *packeter.Package) (*message.Header, er
 	return h, nil
 }
 
-var encSymmetricTag = []byte{encSymmetric}
-
 var noCompressionTag = []byte{NoCompression}
 var gzTag = []byte{GZipped}
 
@@ -127,13 +288,18 @@ var gzTag = []byte{GZipped}
 // 0 - this is probably a sign that something isn't correctly setting the ID
 const ErrMsgIDZero = errors.String("Message ID cannot be 0")
 
+// ErrSealFailed is reported if encrypting a message produced no packets
+const ErrSealFailed = errors.String("Failed to seal packets")
+
 func (s *Server) netSend(msg *message.Header, n *node, compression bool, origin rnet.Port) {
 	s.addNode(n)
-	if n.Shared == nil || !n.live() {
-		log.Info(log.Lbl("delay_net_send_for_handshake"), n.Shared == nil, !n.live(), n.liveTil)
-		s.sendHandshakeRequest(n, func() {
-			log.Info(log.Lbl("handshake_complete:resuming"))
-			s.netSend(msg, n, compression, origin)
+	key := n.sessionKey()
+	if key == nil || !n.live() {
+		log.Info(log.Lbl("delay_net_send_for_handshake"), key == nil, !n.live(), n.liveTil)
+		s.queueSend(n, &pendingSend{
+			msg:         msg,
+			compression: compression,
+			origin:      origin,
 		})
 		return
 	}
@@ -149,12 +315,14 @@ func (s *Server) netSend(msg *message.Header, n *node, compression bool, origin
 	msg.Id = 0
 
 	pb := getPBuffer(noCompressionTag)
-	if log.Error(pb.Marshal(msg)) {
+	if err := pb.Marshal(msg); err != nil {
+		log.Error(err)
+		s.nack(origin, id, overlaymessages.NackEncoding, err)
 		return
 	}
 	bts = pb.Bytes()
 
-	if compression {
+	if compression && n.features.has(featGZip) {
 		bb = compress(gzTag, bts[1:])
 		cpBts := bb.Bytes()
 		if len(cpBts) < len(bts) {
@@ -170,20 +338,33 @@ func (s *Server) netSend(msg *message.Header, n *node, compression bool, origin
 		packets = [][]byte{bts}
 	}
 
-	packets = n.Shared.SealPackets(encSymmetricTag, packets, nil, 0)
+	packets = key.SealPackets(n.packetTag(encSymmetric), n.addCounters(packets), nil, 0)
 
 	pbPool.Put(pb)
 	if bb != nil {
 		bufpool.Put(bb)
 	}
+	if len(packets) == 0 {
+		s.nack(origin, id, overlaymessages.NackEncryption, ErrSealFailed)
+		return
+	}
+	if n.countSent(packets) {
+		go s.rekey(n)
+	}
 
 	if msg.IsQuery() {
-		s.callbacks.set(id, origin)
+		s.addQuery(id, origin, n)
 	}
-	errs := s.net.SendAll(packets, n.ToAddr)
+	errs := s.sendAllTo(n, packets)
 	for _, err := range errs {
 		log.Error(err)
 	}
+	if len(errs) > 0 {
+		n.pathFailed(n.toAddr())
+		s.selectPath(n)
+		s.queries.delete(id)
+		s.nack(origin, id, overlaymessages.NackTransport, errs[0])
+	}
 }
 
 var pbPool = sync.Pool{
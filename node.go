@@ -2,21 +2,62 @@ package overlay
 
 import (
 	"github.com/dist-ribut-us/crypto"
+	"github.com/dist-ribut-us/overlay/overlaymessages"
 	"github.com/dist-ribut-us/rnet"
 	"sync"
 	"time"
 )
 
 type node struct {
-	Pub        *crypto.SignPub
-	PubX       *crypto.XchgPub // Temporary until github.com/golang/go/issues/20504
-	cachedID   *crypto.ID
-	Shared     *crypto.Symmetric
-	ToAddr     *rnet.Addr
-	FromAddr   *rnet.Addr
-	TTL        time.Duration
-	liveTil    time.Time
-	hsCallback func()
+	Pub      *crypto.SignPub
+	PubX     *crypto.XchgPub // Temporary until github.com/golang/go/issues/20504
+	cachedID *crypto.ID
+	Shared   *crypto.Symmetric
+	ToAddr   *rnet.Addr // guarded by the lock once the node is added
+	FromAddr *rnet.Addr // guarded by the lock once the node is added
+	TTL      time.Duration
+	liveTil  time.Time
+	added    time.Time
+	lastSeen time.Time
+	score    float64 // moving average of successful contacts
+	version  uint16  // negotiated in the handshake
+	features feature // negotiated in the handshake
+	cookie   []byte
+	cookieAt time.Time
+
+	// guards the send queue, handshake retry state and record
+	sync.Mutex
+	record      *overlaymessages.NodeRecord
+	queue       []*pendingSend
+	hsTimer     *time.Timer
+	hsRetry     time.Duration
+	hsDeadline  time.Time
+	hsPunched   bool
+	hsPunchAddr *rnet.Addr // handshakes are also sent here, see punch.go
+	hsRelayed   bool
+	hsXchgOK    bool  // PubX is known to be right, see hiddenhandshake.go
+	relay       *node // packets are sent through this node, see relay.go
+
+	// session key rotation, see rekey.go
+	keyAt       time.Time
+	sentBytes   uint64
+	sentPackets uint64
+	rekeyAt     time.Time
+	rekeyPair   *crypto.XchgPair
+	nextShared  *crypto.Symmetric
+	prevShared  *crypto.Symmetric
+	prevUntil   time.Time
+
+	// connection IDs, see connid.go
+	connID     uint64
+	peerConnID uint64
+
+	// candidate addresses, see paths.go
+	paths []*path
+
+	// packet counters, see replaywindow.go
+	sendCtr    uint64
+	recvWindow replayWindow
 }
 
 func (n *node) id() *crypto.ID {
@@ -26,14 +67,50 @@ func (n *node) id() *crypto.ID {
 	return n.cachedID
 }
 
+// toAddr returns the address packets to n are sent to.
+func (n *node) toAddr() *rnet.Addr {
+	n.Lock()
+	defer n.Unlock()
+	return n.ToAddr
+}
+
+// fromAddr returns the address packets from n are expected from.
+func (n *node) fromAddr() *rnet.Addr {
+	n.Lock()
+	defer n.Unlock()
+	return n.FromAddr
+}
+
+func (n *node) setToAddr(addr *rnet.Addr) {
+	n.Lock()
+	n.ToAddr = addr
+	n.Unlock()
+}
+
 func (n *node) live() bool {
 	return n.liveTil.After(time.Now())
 }
 
+// scoreWeight is the weight given to the most recent contact in the moving
+// average that makes up a node's quality score.
+const scoreWeight = 0.1
+
+// contacted records the outcome of an attempt to reach the node.
+func (n *node) contacted(ok bool) {
+	var v float64
+	if ok {
+		v = 1
+		n.lastSeen = time.Now()
+	}
+	n.score = n.score*(1-scoreWeight) + v*scoreWeight
+}
+
 type nodes struct {
 	sync.RWMutex
 	nByID   map[string]*node
 	nByAddr map[string]*node
+	nByConn map[uint64]*node
+	nByRecv map[string]*node // see setReceiver
 	beacons []*node
 }
 
@@ -41,6 +118,8 @@ func newNodes() *nodes {
 	return &nodes{
 		nByID:   make(map[string]*node),
 		nByAddr: make(map[string]*node),
+		nByConn: make(map[uint64]*node),
+		nByRecv: make(map[string]*node),
 	}
 }
 
@@ -64,22 +143,78 @@ func (ns *nodes) addNode(n *node) {
 		return
 	}
 	idStr := id.String()
+	if n.added.IsZero() {
+		n.added = time.Now()
+	}
 	ns.Lock()
 	ns.nByID[idStr] = n
-	if n.FromAddr != nil {
-		ns.nByAddr[n.FromAddr.String()] = n
+	// an address already in use belongs to a node that has been heard from
+	// there; only roam moves it
+	if from := n.fromAddr(); from != nil {
+		if _, taken := ns.nByAddr[from.String()]; !taken {
+			ns.nByAddr[from.String()] = n
+		}
 	}
 	ns.Unlock()
 }
 
-func (ns *nodes) addBeacon(pub *crypto.SignPub, addr *rnet.Addr) {
-	n := &node{
-		Pub:      pub,
-		FromAddr: addr,
-		ToAddr:   addr,
+func (ns *nodes) addBeacon(pub *crypto.SignPub, addr *rnet.Addr) *node {
+	n, ok := ns.nodeByID(pub.ID())
+	if !ok {
+		n = &node{
+			Pub:      pub,
+			FromAddr: addr,
+			ToAddr:   addr,
+		}
+		ns.addNode(n)
+	}
+	if ns.isBeacon(n) {
+		return n
 	}
-	ns.addNode(n)
 	ns.Lock()
 	ns.beacons = append(ns.beacons, n)
 	ns.Unlock()
+	return n
+}
+
+// removeNode drops a node from the maps.
+func (ns *nodes) removeNode(n *node) {
+	ns.Lock()
+	if ns.nByID[n.id().String()] == n {
+		delete(ns.nByID, n.id().String())
+	}
+	if from := n.fromAddr(); from != nil && ns.nByAddr[from.String()] == n {
+		delete(ns.nByAddr, from.String())
+	}
+	if n.connID != 0 && ns.nByConn[n.connID] == n {
+		delete(ns.nByConn, n.connID)
+	}
+	for addr, r := range ns.nByRecv {
+		if r == n {
+			delete(ns.nByRecv, addr)
+		}
+	}
+	ns.Unlock()
+}
+
+func (ns *nodes) isBeacon(n *node) bool {
+	ns.RLock()
+	defer ns.RUnlock()
+	for _, b := range ns.beacons {
+		if b == n {
+			return true
+		}
+	}
+	return false
+}
+
+// all returns a copy of the list of known nodes.
+func (ns *nodes) all() []*node {
+	ns.RLock()
+	out := make([]*node, 0, len(ns.nByID))
+	for _, n := range ns.nByID {
+		out = append(out, n)
+	}
+	ns.RUnlock()
+	return out
 }
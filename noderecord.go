@@ -0,0 +1,99 @@
+package overlay
+
+import (
+	"github.com/dist-ribut-us/overlay/overlaymessages"
+	"github.com/dist-ribut-us/rnet"
+	"time"
+)
+
+// Node record parameters. This node's record is valid for nodeRecordTTL and
+// re-signed half way through. Records expiring further than maxNodeRecordTTL
+// in the future are rejected.
+var (
+	nodeRecordTTL    = time.Hour
+	maxNodeRecordTTL = time.Hour * 24 * 30
+	nodeRoles        = overlaymessages.RoleDHT
+)
+
+// selfRecord returns this node's record signed with its key. It is re-signed
+// when the address or key changes or it is half way to expiring.
+func (s *Server) selfRecord() *overlaymessages.NodeRecord {
+	addr := s.getAddr()
+	if addr == nil || s.key == nil {
+		return nil
+	}
+	s.selfRecordLock.Lock()
+	defer s.selfRecordLock.Unlock()
+	r := s.selfRec
+	if r == nil || r.Addrs[0].String() != addr.String() || *r.ID.Sign != *s.key.Pub() || r.Roles != s.roles || time.Until(r.Expires) < nodeRecordTTL/2 {
+		r = &overlaymessages.NodeRecord{
+			ID:       &overlaymessages.ID{Xchng: s.keyX.Pub()},
+			Addrs:    []*rnet.Addr{addr},
+			Versions: []uint16{overlaymessages.ProtocolVersion},
+			Roles:    s.roles,
+			Seq:      uint64(time.Now().UnixNano()),
+			Expires:  time.Now().Add(nodeRecordTTL),
+		}
+		r.Sign(s.key)
+		s.selfRec = r
+	}
+	return r
+}
+
+// validRecord checks that a record is signed, has not expired and does not
+// expire too far in the future.
+func validRecord(r *overlaymessages.NodeRecord) bool {
+	return r != nil && !r.Expired() && r.Expires.Before(time.Now().Add(maxNodeRecordTTL)) && r.Verify()
+}
+
+// setRecord replaces the record for n if r is a valid record for n with a
+// higher sequence number. The exchange key is taken from the record if it is
+// not already known.
+func (n *node) setRecord(r *overlaymessages.NodeRecord) bool {
+	if *r.ID.Sign != *n.Pub || !validRecord(r) {
+		return false
+	}
+	n.Lock()
+	defer n.Unlock()
+	if n.record != nil && n.record.Seq >= r.Seq {
+		return false
+	}
+	n.record = r
+	for _, addr := range r.Addrs {
+		n.addPathLocked(addr, addrKind(addr))
+	}
+	if r.ID.Xchng != nil {
+		if n.PubX == nil || string(n.PubX.Slice()) != string(r.ID.Xchng.Slice()) {
+			n.hsXchgOK = false
+		}
+		n.PubX = r.ID.Xchng
+	}
+	return true
+}
+
+// getRecord returns the record for n if it is still valid.
+func (n *node) getRecord() *overlaymessages.NodeRecord {
+	n.Lock()
+	defer n.Unlock()
+	if n.record == nil || n.record.Expired() {
+		return nil
+	}
+	return n.record
+}
+
+// nodeFromRecord creates a node from a valid record. The first address in the
+// record is used to send to and every address becomes a candidate path. The
+// record does not prove the node is at any of them, so FromAddr is left unset
+// until a packet from the node is authenticated.
+func nodeFromRecord(r *overlaymessages.NodeRecord) *node {
+	n := &node{
+		Pub:    r.ID.Sign,
+		PubX:   r.ID.Xchng,
+		ToAddr: r.Addrs[0],
+		record: r,
+	}
+	for _, addr := range r.Addrs {
+		n.addPathLocked(addr, addrKind(addr))
+	}
+	return n
+}
@@ -0,0 +1,73 @@
+package overlay
+
+import (
+	"github.com/dist-ribut-us/crypto"
+	"github.com/dist-ribut-us/overlay/overlaymessages"
+	"github.com/dist-ribut-us/rnet"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func newTestRecord(addr *rnet.Addr, expires time.Time) *overlaymessages.NodeRecord {
+	_, priv := crypto.GenerateSignPair()
+	r := &overlaymessages.NodeRecord{
+		Addrs:    []*rnet.Addr{addr},
+		Versions: []uint16{overlaymessages.ProtocolVersion},
+		Roles:    overlaymessages.RoleDHT | overlaymessages.RoleBeacon,
+		Seq:      1,
+		Expires:  expires,
+	}
+	r.Sign(priv)
+	return r
+}
+
+func TestNodeRecord(t *testing.T) {
+	r := newTestRecord(rnet.Port(7667).On("10.1.2.3"), time.Now().Add(time.Minute))
+	r.Addrs = append(r.Addrs, rnet.Port(7668).On("10.1.2.4"))
+	assert.False(t, r.Verify())
+	r.Addrs = r.Addrs[:1]
+	assert.True(t, validRecord(r))
+
+	rs, err := overlaymessages.DeserializeNodeRecords(overlaymessages.SerializeNodeRecords([]*overlaymessages.NodeRecord{r, r}))
+	assert.NoError(t, err)
+	if assert.Len(t, rs, 2) {
+		r2 := rs[1]
+		assert.True(t, r2.Verify())
+		assert.Equal(t, r.Addrs[0].String(), r2.Addrs[0].String())
+		assert.Equal(t, r.Seq, r2.Seq)
+		assert.True(t, r2.Roles.Has(overlaymessages.RoleBeacon))
+		assert.False(t, r2.Roles.Has(overlaymessages.RoleRelay))
+		assert.True(t, r2.Supports(overlaymessages.ProtocolVersion))
+	}
+
+	_, err = overlaymessages.DeserializeNodeRecord(r.Serialize()[:20])
+	assert.Equal(t, overlaymessages.ErrBadNodeRecord, err)
+
+	expired := newTestRecord(rnet.Port(7667).On("10.1.2.3"), time.Now().Add(-time.Minute))
+	assert.True(t, expired.Verify())
+	assert.False(t, validRecord(expired))
+}
+
+func TestSetRecord(t *testing.T) {
+	_, priv := crypto.GenerateSignPair()
+	n := &node{Pub: priv.Pub()}
+	sign := func(seq uint64) *overlaymessages.NodeRecord {
+		r := &overlaymessages.NodeRecord{
+			Addrs:   []*rnet.Addr{rnet.Port(7667).On("10.1.2.3")},
+			Seq:     seq,
+			Expires: time.Now().Add(time.Minute),
+		}
+		r.Sign(priv)
+		return r
+	}
+
+	assert.True(t, n.setRecord(sign(2)))
+	assert.False(t, n.setRecord(sign(1)))
+	assert.True(t, n.setRecord(sign(3)))
+	assert.Equal(t, uint64(3), n.getRecord().Seq)
+
+	other := newTestRecord(rnet.Port(7667).On("10.1.2.3"), time.Now().Add(time.Minute))
+	other.Seq = 10
+	assert.False(t, n.setRecord(other))
+}
@@ -0,0 +1,160 @@
+package overlay
+
+import (
+	"encoding/binary"
+	"github.com/dist-ribut-us/crypto"
+	"github.com/dist-ribut-us/errors"
+	"github.com/dist-ribut-us/log"
+	"github.com/dist-ribut-us/message"
+	"github.com/dist-ribut-us/rnet"
+	"math"
+	"time"
+)
+
+var nodeBkt = []byte("nodes")
+
+// Node persistence parameters. Known nodes are saved every saveNodesInterval
+// and when the server is closed. Nodes that have not been seen for
+// maxStoredNodeAge are not loaded.
+var (
+	saveNodesInterval = time.Minute * 5
+	maxStoredNodeAge  = time.Hour * 24 * 7
+)
+
+// ErrBadStoredNode is returned when a stored node cannot be decoded
+const ErrBadStoredNode = errors.String("Malformed stored node")
+
+var zeroKey = make([]byte, crypto.KeyLength)
+
+// A stored node is PubX, lastSeen, TTL, score, then length prefixed ToAddr and
+// FromAddr. The key is the sign key.
+const storedNodeHeaderLen = crypto.KeyLength + 8 + 8 + 8
+
+func marshalNode(n *node) []byte {
+	b := make([]byte, storedNodeHeaderLen)
+	if n.PubX != nil {
+		copy(b, n.PubX.Slice())
+	}
+	binary.BigEndian.PutUint64(b[crypto.KeyLength:], uint64(n.lastSeen.Unix()))
+	binary.BigEndian.PutUint64(b[crypto.KeyLength+8:], uint64(n.TTL))
+	binary.BigEndian.PutUint64(b[crypto.KeyLength+16:], math.Float64bits(n.score))
+	b = appendAddr(b, n.toAddr())
+	return appendAddr(b, n.fromAddr())
+}
+
+func appendAddr(b []byte, addr *rnet.Addr) []byte {
+	var ab []byte
+	if addr != nil {
+		ab = message.FromAddr(addr).Marshal()
+	}
+	var l [2]byte
+	binary.BigEndian.PutUint16(l[:], uint16(len(ab)))
+	b = append(b, l[:]...)
+	return append(b, ab...)
+}
+
+func readAddr(b []byte) (*rnet.Addr, []byte, error) {
+	if len(b) < 2 {
+		return nil, nil, ErrBadStoredNode
+	}
+	l := int(binary.BigEndian.Uint16(b))
+	b = b[2:]
+	if len(b) < l {
+		return nil, nil, ErrBadStoredNode
+	}
+	if l == 0 {
+		return nil, b, nil
+	}
+	return message.UnmarshalAddrpb(b[:l]).GetAddr(), b[l:], nil
+}
+
+func unmarshalNode(key, b []byte) (*node, error) {
+	if len(key) != crypto.KeyLength || len(b) < storedNodeHeaderLen {
+		return nil, ErrBadStoredNode
+	}
+	n := &node{
+		Pub:      crypto.SignPubFromSlice(key),
+		lastSeen: time.Unix(int64(binary.BigEndian.Uint64(b[crypto.KeyLength:])), 0),
+		TTL:      time.Duration(binary.BigEndian.Uint64(b[crypto.KeyLength+8:])),
+		score:    math.Float64frombits(binary.BigEndian.Uint64(b[crypto.KeyLength+16:])),
+	}
+	if x := b[:crypto.KeyLength]; string(x) != string(zeroKey) {
+		n.PubX = crypto.XchgPubFromSlice(x)
+	}
+	var err error
+	b = b[storedNodeHeaderLen:]
+	if n.ToAddr, b, err = readAddr(b); err != nil {
+		return nil, err
+	}
+	if n.FromAddr, _, err = readAddr(b); err != nil {
+		return nil, err
+	}
+	if n.ToAddr == nil {
+		return nil, ErrBadStoredNode
+	}
+	return n, nil
+}
+
+// saveNodes writes every known node with an address to the forest and removes
+// stored nodes that are too old.
+func (s *Server) saveNodes() {
+	if s.forest == nil {
+		return
+	}
+	for _, n := range s.all() {
+		if n.toAddr() == nil || n.Pub == nil {
+			continue
+		}
+		log.Error(s.forest.SetValue(nodeBkt, n.Pub.Slice(), marshalNode(n)))
+	}
+	s.storedNodes()
+}
+
+// storedNodes returns the stored nodes that were seen within
+// maxStoredNodeAge and removes the rest. Stored nodes only age out here; a node
+// dropped from memory by the reaper keeps its stored address.
+func (s *Server) storedNodes() []*node {
+	if s.forest == nil {
+		return nil
+	}
+	cutoff := time.Now().Add(-maxStoredNodeAge)
+	var ns []*node
+	var stale [][]byte
+	for key, val, err := s.forest.First(nodeBkt); key != nil && !log.Error(err); key, val, err = s.forest.Next(nodeBkt, key) {
+		if len(val) == 0 {
+			continue
+		}
+		n, err := unmarshalNode(key, val)
+		if log.Error(err) || n.lastSeen.Before(cutoff) {
+			stale = append(stale, key)
+			continue
+		}
+		ns = append(ns, n)
+	}
+	for _, key := range stale {
+		log.Error(s.forest.SetValue(nodeBkt, key, []byte{}))
+	}
+	return ns
+}
+
+// storedNode returns the stored node with the given ID. It is used to find
+// the last known address of a node that is no longer in the node table.
+func (s *Server) storedNode(id *crypto.ID) (*node, bool) {
+	for _, n := range s.storedNodes() {
+		if *n.id() == *id {
+			return n, true
+		}
+	}
+	return nil, false
+}
+
+// loadNodes adds the stored nodes to the node table. They will need a new
+// handshake before they can be used.
+func (s *Server) loadNodes() {
+	for _, n := range s.storedNodes() {
+		s.addNode(n)
+		if s.table != nil {
+			s.table.seen(n)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package overlay
+
+import (
+	"github.com/dist-ribut-us/crypto"
+	"github.com/dist-ribut-us/rnet"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestMarshalNode(t *testing.T) {
+	_, priv := crypto.GenerateSignPair()
+	n := &node{
+		Pub:      priv.Pub(),
+		PubX:     crypto.GenerateXchgPair().Pub(),
+		ToAddr:   rnet.Port(7667).On("127.0.0.1"),
+		FromAddr: rnet.Port(7668).On("127.0.0.1"),
+		TTL:      time.Minute,
+		lastSeen: time.Now(),
+		score:    0.75,
+	}
+	n2, err := unmarshalNode(n.Pub.Slice(), marshalNode(n))
+	assert.NoError(t, err)
+	assert.Equal(t, n.Pub, n2.Pub)
+	assert.Equal(t, n.PubX, n2.PubX)
+	assert.Equal(t, n.ToAddr.String(), n2.ToAddr.String())
+	assert.Equal(t, n.FromAddr.String(), n2.FromAddr.String())
+	assert.Equal(t, n.TTL, n2.TTL)
+	assert.Equal(t, n.lastSeen.Unix(), n2.lastSeen.Unix())
+	assert.Equal(t, n.score, n2.score)
+
+	n.PubX, n.FromAddr = nil, nil
+	n2, err = unmarshalNode(n.Pub.Slice(), marshalNode(n))
+	assert.NoError(t, err)
+	assert.Nil(t, n2.PubX)
+	assert.Nil(t, n2.FromAddr)
+}
+
+func TestSaveLoadNodes(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+	dir := "testNodeDir"
+	os.RemoveAll(dir)
+	defer os.RemoveAll(dir)
+	assert.NoError(t, s.Forest(crypto.RandomSymmetric(), dir))
+
+	_, priv := crypto.GenerateSignPair()
+	seen := &node{
+		Pub:      priv.Pub(),
+		ToAddr:   rnet.Port(7667).On("127.0.0.1"),
+		FromAddr: rnet.Port(7667).On("127.0.0.1"),
+		lastSeen: time.Now(),
+	}
+	s.addNode(seen)
+
+	_, priv = crypto.GenerateSignPair()
+	stale := &node{
+		Pub:      priv.Pub(),
+		ToAddr:   rnet.Port(7668).On("127.0.0.1"),
+		FromAddr: rnet.Port(7668).On("127.0.0.1"),
+		lastSeen: time.Now().Add(-2 * maxStoredNodeAge),
+	}
+	s.addNode(stale)
+
+	s.saveNodes()
+	s.removeNode(seen)
+	s.removeNode(stale)
+
+	s.loadNodes()
+	n, ok := s.nodeByID(seen.id())
+	if assert.True(t, ok) {
+		assert.Equal(t, seen.ToAddr.String(), n.ToAddr.String())
+	}
+	_, ok = s.nodeByID(stale.id())
+	assert.False(t, ok)
+}
+
+func TestResolveStoredNode(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+	dir := "testResolveDir"
+	os.RemoveAll(dir)
+	defer os.RemoveAll(dir)
+	assert.NoError(t, s.Forest(crypto.RandomSymmetric(), dir))
+
+	_, priv := crypto.GenerateSignPair()
+	stored := &node{
+		Pub:      priv.Pub(),
+		ToAddr:   rnet.Port(7667).On("127.0.0.1"),
+		FromAddr: rnet.Port(7667).On("127.0.0.1"),
+		lastSeen: time.Now(),
+	}
+	s.addNode(stored)
+	s.saveNodes()
+	s.removeNode(stored)
+
+	// no beacons and an empty table, so only the stored node can be found
+	n, ok := s.resolveNode(stored.id())
+	if assert.True(t, ok) {
+		assert.Equal(t, stored.ToAddr.String(), n.ToAddr.String())
+	}
+	_, ok = s.nodeByID(stored.id())
+	assert.True(t, ok)
+
+	_, priv = crypto.GenerateSignPair()
+	_, ok = s.resolveNode(priv.Pub().ID())
+	assert.False(t, ok)
+}
+
+func TestReapKeepsStoredNode(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+	dir := "testReapStoreDir"
+	os.RemoveAll(dir)
+	defer os.RemoveAll(dir)
+	assert.NoError(t, s.Forest(crypto.RandomSymmetric(), dir))
+
+	_, priv := crypto.GenerateSignPair()
+	n := &node{
+		Pub:      priv.Pub(),
+		ToAddr:   rnet.Port(7667).On("127.0.0.1"),
+		FromAddr: rnet.Port(7667).On("127.0.0.1"),
+		lastSeen: time.Now(),
+		liveTil:  time.Now().Add(-reapGrace - time.Second),
+	}
+	s.addNode(n)
+	s.saveNodes()
+	s.reap()
+
+	_, ok := s.nodeByID(n.id())
+	assert.False(t, ok)
+	_, ok = s.storedNode(n.id())
+	assert.True(t, ok)
+}
@@ -0,0 +1,238 @@
+package overlay
+
+import (
+	"github.com/dist-ribut-us/crypto"
+	"github.com/dist-ribut-us/ipcrouter"
+	"github.com/dist-ribut-us/log"
+	"github.com/dist-ribut-us/message"
+	"github.com/dist-ribut-us/overlay/overlaymessages"
+	"github.com/dist-ribut-us/rnet"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Address discovery parameters. Every observeInterval, up to observePeers
+// live nodes, each from a different subnet, are sent an ObservedAddr query
+// and respond with the address they see this node's packets come from. An
+// address is accepted if at least observeQuorum peers and more than half of
+// those that answered agree on it. Peers on the LAN are not asked.
+var (
+	observeInterval = time.Minute * 5
+	observePeers    = 5
+	observeQuorum   = 2
+)
+
+// NATType describes how peers see the address of this node.
+type NATType byte
+
+// NAT types
+const (
+	NATUnknown   = NATType(iota)
+	NATOpen      // peers see a local address and port
+	NATCone      // peers agree on one translated address
+	NATSymmetric // peers see the same IP with different ports
+)
+
+func (t NATType) String() string {
+	switch t {
+	case NATOpen:
+		return "open"
+	case NATCone:
+		return "cone"
+	case NATSymmetric:
+		return "symmetric"
+	}
+	return "unknown"
+}
+
+// NAT returns the NAT type found by the last address discovery.
+func (s *Server) NAT() NATType {
+	s.addrLock.Lock()
+	defer s.addrLock.Unlock()
+	return s.nat
+}
+
+// getAddr returns the address this node advertises.
+func (s *Server) getAddr() *rnet.Addr {
+	s.addrLock.Lock()
+	defer s.addrLock.Unlock()
+	return s.addr
+}
+
+// setObservedAddr records the result of address discovery. addr is nil if
+// peers did not agree.
+func (s *Server) setObservedAddr(addr *rnet.Addr, nat NATType) {
+	s.addrLock.Lock()
+	defer s.addrLock.Unlock()
+	if nat != s.nat {
+		log.Info(log.Lbl("nat_type"), nat.String())
+		s.nat = nat
+	}
+	s.observedAddr = addr
+	s.updateAddrLocked()
+}
+
+// setMappedAddr records the external side of the port mapping. addr is nil if
+// no port is mapped.
+func (s *Server) setMappedAddr(addr *rnet.Addr) {
+	s.addrLock.Lock()
+	defer s.addrLock.Unlock()
+	s.mappedAddr = addr
+	s.updateAddrLocked()
+}
+
+// updateAddrLocked picks the address to advertise. The port mapped address is
+// used while a mapping is held, unless peers see a different host; then the
+// gateway is behind another NAT and the address peers see is used. If neither
+// is known the address is left alone. It must be called with addrLock held.
+func (s *Server) updateAddrLocked() {
+	addr := s.mappedAddr
+	if addr == nil || (s.observedAddr != nil && addrIP(s.observedAddr).String() != addrIP(addr).String()) {
+		addr = s.observedAddr
+	}
+	if addr == nil || (s.addr != nil && s.addr.String() == addr.String()) {
+		return
+	}
+	log.Info(log.Lbl("external_addr_changed"), s.addr, addr)
+	s.addr = addr
+}
+
+func (s *Server) handleObservedAddrQuery(q ipcrouter.NetQuery) {
+	from, err := crypto.IDFromSlice(q.GetNodeID())
+	if log.Error(err) {
+		return
+	}
+	n, ok := s.nodeByID(from)
+	if !ok {
+		q.Respond([]byte{})
+		return
+	}
+	addr := n.fromAddr()
+	if addr == nil {
+		q.Respond([]byte{})
+		return
+	}
+	q.Respond(message.FromAddr(addr).Marshal())
+}
+
+// queryObservedAddr asks n for the address it sees this node at.
+func (s *Server) queryObservedAddr(n *node, timeout time.Duration) (*rnet.Addr, bool) {
+	resp := make(chan *rnet.Addr, 1)
+	s.router.
+		Query(overlaymessages.ObservedAddr, []byte{}).
+		SetService(overlaymessages.ServiceID).
+		SendToNet(n.toAddr(), func(r ipcrouter.NetResponse) {
+			if b := r.GetBody(); len(b) > 0 {
+				resp <- message.UnmarshalAddrpb(b).GetAddr()
+				return
+			}
+			resp <- nil
+		})
+	select {
+	case addr := <-resp:
+		return addr, addr != nil
+	case <-time.After(timeout):
+		return nil, false
+	}
+}
+
+func localIPs() map[string]bool {
+	ips := make(map[string]bool)
+	addrs, err := net.InterfaceAddrs()
+	if log.Error(err) {
+		return ips
+	}
+	for _, a := range addrs {
+		if ipn, ok := a.(*net.IPNet); ok {
+			ips[ipn.IP.String()] = true
+		}
+	}
+	return ips
+}
+
+// classifyNAT returns the address most peers agree on and the NAT type. The
+// address is nil if there is no consensus.
+func classifyNAT(observed []*rnet.Addr, localPort string, local map[string]bool) (*rnet.Addr, NATType) {
+	if len(observed) < observeQuorum {
+		return nil, NATUnknown
+	}
+	counts := make(map[string]int)
+	hosts := make(map[string]bool)
+	var best *rnet.Addr
+	for _, addr := range observed {
+		key := addr.String()
+		counts[key]++
+		if best == nil || counts[key] > counts[best.String()] {
+			best = addr
+		}
+		if host, _, err := net.SplitHostPort(key); err == nil {
+			hosts[host] = true
+		}
+	}
+	if c := counts[best.String()]; c >= observeQuorum && c*2 > len(observed) {
+		host, port, _ := net.SplitHostPort(best.String())
+		for _, addr := range observed {
+			// the same host with a different port means the mapping depends on
+			// the destination, even if most peers got the same port
+			if h, p, err := net.SplitHostPort(addr.String()); err == nil && h == host && p != port {
+				return nil, NATSymmetric
+			}
+		}
+		if local[host] && port == localPort {
+			return best, NATOpen
+		}
+		return best, NATCone
+	}
+	if len(hosts) == 1 {
+		return nil, NATSymmetric
+	}
+	return nil, NATUnknown
+}
+
+// observers picks live nodes with sessions from different subnets. Nodes on
+// the LAN see the local address, so they are not asked.
+func (s *Server) observers() []*node {
+	subnets := make(map[string]bool)
+	var ns []*node
+	for _, n := range s.all() {
+		if len(ns) == observePeers {
+			break
+		}
+		to := n.toAddr()
+		if !n.hasSession() || !n.live() || to == nil || addrKind(to) == pathLAN {
+			continue
+		}
+		sn := subnet(to)
+		if subnets[sn] {
+			continue
+		}
+		subnets[sn] = true
+		ns = append(ns, n)
+	}
+	return ns
+}
+
+// discoverAddr asks peers for the address they see and updates the address
+// of this node and the NAT type.
+func (s *Server) discoverAddr() {
+	ns := s.observers()
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	var observed []*rnet.Addr
+	for _, n := range ns {
+		wg.Add(1)
+		go func(n *node) {
+			if addr, ok := s.queryObservedAddr(n, lookupTimeout); ok {
+				lock.Lock()
+				observed = append(observed, addr)
+				lock.Unlock()
+			}
+			wg.Done()
+		}(n)
+	}
+	wg.Wait()
+
+	s.setObservedAddr(classifyNAT(observed, strconv.Itoa(int(s.net.Port())), localIPs()))
+}
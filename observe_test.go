@@ -0,0 +1,111 @@
+package overlay
+
+import (
+	"github.com/dist-ribut-us/crypto"
+	"github.com/dist-ribut-us/rnet"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestClassifyNAT(t *testing.T) {
+	local := map[string]bool{"5.6.7.8": true}
+	ext := rnet.Port(5555).On("1.2.3.4")
+
+	addr, nat := classifyNAT([]*rnet.Addr{ext}, "5555", local)
+	assert.Nil(t, addr)
+	assert.Equal(t, NATUnknown, nat)
+
+	addr, nat = classifyNAT([]*rnet.Addr{ext, rnet.Port(5555).On("1.2.3.4")}, "5555", local)
+	assert.Equal(t, ext.String(), addr.String())
+	assert.Equal(t, NATCone, nat)
+
+	// peers see an address of a local interface on the same port
+	open := rnet.Port(5555).On("5.6.7.8")
+	addr, nat = classifyNAT([]*rnet.Addr{open, open, ext}, "5555", local)
+	assert.Equal(t, open.String(), addr.String())
+	assert.Equal(t, NATOpen, nat)
+
+	addr, nat = classifyNAT([]*rnet.Addr{ext, rnet.Port(6666).On("1.2.3.4"), rnet.Port(7777).On("1.2.3.4")}, "5555", local)
+	assert.Nil(t, addr)
+	assert.Equal(t, NATSymmetric, nat)
+
+	// a majority on one port does not hide a different port for the same host
+	addr, nat = classifyNAT([]*rnet.Addr{ext, ext, rnet.Port(6666).On("1.2.3.4")}, "5555", local)
+	assert.Nil(t, addr)
+	assert.Equal(t, NATSymmetric, nat)
+}
+
+func TestAddrPrecedence(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+
+	mapped := rnet.Port(5555).On("1.2.3.4")
+	observed := rnet.Port(6666).On("1.2.3.4")
+	s.setObservedAddr(observed, NATCone)
+	assert.Equal(t, observed.String(), s.getAddr().String())
+
+	// the mapping wins while peers see the same host
+	s.setMappedAddr(mapped)
+	assert.Equal(t, mapped.String(), s.getAddr().String())
+	s.setObservedAddr(nil, NATUnknown)
+	assert.Equal(t, mapped.String(), s.getAddr().String())
+
+	// a different host means the gateway is behind another NAT
+	outer := rnet.Port(7777).On("5.6.7.8")
+	s.setObservedAddr(outer, NATCone)
+	assert.Equal(t, outer.String(), s.getAddr().String())
+
+	s.setMappedAddr(nil)
+	s.setObservedAddr(nil, NATUnknown)
+	assert.Equal(t, outer.String(), s.getAddr().String())
+	assert.Equal(t, NATUnknown, s.NAT())
+}
+
+func TestDiscoverAddr(t *testing.T) {
+	srvs := newTestChain(t, 2)
+	for _, s := range srvs {
+		defer s.Close()
+	}
+	a, b := srvs[0], srvs[1]
+
+	nb, _ := a.nodeByID(b.key.Pub().ID())
+	_, ok := a.queryFindNode(nb, b.key.Pub().ID(), lookupTimeout)
+	assert.True(t, ok)
+
+	observed, ok := a.queryObservedAddr(nb, lookupTimeout)
+	assert.True(t, ok)
+	assert.Equal(t, a.addr.String(), observed.String())
+
+	defer func(q int) { observeQuorum = q }(observeQuorum)
+	observeQuorum = 1
+	want := a.addr.String()
+	a.addr = nil
+	a.discoverAddr()
+	if assert.NotNil(t, a.addr) {
+		assert.Equal(t, want, a.addr.String())
+	}
+	assert.Equal(t, NATOpen, a.NAT())
+}
+
+func TestObserversSkipLAN(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+
+	add := func(addr *rnet.Addr) *node {
+		_, priv := crypto.GenerateSignPair()
+		n := &node{
+			Pub:      priv.Pub(),
+			ToAddr:   addr,
+			FromAddr: addr,
+			liveTil:  time.Now().Add(time.Minute),
+		}
+		n.setSession(crypto.RandomSymmetric())
+		s.addNode(n)
+		return n
+	}
+	add(rnet.Port(5555).On("10.0.0.3"))
+	public := add(rnet.Port(5555).On("1.2.3.4"))
+
+	assert.Equal(t, []*node{public}, s.observers())
+}
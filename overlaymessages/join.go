@@ -0,0 +1,50 @@
+package overlaymessages
+
+import (
+	"encoding/binary"
+	"github.com/dist-ribut-us/errors"
+)
+
+// JoinState is the stage of joining the network reported in a JoinStatus
+type JoinState byte
+
+// Join states
+const (
+	JoinStarted = JoinState(iota + 1)
+	JoinBeaconReached
+	JoinBeaconUnreachable
+	Joined
+	JoinFailed
+)
+
+// ErrBadJoinStatus is returned when a serialized JoinStatus is malformed
+const ErrBadJoinStatus = errors.String("Malformed join status")
+
+// JoinStatus is sent to subscribed services to report the progress of
+// bootstrapping. Nodes is the number of nodes in the routing table and Detail
+// holds the beacon address or error, if any.
+type JoinStatus struct {
+	State  JoinState
+	Nodes  uint32
+	Detail string
+}
+
+// Serialize the JoinStatus
+func (j *JoinStatus) Serialize() []byte {
+	b := make([]byte, 5, 5+len(j.Detail))
+	b[0] = byte(j.State)
+	binary.BigEndian.PutUint32(b[1:], j.Nodes)
+	return append(b, j.Detail...)
+}
+
+// DeserializeJoinStatus decodes a JoinStatus created by Serialize
+func DeserializeJoinStatus(b []byte) (*JoinStatus, error) {
+	if len(b) < 5 {
+		return nil, ErrBadJoinStatus
+	}
+	return &JoinStatus{
+		State:  JoinState(b[0]),
+		Nodes:  binary.BigEndian.Uint32(b[1:]),
+		Detail: string(b[5:]),
+	}, nil
+}
@@ -1,12 +1,35 @@
 package overlaymessages
 
 import (
+	"encoding/binary"
 	"github.com/dist-ribut-us/crypto"
+	"github.com/dist-ribut-us/errors"
 	"github.com/dist-ribut-us/message"
+	"github.com/dist-ribut-us/rnet"
 )
 
 const (
 	GetID = message.Type(iota + message.ServiceTypeOffset)
+	FindNode
+	Put
+	Get
+	Store
+	FindValue
+	BuildCircuit
+	CircuitSend
+	CloseCircuit
+	SubscribeNodeEvents
+	NodeRemoved
+	Nack
+	Bootstrap
+	JoinStatusUpdate
+	PeerExchange
+	Rekey
+	Rendezvous
+	PunchRequest
+	ObservedAddr
+	PortMappingStatus
+	RendezvousRegister
 )
 
 const (
@@ -28,3 +51,72 @@ func DeserializeID(b []byte) *ID {
 		Xchng: crypto.XchgPubFromSlice(b[crypto.KeyLength:]),
 	}
 }
+
+// ErrBadContacts is returned when a serialized contact list is malformed
+const ErrBadContacts = errors.String("Malformed contact list")
+
+// Contact is the information needed to reach a node in the DHT. Xchng may be
+// nil if the exchange key is not known.
+type Contact struct {
+	Sign  *crypto.SignPub
+	Xchng *crypto.XchgPub
+	Addr  *rnet.Addr
+}
+
+const contactKeysLen = crypto.KeyLength * 2
+
+var zeroKey = make([]byte, crypto.KeyLength)
+
+func (c *Contact) serialize(b []byte) []byte {
+	b = append(b, c.Sign.Slice()...)
+	if c.Xchng == nil {
+		b = append(b, zeroKey...)
+	} else {
+		b = append(b, c.Xchng.Slice()...)
+	}
+	var addr []byte
+	if c.Addr != nil {
+		addr = message.FromAddr(c.Addr).Marshal()
+	}
+	var l [2]byte
+	binary.BigEndian.PutUint16(l[:], uint16(len(addr)))
+	b = append(b, l[:]...)
+	return append(b, addr...)
+}
+
+// SerializeContacts encodes a list of contacts, as returned by a FindNode
+// query.
+func SerializeContacts(cs []*Contact) []byte {
+	var b []byte
+	for _, c := range cs {
+		b = c.serialize(b)
+	}
+	return b
+}
+
+// DeserializeContacts decodes a list of contacts created by SerializeContacts.
+func DeserializeContacts(b []byte) ([]*Contact, error) {
+	var cs []*Contact
+	for len(b) > 0 {
+		if len(b) < contactKeysLen+2 {
+			return nil, ErrBadContacts
+		}
+		c := &Contact{
+			Sign: crypto.SignPubFromSlice(b[:crypto.KeyLength]),
+		}
+		if x := b[crypto.KeyLength:contactKeysLen]; string(x) != string(zeroKey) {
+			c.Xchng = crypto.XchgPubFromSlice(x)
+		}
+		l := int(binary.BigEndian.Uint16(b[contactKeysLen:]))
+		b = b[contactKeysLen+2:]
+		if len(b) < l {
+			return nil, ErrBadContacts
+		}
+		if l > 0 {
+			c.Addr = message.UnmarshalAddrpb(b[:l]).GetAddr()
+		}
+		b = b[l:]
+		cs = append(cs, c)
+	}
+	return cs, nil
+}
@@ -0,0 +1,68 @@
+package overlaymessages
+
+import (
+	"encoding/binary"
+	"github.com/dist-ribut-us/errors"
+)
+
+// NackReason explains why Overlay could not deliver a message
+type NackReason byte
+
+// Nack reasons
+const (
+	NackUnknownNode = NackReason(iota + 1)
+	NackHandshakeTimeout
+	NackQueueFull
+	NackEncoding
+	NackEncryption
+	NackTransport
+	NackQueryTimeout
+)
+
+var nackReasonStrings = map[NackReason]string{
+	NackUnknownNode:      "unknown node",
+	NackHandshakeTimeout: "handshake timeout",
+	NackQueueFull:        "send queue full",
+	NackEncoding:         "encoding error",
+	NackEncryption:       "encryption error",
+	NackTransport:        "transport error",
+	NackQueryTimeout:     "query timeout",
+}
+
+func (r NackReason) String() string {
+	if s, ok := nackReasonStrings[r]; ok {
+		return s
+	}
+	return "unknown reason"
+}
+
+// ErrBadNack is returned when a serialized Nack is malformed
+const ErrBadNack = errors.String("Malformed nack")
+
+// Nack is sent by Overlay to the origin service when a message it asked
+// Overlay to send could not be delivered. ID is the ID of the failed message.
+type Nack struct {
+	ID     uint32
+	Reason NackReason
+	Detail string
+}
+
+// Serialize the Nack
+func (n *Nack) Serialize() []byte {
+	b := make([]byte, 5, 5+len(n.Detail))
+	binary.BigEndian.PutUint32(b, n.ID)
+	b[4] = byte(n.Reason)
+	return append(b, n.Detail...)
+}
+
+// DeserializeNack decodes a Nack created by Serialize
+func DeserializeNack(b []byte) (*Nack, error) {
+	if len(b) < 5 {
+		return nil, ErrBadNack
+	}
+	return &Nack{
+		ID:     binary.BigEndian.Uint32(b),
+		Reason: NackReason(b[4]),
+		Detail: string(b[5:]),
+	}, nil
+}
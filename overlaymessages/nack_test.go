@@ -0,0 +1,22 @@
+package overlaymessages
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestNackSerialize(t *testing.T) {
+	n := &Nack{
+		ID:     12345,
+		Reason: NackHandshakeTimeout,
+		Detail: "Handshake timed out",
+	}
+	n2, err := DeserializeNack(n.Serialize())
+	assert.NoError(t, err)
+	assert.Equal(t, n, n2)
+	assert.Equal(t, "handshake timeout", n2.Reason.String())
+	assert.Equal(t, "unknown reason", NackReason(0).String())
+
+	_, err = DeserializeNack([]byte{1, 2})
+	assert.Equal(t, ErrBadNack, err)
+}
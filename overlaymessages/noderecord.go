@@ -0,0 +1,219 @@
+package overlaymessages
+
+import (
+	"encoding/binary"
+	"github.com/dist-ribut-us/crypto"
+	"github.com/dist-ribut-us/errors"
+	"github.com/dist-ribut-us/message"
+	"github.com/dist-ribut-us/rnet"
+	"time"
+)
+
+// ProtocolVersion is the overlay protocol version implemented by this package.
+// Version 2 adds connection IDs and packet counters to session packets and the
+// path probe, relay and LAN announcement packets; version 1 nodes cannot read
+// them.
+const ProtocolVersion uint16 = 2
+
+// nodeRecordFormat is the first byte of a serialized NodeRecord so the format
+// can be changed later.
+const nodeRecordFormat byte = 1
+
+// Limits on the lists in a NodeRecord
+const (
+	MaxRecordAddrs    = 8
+	MaxRecordVersions = 8
+)
+
+// ErrBadNodeRecord is returned when a serialized NodeRecord is malformed
+const ErrBadNodeRecord = errors.String("Malformed node record")
+
+// Role is a set of flags for the services a node offers
+type Role byte
+
+// Roles
+const (
+	RoleDHT = Role(1 << iota)
+	RoleBeacon
+	RoleRelay
+)
+
+// Has returns true if all the roles in r2 are set in r.
+func (r Role) Has(r2 Role) bool {
+	return r&r2 == r2
+}
+
+// NodeRecord describes how to reach a node and what it supports. It is signed
+// by the node it describes so any node can verify it and pass it on
+// unaltered. When there is more than one record for a node, the one with the
+// highest Seq replaces the others. A record is only valid until Expires.
+type NodeRecord struct {
+	ID       *ID
+	Addrs    []*rnet.Addr
+	Versions []uint16
+	Roles    Role
+	Seq      uint64
+	Expires  time.Time
+	Sig      []byte
+}
+
+// format byte, sign key, exchange key, seq, expires, roles
+const nodeRecordHeaderLen = 1 + crypto.KeyLength*2 + 8 + 8 + 1
+
+func (r *NodeRecord) signed() []byte {
+	b := make([]byte, nodeRecordHeaderLen, nodeRecordHeaderLen+64)
+	b[0] = nodeRecordFormat
+	copy(b[1:], r.ID.Sign.Slice())
+	if r.ID.Xchng != nil {
+		copy(b[1+crypto.KeyLength:], r.ID.Xchng.Slice())
+	}
+	binary.BigEndian.PutUint64(b[1+crypto.KeyLength*2:], r.Seq)
+	binary.BigEndian.PutUint64(b[9+crypto.KeyLength*2:], uint64(r.Expires.Unix()))
+	b[17+crypto.KeyLength*2] = byte(r.Roles)
+
+	b = append(b, byte(len(r.Versions)))
+	for _, v := range r.Versions {
+		var vb [2]byte
+		binary.BigEndian.PutUint16(vb[:], v)
+		b = append(b, vb[:]...)
+	}
+	b = append(b, byte(len(r.Addrs)))
+	for _, addr := range r.Addrs {
+		ab := message.FromAddr(addr).Marshal()
+		var l [2]byte
+		binary.BigEndian.PutUint16(l[:], uint16(len(ab)))
+		b = append(b, l[:]...)
+		b = append(b, ab...)
+	}
+	return b
+}
+
+// Sign sets the sign key of the record to the public key of priv and signs it.
+func (r *NodeRecord) Sign(priv *crypto.SignPriv) {
+	if r.ID == nil {
+		r.ID = &ID{}
+	}
+	r.ID.Sign = priv.Pub()
+	r.Sig = priv.Sign(r.signed())
+}
+
+// Verify checks the signature on the record.
+func (r *NodeRecord) Verify() bool {
+	return r.ID != nil && r.ID.Sign != nil && len(r.Addrs) > 0 &&
+		len(r.Addrs) <= MaxRecordAddrs && len(r.Versions) <= MaxRecordVersions &&
+		r.ID.Sign.Verify(r.signed(), r.Sig)
+}
+
+// Expired returns true if the record is no longer valid.
+func (r *NodeRecord) Expired() bool {
+	return !r.Expires.After(time.Now())
+}
+
+// Supports returns true if the node supports protocol version v.
+func (r *NodeRecord) Supports(v uint16) bool {
+	for _, rv := range r.Versions {
+		if rv == v {
+			return true
+		}
+	}
+	return false
+}
+
+// Serialize a signed record.
+func (r *NodeRecord) Serialize() []byte {
+	return append(r.signed(), r.Sig...)
+}
+
+// DeserializeNodeRecord decodes a record created by Serialize. The signature
+// is not checked.
+func DeserializeNodeRecord(b []byte) (*NodeRecord, error) {
+	if len(b) < nodeRecordHeaderLen+2+crypto.SignatureLength || b[0] != nodeRecordFormat {
+		return nil, ErrBadNodeRecord
+	}
+	r := &NodeRecord{
+		ID: &ID{
+			Sign: crypto.SignPubFromSlice(b[1 : 1+crypto.KeyLength]),
+		},
+		Seq:     binary.BigEndian.Uint64(b[1+crypto.KeyLength*2:]),
+		Expires: time.Unix(int64(binary.BigEndian.Uint64(b[9+crypto.KeyLength*2:])), 0),
+		Roles:   Role(b[17+crypto.KeyLength*2]),
+	}
+	if x := b[1+crypto.KeyLength : 1+crypto.KeyLength*2]; string(x) != string(zeroKey) {
+		r.ID.Xchng = crypto.XchgPubFromSlice(x)
+	}
+	sigStart := len(b) - crypto.SignatureLength
+	r.Sig = append([]byte(nil), b[sigStart:]...)
+	b = b[nodeRecordHeaderLen:sigStart]
+
+	nv := int(b[0])
+	b = b[1:]
+	if nv > MaxRecordVersions || len(b) < nv*2+1 {
+		return nil, ErrBadNodeRecord
+	}
+	for i := 0; i < nv; i++ {
+		r.Versions = append(r.Versions, binary.BigEndian.Uint16(b[i*2:]))
+	}
+	b = b[nv*2:]
+
+	na := int(b[0])
+	b = b[1:]
+	if na > MaxRecordAddrs {
+		return nil, ErrBadNodeRecord
+	}
+	for i := 0; i < na; i++ {
+		if len(b) < 2 {
+			return nil, ErrBadNodeRecord
+		}
+		l := int(binary.BigEndian.Uint16(b))
+		b = b[2:]
+		if l == 0 || len(b) < l {
+			return nil, ErrBadNodeRecord
+		}
+		addr := message.UnmarshalAddrpb(b[:l]).GetAddr()
+		if addr == nil {
+			return nil, ErrBadNodeRecord
+		}
+		r.Addrs = append(r.Addrs, addr)
+		b = b[l:]
+	}
+	if len(b) != 0 {
+		return nil, ErrBadNodeRecord
+	}
+	return r, nil
+}
+
+// SerializeNodeRecords encodes a list of records, each prefixed with its
+// length.
+func SerializeNodeRecords(rs []*NodeRecord) []byte {
+	var b []byte
+	for _, r := range rs {
+		rb := r.Serialize()
+		var l [2]byte
+		binary.BigEndian.PutUint16(l[:], uint16(len(rb)))
+		b = append(b, l[:]...)
+		b = append(b, rb...)
+	}
+	return b
+}
+
+// DeserializeNodeRecords decodes a list created by SerializeNodeRecords.
+func DeserializeNodeRecords(b []byte) ([]*NodeRecord, error) {
+	var rs []*NodeRecord
+	for len(b) > 0 {
+		if len(b) < 2 {
+			return nil, ErrBadNodeRecord
+		}
+		l := int(binary.BigEndian.Uint16(b))
+		b = b[2:]
+		if len(b) < l {
+			return nil, ErrBadNodeRecord
+		}
+		r, err := DeserializeNodeRecord(b[:l])
+		if err != nil {
+			return nil, err
+		}
+		rs = append(rs, r)
+		b = b[l:]
+	}
+	return rs, nil
+}
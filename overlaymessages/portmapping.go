@@ -0,0 +1,73 @@
+package overlaymessages
+
+import (
+	"encoding/binary"
+	"github.com/dist-ribut-us/errors"
+	"net"
+	"time"
+)
+
+// ErrBadPortMapping is returned when a serialized PortMapping is malformed
+const ErrBadPortMapping = errors.String("Malformed port mapping")
+
+// PortMapping is the state of the mapping of the overlay port on the gateway.
+// It is the response to a PortMappingStatus query. If there is no mapping,
+// Backend is empty and Err holds the last error.
+type PortMapping struct {
+	Backend    string
+	Internal   uint16
+	External   uint16
+	ExternalIP net.IP
+	Expires    time.Time
+	Err        string
+}
+
+// Mapped returns true if the port is mapped.
+func (pm *PortMapping) Mapped() bool {
+	return pm.Backend != ""
+}
+
+// Serialize the port mapping.
+func (pm *PortMapping) Serialize() []byte {
+	b := make([]byte, 0, 16+len(pm.Backend)+len(pm.ExternalIP)+len(pm.Err))
+	b = append(b, byte(len(pm.Backend)))
+	b = append(b, pm.Backend...)
+	var ports [4]byte
+	binary.BigEndian.PutUint16(ports[:], pm.Internal)
+	binary.BigEndian.PutUint16(ports[2:], pm.External)
+	b = append(b, ports[:]...)
+	b = append(b, byte(len(pm.ExternalIP)))
+	b = append(b, pm.ExternalIP...)
+	var exp [8]byte
+	if !pm.Expires.IsZero() {
+		binary.BigEndian.PutUint64(exp[:], uint64(pm.Expires.Unix()))
+	}
+	b = append(b, exp[:]...)
+	return append(b, pm.Err...)
+}
+
+// DeserializePortMapping decodes a port mapping created by Serialize.
+func DeserializePortMapping(b []byte) (*PortMapping, error) {
+	pm := &PortMapping{}
+	if len(b) < 1 || len(b) < 1+int(b[0])+5 {
+		return nil, ErrBadPortMapping
+	}
+	l := int(b[0])
+	pm.Backend = string(b[1 : 1+l])
+	b = b[1+l:]
+	pm.Internal = binary.BigEndian.Uint16(b)
+	pm.External = binary.BigEndian.Uint16(b[2:])
+	l = int(b[4])
+	b = b[5:]
+	if (l != 0 && l != net.IPv4len && l != net.IPv6len) || len(b) < l+8 {
+		return nil, ErrBadPortMapping
+	}
+	if l > 0 {
+		pm.ExternalIP = append(net.IP(nil), b[:l]...)
+	}
+	if exp := binary.BigEndian.Uint64(b[l:]); exp != 0 {
+		pm.Expires = time.Unix(int64(exp), 0)
+	}
+	pm.Err = string(b[l+8:])
+	return pm, nil
+}
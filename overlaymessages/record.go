@@ -0,0 +1,148 @@
+package overlaymessages
+
+import (
+	"encoding/binary"
+	"github.com/dist-ribut-us/crypto"
+	"github.com/dist-ribut-us/errors"
+	"time"
+)
+
+// MaxValueLength is the largest value that can be stored in the DHT
+const MaxValueLength = 4096
+
+// Errors decoding records and put requests
+const (
+	ErrBadRecord     = errors.String("Malformed DHT record")
+	ErrBadPutRequest = errors.String("Malformed DHT put request")
+	ErrBadGetRequest = errors.String("Malformed DHT get request")
+	ErrValueTooLong  = errors.String("DHT value exceeds MaxValueLength")
+)
+
+// Record is a signed key/value pair stored in the DHT. A record is only valid
+// until Expires. Of two records for the same key from the same publisher, the
+// one with the higher Seq replaces the other.
+type Record struct {
+	Key       []byte
+	Value     []byte
+	Publisher *crypto.SignPub
+	Expires   time.Time
+	Seq       uint64
+	Sig       []byte
+}
+
+const recordHeaderLen = crypto.KeyLength + 8 + 8 + 2 + 4
+
+func (r *Record) signed() []byte {
+	b := make([]byte, recordHeaderLen, recordHeaderLen+len(r.Key)+len(r.Value)+crypto.SignatureLength)
+	copy(b, r.Publisher.Slice())
+	binary.BigEndian.PutUint64(b[crypto.KeyLength:], uint64(r.Expires.Unix()))
+	binary.BigEndian.PutUint64(b[crypto.KeyLength+8:], r.Seq)
+	binary.BigEndian.PutUint16(b[crypto.KeyLength+16:], uint16(len(r.Key)))
+	binary.BigEndian.PutUint32(b[crypto.KeyLength+18:], uint32(len(r.Value)))
+	b = append(b, r.Key...)
+	return append(b, r.Value...)
+}
+
+// Sign sets the publisher of the record to the public key of priv and signs
+// it.
+func (r *Record) Sign(priv *crypto.SignPriv) {
+	r.Publisher = priv.Pub()
+	r.Sig = priv.Sign(r.signed())
+}
+
+// Verify checks the signature on the record.
+func (r *Record) Verify() bool {
+	return r.Publisher != nil && len(r.Value) <= MaxValueLength && r.Publisher.Verify(r.signed(), r.Sig)
+}
+
+// Expired returns true if the record is no longer valid.
+func (r *Record) Expired() bool {
+	return !r.Expires.After(time.Now())
+}
+
+// Serialize a signed record.
+func (r *Record) Serialize() []byte {
+	return append(r.signed(), r.Sig...)
+}
+
+// DeserializeRecord decodes a record created by Serialize. The signature is
+// not checked.
+func DeserializeRecord(b []byte) (*Record, error) {
+	if len(b) < recordHeaderLen+crypto.SignatureLength {
+		return nil, ErrBadRecord
+	}
+	kl := int(binary.BigEndian.Uint16(b[crypto.KeyLength+16:]))
+	vl := int(binary.BigEndian.Uint32(b[crypto.KeyLength+18:]))
+	if vl > MaxValueLength || len(b) != recordHeaderLen+kl+vl+crypto.SignatureLength {
+		return nil, ErrBadRecord
+	}
+	r := &Record{
+		Publisher: crypto.SignPubFromSlice(b[:crypto.KeyLength]),
+		Expires:   time.Unix(int64(binary.BigEndian.Uint64(b[crypto.KeyLength:])), 0),
+		Seq:       binary.BigEndian.Uint64(b[crypto.KeyLength+8:]),
+	}
+	b = b[recordHeaderLen:]
+	r.Key = append([]byte(nil), b[:kl]...)
+	r.Value = append([]byte(nil), b[kl:kl+vl]...)
+	r.Sig = append([]byte(nil), b[kl+vl:]...)
+	return r, nil
+}
+
+// PutRequest is the body of a Put query sent to Overlay by a service.
+type PutRequest struct {
+	Key   []byte
+	Value []byte
+	TTL   uint32 // seconds
+}
+
+// Serialize the PutRequest
+func (p *PutRequest) Serialize() []byte {
+	b := make([]byte, 6, 6+len(p.Key)+len(p.Value))
+	binary.BigEndian.PutUint32(b, p.TTL)
+	binary.BigEndian.PutUint16(b[4:], uint16(len(p.Key)))
+	b = append(b, p.Key...)
+	return append(b, p.Value...)
+}
+
+// DeserializePutRequest decodes a PutRequest created by Serialize.
+func DeserializePutRequest(b []byte) (*PutRequest, error) {
+	if len(b) < 6 {
+		return nil, ErrBadPutRequest
+	}
+	kl := int(binary.BigEndian.Uint16(b[4:]))
+	if len(b) < 6+kl {
+		return nil, ErrBadPutRequest
+	}
+	p := &PutRequest{
+		TTL:   binary.BigEndian.Uint32(b),
+		Key:   b[6 : 6+kl],
+		Value: b[6+kl:],
+	}
+	if len(p.Value) > MaxValueLength {
+		return nil, ErrValueTooLong
+	}
+	return p, nil
+}
+
+// GetRequest is the body of a Get query sent to Overlay by a service. Keys are
+// namespaced by publisher, so the publisher is part of the request.
+type GetRequest struct {
+	Publisher *crypto.SignPub
+	Key       []byte
+}
+
+// Serialize the GetRequest
+func (g *GetRequest) Serialize() []byte {
+	return append(g.Publisher.Slice(), g.Key...)
+}
+
+// DeserializeGetRequest decodes a GetRequest created by Serialize.
+func DeserializeGetRequest(b []byte) (*GetRequest, error) {
+	if len(b) < crypto.KeyLength {
+		return nil, ErrBadGetRequest
+	}
+	return &GetRequest{
+		Publisher: crypto.SignPubFromSlice(b[:crypto.KeyLength]),
+		Key:       b[crypto.KeyLength:],
+	}, nil
+}
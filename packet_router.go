@@ -9,12 +9,32 @@ const (
 	handshakeRequest = byte(iota)
 	handshakeResponse
 	encSymmetric
+	onionRelay
+	handshakeCookie
+	hiddenHandshakeRequest
+	hiddenHandshakeResponse
+	pathProbe
+	pathProbeReply
+	relayForward
+	relayDeliver
+	lanAnnounce
+	onionData
 )
 
 var handlers = map[byte]func(*Server, []byte, *rnet.Addr){
-	handshakeRequest:  (*Server).handleHandshakeRequest,
-	handshakeResponse: (*Server).handleHandshakeResponse,
-	encSymmetric:      (*Server).message,
+	handshakeRequest:        (*Server).handleHandshakeRequest,
+	handshakeResponse:       (*Server).handleHandshakeResponse,
+	encSymmetric:            (*Server).message,
+	onionRelay:              (*Server).handleOnion,
+	handshakeCookie:         (*Server).handleHandshakeCookie,
+	hiddenHandshakeRequest:  (*Server).handleHiddenHandshakeRequest,
+	hiddenHandshakeResponse: (*Server).handleHiddenHandshakeResponse,
+	pathProbe:               (*Server).handlePathProbe,
+	pathProbeReply:          (*Server).handlePathProbeReply,
+	relayForward:            (*Server).handleRelayForward,
+	relayDeliver:            (*Server).handleRelayDeliver,
+	lanAnnounce:             (*Server).handleLANAnnounce,
+	onionData:               (*Server).handleOnionData,
 }
 
 // Receive fulfills PacketHandler allowing the server to handle network packets
@@ -0,0 +1,318 @@
+package overlay
+
+import (
+	"encoding/binary"
+	"github.com/dist-ribut-us/log"
+	"github.com/dist-ribut-us/rnet"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// Path parameters. A node may have up to maxPaths candidate addresses. When
+// there is more than one, each is probed every probeInterval through the
+// session. A probe that is not answered within probeTimeout is sent again
+// until the path has missed pathMaxFailures probes in a row, so a dead path is
+// dropped within a few seconds. A path is working if it has answered a probe
+// or delivered a packet within pathStale and has not missed pathMaxFailures
+// probes in a row. Probes carry packet counters and are checked against the
+// replay window like any other session packet. netSend
+// uses the best working path: LAN first, then IPv6, IPv4 and finally relayed,
+// with the lowest round trip time breaking ties. Relayed paths are not probed;
+// they are kept working by the packets that arrive through the relay.
+var (
+	maxPaths        = 8
+	probeInterval   = time.Second * 30
+	probeTimeout    = time.Second * 2
+	pathStale       = probeInterval * 3
+	pathMaxFailures = 3
+)
+
+type pathKind byte
+
+// Path kinds, in order of preference
+const (
+	pathLAN = pathKind(iota)
+	pathIPv6
+	pathIPv4
+	pathRelay
+)
+
+type path struct {
+	addr     *rnet.Addr
+	kind     pathKind
+	relay    *node // set for pathRelay, addr is the address of the relay
+	rtt      time.Duration
+	lastOK   time.Time
+	failures int
+}
+
+func (p *path) working(now time.Time) bool {
+	return p.failures < pathMaxFailures && now.Sub(p.lastOK) < pathStale
+}
+
+// better returns true if p should be used over p2.
+func (p *path) better(p2 *path) bool {
+	if p.kind != p2.kind {
+		return p.kind < p2.kind
+	}
+	return p.rtt < p2.rtt
+}
+
+// sentProbe is a probe that is waiting for a reply.
+type sentProbe struct {
+	node *node
+	addr *rnet.Addr
+	sent time.Time
+}
+
+func addrIP(addr *rnet.Addr) net.IP {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+var lanNets = func() []*net.IPNet {
+	var ns []*net.IPNet
+	for _, cidr := range []string{"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "fc00::/7"} {
+		_, n, _ := net.ParseCIDR(cidr)
+		ns = append(ns, n)
+	}
+	return ns
+}()
+
+// addrKind classifies a direct address.
+func addrKind(addr *rnet.Addr) pathKind {
+	ip := addrIP(addr)
+	if ip == nil {
+		return pathIPv4
+	}
+	if ip.IsLoopback() || ip.IsLinkLocalUnicast() {
+		return pathLAN
+	}
+	for _, n := range lanNets {
+		if n.Contains(ip) {
+			return pathLAN
+		}
+	}
+	if ip.To4() == nil {
+		return pathIPv6
+	}
+	return pathIPv4
+}
+
+// addPath adds a candidate address for the node.
+func (n *node) addPath(addr *rnet.Addr, kind pathKind) {
+	n.Lock()
+	n.addPathLocked(addr, kind)
+	n.Unlock()
+}
+
+func (n *node) addPathLocked(addr *rnet.Addr, kind pathKind) {
+	if addr == nil || n.findPath(addr) != nil || len(n.paths) >= maxPaths {
+		return
+	}
+	n.paths = append(n.paths, &path{
+		addr: addr,
+		kind: kind,
+	})
+}
+
+// findPath must be called with the lock held.
+func (n *node) findPath(addr *rnet.Addr) *path {
+	s := addr.String()
+	for _, p := range n.paths {
+		if p.addr.String() == s {
+			return p
+		}
+	}
+	return nil
+}
+
+// pathOK records a reply to a probe on addr.
+func (n *node) pathOK(addr *rnet.Addr, rtt time.Duration) {
+	n.Lock()
+	if p := n.findPath(addr); p != nil {
+		p.rtt, p.lastOK, p.failures = rtt, time.Now(), 0
+	}
+	n.Unlock()
+}
+
+// pathSeen records an authenticated packet from addr.
+func (n *node) pathSeen(addr *rnet.Addr) {
+	n.Lock()
+	if p := n.findPath(addr); p != nil {
+		p.lastOK, p.failures = time.Now(), 0
+	}
+	n.Unlock()
+}
+
+// pathFailed records a missed probe or a failed send on addr. It returns true
+// if the path has not yet failed pathMaxFailures times.
+func (n *node) pathFailed(addr *rnet.Addr) bool {
+	n.Lock()
+	defer n.Unlock()
+	p := n.findPath(addr)
+	if p == nil {
+		return false
+	}
+	p.failures++
+	return p.failures < pathMaxFailures
+}
+
+// bestPath returns the best working path or nil if none are working.
+func (n *node) bestPath() *path {
+	now := time.Now()
+	n.Lock()
+	defer n.Unlock()
+	var best *path
+	for _, p := range n.paths {
+		if p.working(now) && (best == nil || p.better(best)) {
+			best = p
+		}
+	}
+	return best
+}
+
+// selectPath points ToAddr at the best working path or, if that is a relayed
+// path, sends through its relay. If no path is known to work, nothing changes.
+func (s *Server) selectPath(n *node) {
+	best := n.bestPath()
+	if best == nil {
+		return
+	}
+	n.Lock()
+	old, oldRelay := n.ToAddr, n.relay
+	n.relay = best.relay
+	if best.relay == nil {
+		n.ToAddr = best.addr
+	}
+	n.Unlock()
+	if oldRelay != best.relay || (best.relay == nil && (old == nil || old.String() != best.addr.String())) {
+		log.Info(log.Lbl("path_selected"), old, best.addr)
+	}
+}
+
+// sendProbe sends a probe through the session to addr. The reply is matched by
+// the random ID inside the sealed probe.
+func (s *Server) sendProbe(n *node, addr *rnet.Addr) {
+	id := randomConnID()
+	key := n.sessionKey()
+	if key == nil {
+		return
+	}
+	s.probes.set(id, &sentProbe{
+		node: n,
+		addr: addr,
+		sent: time.Now(),
+	})
+	time.AfterFunc(probeTimeout, func() { s.probeTimedOut(id) })
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], id)
+	pkt := key.SealPackets(n.packetTag(pathProbe), n.addCounters([][]byte{b[:]}), nil, 0)
+	if len(pkt) == 0 {
+		return
+	}
+	log.Error(s.net.Send(pkt[0], addr))
+}
+
+// probeTimedOut fails a probe that has not been answered, picks a new path
+// and probes the path again unless it has failed too often.
+func (s *Server) probeTimedOut(id uint64) {
+	s.probes.Lock()
+	p, ok := s.probes.Map[id]
+	delete(s.probes.Map, id)
+	s.probes.Unlock()
+	if !ok {
+		return
+	}
+	retry := p.node.pathFailed(p.addr)
+	s.selectPath(p.node)
+	if retry {
+		s.sendProbe(p.node, p.addr)
+	}
+}
+
+// openProbe finds the session for a probe or probe reply and opens it.
+func (s *Server) openProbe(pkt []byte, addr *rnet.Addr) (*node, []byte, bool) {
+	if len(pkt) < 1+connIDLen {
+		return nil, nil, false
+	}
+	n, ok := s.nodeByConn(binary.BigEndian.Uint64(pkt[1:]))
+	if !ok {
+		return nil, nil, false
+	}
+	b, err := n.open(pkt[1+connIDLen:])
+	if err == nil {
+		b, _, err = n.checkCounter(b)
+	}
+	if err == ErrReplayedPacket {
+		atomic.AddUint64(&s.replayed, 1)
+		log.Info(log.Lbl("dropped_replayed_probe"), addr)
+		return nil, nil, false
+	}
+	if err != nil || len(b) != 8 {
+		log.Info(log.Lbl("bad_path_probe"), addr)
+		return nil, nil, false
+	}
+	return n, b, true
+}
+
+// handlePathProbe echoes a probe back to the address it came from.
+func (s *Server) handlePathProbe(pkt []byte, addr *rnet.Addr) {
+	n, b, ok := s.openProbe(pkt, addr)
+	if !ok {
+		return
+	}
+	key := n.sessionKey()
+	if key == nil {
+		return
+	}
+	reply := key.SealPackets(n.packetTag(pathProbeReply), n.addCounters([][]byte{b}), nil, 0)
+	if len(reply) == 0 {
+		return
+	}
+	log.Error(s.net.Send(reply[0], addr))
+}
+
+func (s *Server) handlePathProbeReply(pkt []byte, addr *rnet.Addr) {
+	n, b, ok := s.openProbe(pkt, addr)
+	if !ok {
+		return
+	}
+	id := binary.BigEndian.Uint64(b)
+	p, ok := s.probes.get(id)
+	if !ok || p.node != n {
+		return
+	}
+	s.probes.delete(id)
+	n.pathOK(p.addr, time.Since(p.sent))
+	s.selectPath(n)
+}
+
+// probePaths probes every direct path of live nodes with more than one.
+func (s *Server) probePaths() {
+	for _, n := range s.all() {
+		if !n.hasSession() || !n.live() {
+			continue
+		}
+		to := n.toAddr()
+		n.addPath(to, addrKind(to))
+		n.Lock()
+		addrs := make([]*rnet.Addr, 0, len(n.paths))
+		for _, p := range n.paths {
+			if p.kind != pathRelay {
+				addrs = append(addrs, p.addr)
+			}
+		}
+		n.Unlock()
+		if len(addrs) < 2 {
+			continue
+		}
+		for _, addr := range addrs {
+			s.sendProbe(n, addr)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package overlay
+
+import (
+	"github.com/dist-ribut-us/rnet"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestAddrKind(t *testing.T) {
+	assert.Equal(t, pathLAN, addrKind(rnet.Port(1).On("192.168.1.4")))
+	assert.Equal(t, pathLAN, addrKind(rnet.Port(1).On("127.0.0.1")))
+	assert.Equal(t, pathIPv4, addrKind(rnet.Port(1).On("8.8.8.8")))
+	assert.Equal(t, pathIPv6, addrKind(rnet.Port(1).On("2001:db8::1")))
+}
+
+func TestBestPath(t *testing.T) {
+	n := &node{}
+	assert.Nil(t, n.bestPath())
+
+	wan := rnet.Port(1).On("8.8.8.8")
+	lan := rnet.Port(1).On("192.168.1.4")
+	r := &node{ToAddr: rnet.Port(2).On("8.8.4.4")}
+	n.addPath(wan, addrKind(wan))
+	n.addPath(lan, addrKind(lan))
+	n.addRelayPath(r)
+	n.addPath(wan, addrKind(wan))
+	assert.Len(t, n.paths, 3)
+	assert.True(t, n.relayed(r))
+
+	n.relaySeen(r)
+	assert.Equal(t, r, n.bestPath().relay)
+	n.pathOK(wan, time.Millisecond*50)
+	assert.Equal(t, wan, n.bestPath().addr)
+	n.pathOK(lan, time.Millisecond*100)
+	assert.Equal(t, lan, n.bestPath().addr)
+
+	for i := 0; i < pathMaxFailures; i++ {
+		n.pathFailed(lan)
+	}
+	assert.Equal(t, wan, n.bestPath().addr)
+	n.pathSeen(lan)
+	assert.Equal(t, lan, n.bestPath().addr)
+}
+
+func TestProbePaths(t *testing.T) {
+	srvs := newTestChain(t, 2)
+	for _, s := range srvs {
+		defer s.Close()
+	}
+	n, _ := srvs[0].nodeByID(srvs[1].key.Pub().ID())
+	_, ok := srvs[0].queryFindNode(n, srvs[1].key.Pub().ID(), lookupTimeout)
+	assert.True(t, ok)
+
+	defer func(d time.Duration) { probeTimeout = d }(probeTimeout)
+	probeTimeout = time.Millisecond * 50
+
+	good := n.toAddr()
+	dead := getPort.Next().On("127.0.0.1")
+	n.addPath(dead, pathLAN)
+	n.setToAddr(dead)
+
+	// the reply on the good path moves the session to it and the dead path is
+	// probed again after each timeout until it has failed pathMaxFailures times
+	srvs[0].probePaths()
+	time.Sleep(probeTimeout * time.Duration(pathMaxFailures+2))
+	assert.Equal(t, good.String(), n.toAddr().String())
+	n.Lock()
+	assert.Equal(t, pathMaxFailures, n.findPath(dead).failures)
+	assert.Equal(t, 0, n.findPath(good).failures)
+	n.Unlock()
+	srvs[0].probes.RLock()
+	assert.Len(t, srvs[0].probes.Map, 0)
+	srvs[0].probes.RUnlock()
+
+	_, ok = srvs[0].queryFindNode(n, srvs[1].key.Pub().ID(), lookupTimeout)
+	assert.True(t, ok)
+}
+
+func TestProbeReplay(t *testing.T) {
+	srvs := newTestChain(t, 2)
+	for _, s := range srvs {
+		defer s.Close()
+	}
+	n, _ := srvs[0].nodeByID(srvs[1].key.Pub().ID())
+	_, ok := srvs[0].queryFindNode(n, srvs[1].key.Pub().ID(), lookupTimeout)
+	assert.True(t, ok)
+
+	var b [8]byte
+	pkt := n.sessionKey().SealPackets(n.packetTag(pathProbe), n.addCounters([][]byte{b[:]}), nil, 0)[0]
+	_, _, ok = srvs[1].openProbe(pkt, n.toAddr())
+	assert.True(t, ok)
+	before := srvs[1].ReplayedPackets()
+	_, _, ok = srvs[1].openProbe(pkt, n.toAddr())
+	assert.False(t, ok)
+	assert.Equal(t, before+1, srvs[1].ReplayedPackets())
+}
@@ -0,0 +1,274 @@
+package overlay
+
+import (
+	crand "crypto/rand"
+	"github.com/dist-ribut-us/crypto"
+	"github.com/dist-ribut-us/ipcrouter"
+	"github.com/dist-ribut-us/log"
+	"github.com/dist-ribut-us/overlay/overlaymessages"
+	"github.com/dist-ribut-us/rnet"
+	"math/big"
+	"net"
+	"sync"
+	"time"
+)
+
+// Peer exchange parameters. A PeerExchange query carries the node record of
+// the sender and the response is the record of the responder followed by the
+// records of a sample of other live nodes. Only records signed by the node
+// they describe are passed on.
+//
+// To keep one peer from flooding the node table, a peer may only query once
+// per pexMinInterval, at most pexMaxAccept entries are taken from a response
+// and at most pexPeerNewNodes new nodes are accepted from one peer and
+// pexNewNodes from all peers per minute. For diversity, at most pexPerSubnet
+// entries from one subnet are sent or accepted per exchange and no more than
+// maxNodesPerSubnet nodes from one subnet are kept.
+var (
+	pexInterval       = time.Minute * 10
+	pexMinInterval    = time.Second * 30
+	pexSampleSize     = 16
+	pexMaxAccept      = 10
+	pexNewNodes       = 50
+	pexPeerNewNodes   = 10
+	pexPerSubnet      = 2
+	maxNodesPerSubnet = 8
+)
+
+// pexBucket holds tokens for new nodes. It fills at size tokens per minute and
+// holds at most size tokens.
+type pexBucket struct {
+	tokens float64
+	filled time.Time
+}
+
+func (b *pexBucket) fill(size float64, now time.Time) {
+	b.tokens += now.Sub(b.filled).Minutes() * size
+	if b.tokens > size {
+		b.tokens = size
+	}
+	b.filled = now
+}
+
+type pexLimiter struct {
+	sync.Mutex
+	lastReq map[crypto.ID]time.Time
+	total   pexBucket
+	byPeer  map[crypto.ID]*pexBucket
+}
+
+func newPexLimiter() *pexLimiter {
+	return &pexLimiter{
+		lastReq: make(map[crypto.ID]time.Time),
+		total:   pexBucket{tokens: float64(pexNewNodes), filled: time.Now()},
+		byPeer:  make(map[crypto.ID]*pexBucket),
+	}
+}
+
+// allowRequest returns false if the node has sent a PeerExchange query within
+// pexMinInterval.
+func (l *pexLimiter) allowRequest(id *crypto.ID) bool {
+	now := time.Now()
+	l.Lock()
+	defer l.Unlock()
+	if last, ok := l.lastReq[*id]; ok && now.Sub(last) < pexMinInterval {
+		return false
+	}
+	l.lastReq[*id] = now
+	return true
+}
+
+// takeNewNode returns true if a token is available from both the bucket of
+// the peer that sent the node and the global bucket.
+func (l *pexLimiter) takeNewNode(peer *crypto.ID) bool {
+	now := time.Now()
+	l.Lock()
+	defer l.Unlock()
+	b, ok := l.byPeer[*peer]
+	if !ok {
+		b = &pexBucket{tokens: float64(pexPeerNewNodes), filled: now}
+		l.byPeer[*peer] = b
+	}
+	b.fill(float64(pexPeerNewNodes), now)
+	l.total.fill(float64(pexNewNodes), now)
+	if b.tokens < 1 || l.total.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	l.total.tokens--
+	return true
+}
+
+// expire forgets requests older than pexMinInterval and peer buckets that have
+// had a minute to fill up again.
+func (l *pexLimiter) expire() {
+	now := time.Now()
+	cutoff := now.Add(-pexMinInterval)
+	l.Lock()
+	for id, t := range l.lastReq {
+		if t.Before(cutoff) {
+			delete(l.lastReq, id)
+		}
+	}
+	for id, b := range l.byPeer {
+		if now.Sub(b.filled) > time.Minute {
+			delete(l.byPeer, id)
+		}
+	}
+	l.Unlock()
+}
+
+// subnet returns the /24 of an IPv4 address or the /48 of an IPv6 address.
+func subnet(addr *rnet.Addr) string {
+	ip := addrIP(addr)
+	if ip == nil {
+		return addr.String()
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(24, 32)).String()
+	}
+	return ip.Mask(net.CIDRMask(48, 128)).String()
+}
+
+func randInt(n int) int {
+	i, err := crand.Int(crand.Reader, big.NewInt(int64(n)))
+	if err != nil {
+		return 0
+	}
+	return int(i.Int64())
+}
+
+// pexSample returns the records of a random sample of live nodes, excluding
+// the node with the given ID.
+func (s *Server) pexSample(exclude *crypto.ID) []*overlaymessages.NodeRecord {
+	ns := s.all()
+	perSubnet := make(map[string]int)
+	var rs []*overlaymessages.NodeRecord
+	for len(ns) > 0 && len(rs) < pexSampleSize {
+		i := randInt(len(ns))
+		n := ns[i]
+		ns[i] = ns[len(ns)-1]
+		ns = ns[:len(ns)-1]
+		if !n.live() || (exclude != nil && *n.id() == *exclude) {
+			continue
+		}
+		r := n.getRecord()
+		if r == nil {
+			continue
+		}
+		sn := subnet(r.Addrs[0])
+		if perSubnet[sn] >= pexPerSubnet {
+			continue
+		}
+		perSubnet[sn]++
+		rs = append(rs, r)
+	}
+	return rs
+}
+
+func (s *Server) subnetCounts() map[string]int {
+	counts := make(map[string]int)
+	for _, n := range s.all() {
+		if to := n.toAddr(); to != nil {
+			counts[subnet(to)]++
+		}
+	}
+	return counts
+}
+
+// acceptPeers adds the nodes from a PeerExchange response from n. The first
+// entry is expected to be n's own record.
+func (s *Server) acceptPeers(n *node, rs []*overlaymessages.NodeRecord) {
+	if len(rs) > 0 && *rs[0].ID.Sign == *n.Pub {
+		n.setRecord(rs[0])
+		rs = rs[1:]
+	}
+	if len(rs) > pexMaxAccept {
+		rs = rs[:pexMaxAccept]
+	}
+
+	self := s.key.Pub().ID()
+	counts := s.subnetCounts()
+	perSubnet := make(map[string]int)
+	for _, r := range rs {
+		if !validRecord(r) {
+			continue
+		}
+		id := r.ID.Sign.ID()
+		if *id == *self {
+			continue
+		}
+		if known, ok := s.nodeByID(id); ok {
+			known.setRecord(r)
+			continue
+		}
+		sn := subnet(r.Addrs[0])
+		if perSubnet[sn] >= pexPerSubnet || counts[sn] >= maxNodesPerSubnet {
+			continue
+		}
+		if !s.pex.takeNewNode(n.id()) {
+			log.Info(log.Lbl("pex_new_node_limit"), n.id())
+			return
+		}
+		perSubnet[sn]++
+		counts[sn]++
+		s.addNode(nodeFromRecord(r))
+	}
+}
+
+func (s *Server) handlePeerExchangeQuery(q ipcrouter.NetQuery) {
+	from, err := crypto.IDFromSlice(q.GetNodeID())
+	if log.Error(err) {
+		return
+	}
+	n, ok := s.nodeByID(from)
+	if !ok {
+		return
+	}
+	if !s.pex.allowRequest(from) {
+		log.Info(log.Lbl("pex_rate_limited"), from)
+		q.Respond([]byte{})
+		return
+	}
+	if r, err := overlaymessages.DeserializeNodeRecord(q.GetBody()); err == nil {
+		n.setRecord(r)
+	}
+
+	var rs []*overlaymessages.NodeRecord
+	if self := s.selfRecord(); self != nil {
+		rs = append(rs, self)
+	}
+	rs = append(rs, s.pexSample(from)...)
+	q.Respond(overlaymessages.SerializeNodeRecords(rs))
+}
+
+// exchangePeers sends a PeerExchange query to n.
+func (s *Server) exchangePeers(n *node) {
+	var body []byte
+	if self := s.selfRecord(); self != nil {
+		body = self.Serialize()
+	}
+	s.router.
+		Query(overlaymessages.PeerExchange, body).
+		SetService(overlaymessages.ServiceID).
+		SendToNet(n.toAddr(), func(r ipcrouter.NetResponse) {
+			rs, err := overlaymessages.DeserializeNodeRecords(r.GetBody())
+			if log.Error(err) {
+				return
+			}
+			s.acceptPeers(n, rs)
+		})
+}
+
+// pexRound exchanges peers with a random node from the routing table.
+func (s *Server) pexRound() {
+	s.pex.expire()
+	if s.table == nil {
+		return
+	}
+	ns := s.table.closest(s.table.self, s.table.len())
+	if len(ns) == 0 {
+		return
+	}
+	s.exchangePeers(ns[randInt(len(ns))])
+}
@@ -0,0 +1,86 @@
+package overlay
+
+import (
+	"github.com/dist-ribut-us/crypto"
+	"github.com/dist-ribut-us/overlay/overlaymessages"
+	"github.com/dist-ribut-us/rnet"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestSubnet(t *testing.T) {
+	assert.Equal(t, subnet(rnet.Port(1).On("10.1.2.3")), subnet(rnet.Port(2).On("10.1.2.200")))
+	assert.NotEqual(t, subnet(rnet.Port(1).On("10.1.2.3")), subnet(rnet.Port(1).On("10.1.3.3")))
+}
+
+func TestPexLimiter(t *testing.T) {
+	l := newPexLimiter()
+	var id crypto.ID
+	assert.True(t, l.allowRequest(&id))
+	assert.False(t, l.allowRequest(&id))
+
+	// one peer can only use its own bucket
+	for i := 0; i < pexPeerNewNodes; i++ {
+		assert.True(t, l.takeNewNode(&id))
+	}
+	assert.False(t, l.takeNewNode(&id))
+
+	// the remaining global tokens are shared by the other peers
+	for i := pexPeerNewNodes; i < pexNewNodes; i++ {
+		other := crypto.ID{byte(i)}
+		assert.True(t, l.takeNewNode(&other))
+	}
+	other := crypto.ID{255}
+	assert.False(t, l.takeNewNode(&other))
+}
+
+func TestAcceptPeers(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+
+	_, priv := crypto.GenerateSignPair()
+	from := &node{Pub: priv.Pub()}
+	s.addNode(from)
+
+	var rs []*overlaymessages.NodeRecord
+	for i := 0; i < 5; i++ {
+		rs = append(rs, newTestRecord(rnet.Port(7000+i).On("10.1.2.3"), time.Now().Add(time.Minute)))
+	}
+	rs = append(rs, newTestRecord(rnet.Port(7000).On("10.9.9.9"), time.Now().Add(-time.Minute)))
+
+	s.acceptPeers(from, rs)
+	for i, r := range rs {
+		_, ok := s.nodeByID(r.ID.Sign.ID())
+		assert.Equal(t, i < pexPerSubnet, ok)
+	}
+}
+
+func TestAcceptPeersKeepsAddress(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+
+	_, priv := crypto.GenerateSignPair()
+	from := &node{Pub: priv.Pub()}
+	s.addNode(from)
+
+	addr := rnet.Port(7000).On("10.1.2.3")
+	_, ownerPriv := crypto.GenerateSignPair()
+	owner := &node{Pub: ownerPriv.Pub(), FromAddr: addr, ToAddr: addr}
+	s.addNode(owner)
+
+	// a record claiming the address of a known node does not take it over
+	r := newTestRecord(addr, time.Now().Add(time.Minute))
+	s.acceptPeers(from, []*overlaymessages.NodeRecord{r})
+	n, ok := s.nodeByID(r.ID.Sign.ID())
+	if assert.True(t, ok) {
+		assert.Nil(t, n.fromAddr())
+		assert.Equal(t, addr.String(), n.toAddr().String())
+		n.Lock()
+		assert.NotNil(t, n.findPath(addr))
+		n.Unlock()
+	}
+	got, ok := s.nodeByAddr(addr)
+	assert.True(t, ok)
+	assert.Equal(t, owner, got)
+}
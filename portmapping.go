@@ -0,0 +1,633 @@
+package overlay
+
+import (
+	"bufio"
+	"bytes"
+	crand "crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"github.com/dist-ribut-us/errors"
+	"github.com/dist-ribut-us/log"
+	"github.com/dist-ribut-us/natt/igdp"
+	"github.com/dist-ribut-us/overlay/overlaymessages"
+	"github.com/dist-ribut-us/rnet"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Port mapping parameters. The overlay port is mapped on the gateway for
+// portMapLifetime and the mapping is renewed once less than half of the
+// lifetime the gateway granted remains. The mapping is checked every portMapCheck; if no backend could map
+// the port, they are tried again after portMapRetry. A renewal that fails is
+// tried again on the next check; the other backends are only tried once the
+// mapping has expired.
+//
+// NAT-PMP and PCP requests are sent gatewayRetries times, starting with a
+// timeout of gatewayTimeout and doubling it each time.
+var (
+	portMapLifetime = time.Hour * 2
+	portMapCheck    = time.Minute
+	portMapRetry    = time.Minute * 10
+	gatewayTimeout  = time.Millisecond * 250
+	gatewayRetries  = 4
+)
+
+// Port mapping errors
+const (
+	ErrUnmapUnsupported   = errors.String("Backend cannot remove port mappings")
+	ErrGatewayTimeout     = errors.String("Gateway did not respond")
+	ErrGatewayRefused     = errors.String("Gateway refused port mapping")
+	ErrGatewayUnsupported = errors.String("Gateway does not support protocol")
+	ErrNoGateway          = errors.String("Could not find default gateway")
+)
+
+// PortMapper is a protocol for asking the gateway to forward a UDP port.
+type PortMapper interface {
+	// Name of the protocol, reported in the mapping status
+	Name() string
+	// Map asks for port to be forwarded for lifetime. The returned mapping has
+	// the external port and IP.
+	Map(port rnet.Port, lifetime time.Duration) (*overlaymessages.PortMapping, error)
+	// Unmap removes the mapping for port.
+	Unmap(port rnet.Port) error
+}
+
+// DefaultPortMappers returns PCP and NAT-PMP for the default gateway, if it can
+// be found, followed by UPnP.
+func DefaultPortMappers() []PortMapper {
+	var pms []PortMapper
+	if gw, err := defaultGateway(); !log.Error(err) {
+		pms = append(pms, NewPCPMapper(gw), NewNATPMPMapper(gw))
+	}
+	return append(pms, &upnpMapper{})
+}
+
+// defaultGateway reads the default IPv4 route from /proc/net/route.
+func defaultGateway() (net.IP, error) {
+	b, err := ioutil.ReadFile("/proc/net/route")
+	if err != nil {
+		return nil, ErrNoGateway
+	}
+	for _, line := range strings.Split(string(b), "\n")[1:] {
+		fs := strings.Fields(line)
+		if len(fs) < 3 || fs[1] != "00000000" {
+			continue
+		}
+		gw, err := hex.DecodeString(fs[2])
+		if err != nil || len(gw) != net.IPv4len {
+			continue
+		}
+		// the route table is in host byte order, which is little endian on
+		// everything this runs on
+		return net.IPv4(gw[3], gw[2], gw[1], gw[0]), nil
+	}
+	return nil, ErrNoGateway
+}
+
+type upnpMapper struct {
+	setup bool
+}
+
+func (*upnpMapper) Name() string { return "upnp" }
+
+// Map adds the mapping through UPnP IGD. igdp does not take a lifetime, so the
+// mapping is added again on each renewal.
+func (u *upnpMapper) Map(port rnet.Port, lifetime time.Duration) (*overlaymessages.PortMapping, error) {
+	if !u.setup {
+		if err := igdp.Setup(); err != nil {
+			return nil, err
+		}
+		u.setup = true
+	}
+	if _, err := igdp.AddPortMapping(port, port); err != nil {
+		return nil, err
+	}
+	ip, err := igdp.GetExternalIP()
+	if err != nil {
+		return nil, err
+	}
+	return &overlaymessages.PortMapping{
+		Internal:   uint16(port),
+		External:   uint16(port),
+		ExternalIP: net.ParseIP(ip),
+		Expires:    time.Now().Add(lifetime),
+	}, nil
+}
+
+// Unmap removes the mapping with a DeletePortMapping call. igdp does not
+// expose the control URL it found, so the gateway is discovered again.
+func (*upnpMapper) Unmap(port rnet.Port) error {
+	loc, err := upnpDiscover()
+	if err != nil {
+		return err
+	}
+	return upnpDeletePortMapping(loc, port)
+}
+
+// UPnP IGD, the services that hold port mappings
+var (
+	upnpSSDP     = &net.UDPAddr{IP: net.IPv4(239, 255, 255, 250), Port: 1900}
+	upnpServices = []string{
+		"urn:schemas-upnp-org:service:WANIPConnection:1",
+		"urn:schemas-upnp-org:service:WANPPPConnection:1",
+	}
+)
+
+const upnpSearch = "M-SEARCH * HTTP/1.1\r\n" +
+	"HOST: 239.255.255.250:1900\r\n" +
+	"ST: urn:schemas-upnp-org:device:InternetGatewayDevice:1\r\n" +
+	"MAN: \"ssdp:discover\"\r\n" +
+	"MX: 2\r\n\r\n"
+
+const upnpDeleteBody = `<?xml version="1.0"?>` +
+	`<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/">` +
+	`<s:Body><u:DeletePortMapping xmlns:u="%s">` +
+	`<NewRemoteHost></NewRemoteHost><NewExternalPort>%d</NewExternalPort><NewProtocol>UDP</NewProtocol>` +
+	`</u:DeletePortMapping></s:Body></s:Envelope>`
+
+type upnpDevice struct {
+	Services []struct {
+		ServiceType string `xml:"serviceType"`
+		ControlURL  string `xml:"controlURL"`
+	} `xml:"serviceList>service"`
+	Devices []upnpDevice `xml:"deviceList>device"`
+}
+
+// controlURL returns the control URL and type of the first service on the
+// device or its children that holds port mappings.
+func (d *upnpDevice) controlURL() (string, string) {
+	for _, sv := range d.Services {
+		for _, t := range upnpServices {
+			if sv.ServiceType == t {
+				return sv.ControlURL, t
+			}
+		}
+	}
+	for i := range d.Devices {
+		if u, t := d.Devices[i].controlURL(); u != "" {
+			return u, t
+		}
+	}
+	return "", ""
+}
+
+// upnpDiscover finds the description URL of the gateway with SSDP. Replies
+// come from the gateway's own address, so the socket is not connected.
+func upnpDiscover() (string, error) {
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	buf := make([]byte, 2048)
+	timeout := gatewayTimeout
+	for i := 0; i < gatewayRetries; i++ {
+		if _, err := conn.WriteTo([]byte(upnpSearch), upnpSSDP); err != nil {
+			return "", err
+		}
+		if err := conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+			return "", err
+		}
+		for {
+			n, _, err := conn.ReadFrom(buf)
+			if err != nil {
+				break
+			}
+			resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(buf[:n])), nil)
+			if err != nil {
+				continue
+			}
+			if loc := resp.Header.Get("Location"); loc != "" {
+				return loc, nil
+			}
+		}
+		timeout *= 2
+	}
+	return "", ErrGatewayTimeout
+}
+
+// upnpDeletePortMapping reads the gateway description at loc and asks the
+// service that holds port mappings to remove the UDP mapping for port.
+func upnpDeletePortMapping(loc string, port rnet.Port) error {
+	client := &http.Client{Timeout: gatewayTimeout << uint(gatewayRetries)}
+	resp, err := client.Get(loc)
+	if err != nil {
+		return err
+	}
+	var root struct {
+		Device upnpDevice `xml:"device"`
+	}
+	err = xml.NewDecoder(resp.Body).Decode(&root)
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+	ctrl, service := root.Device.controlURL()
+	if ctrl == "" {
+		return ErrGatewayUnsupported
+	}
+	base, err := url.Parse(loc)
+	if err != nil {
+		return err
+	}
+	ctrlURL, err := base.Parse(ctrl)
+	if err != nil {
+		return err
+	}
+
+	body := fmt.Sprintf(upnpDeleteBody, service, port)
+	req, err := http.NewRequest("POST", ctrlURL.String(), strings.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", `text/xml; charset="utf-8"`)
+	req.Header.Set("SOAPAction", `"`+service+`#DeletePortMapping"`)
+	resp, err = client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		log.Info(log.Lbl("upnp_delete_port_mapping"), resp.StatusCode)
+		return ErrGatewayRefused
+	}
+	return nil
+}
+
+// gatewayRequest sends req to the gateway and returns the first response that
+// passes check. The local IP used to reach the gateway is passed to build.
+func gatewayRequest(gw *net.UDPAddr, build func(local net.IP) []byte, check func([]byte) bool) ([]byte, error) {
+	conn, err := net.DialUDP("udp", nil, gw)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	req := build(conn.LocalAddr().(*net.UDPAddr).IP)
+	buf := make([]byte, 1100)
+	timeout := gatewayTimeout
+	for i := 0; i < gatewayRetries; i++ {
+		if _, err := conn.Write(req); err != nil {
+			return nil, err
+		}
+		if err := conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+			return nil, err
+		}
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				break
+			}
+			if check(buf[:n]) {
+				return buf[:n], nil
+			}
+		}
+		timeout *= 2
+	}
+	return nil, ErrGatewayTimeout
+}
+
+// NAT-PMP, RFC 6886
+const (
+	natpmpPort       = 5351
+	natpmpOpAddr     = 0
+	natpmpOpUDP      = 1
+	natpmpRespOffset = 128
+)
+
+type natpmpMapper struct {
+	gateway *net.UDPAddr
+}
+
+// NewNATPMPMapper returns a PortMapper that uses NAT-PMP with the gateway.
+func NewNATPMPMapper(gateway net.IP) PortMapper {
+	return &natpmpMapper{gateway: &net.UDPAddr{IP: gateway, Port: natpmpPort}}
+}
+
+func (*natpmpMapper) Name() string { return "nat-pmp" }
+
+// natpmpResponse returns a check for a response to op of length l. Errors and
+// replies from a gateway that does not speak NAT-PMP are accepted so they can
+// be reported.
+func natpmpResponse(op byte, l int) func([]byte) bool {
+	return func(b []byte) bool {
+		if len(b) < 4 || b[0] != 0 {
+			return len(b) >= 4
+		}
+		return b[1] == natpmpRespOffset+op && (len(b) >= l || binary.BigEndian.Uint16(b[2:]) != 0)
+	}
+}
+
+func natpmpResult(b []byte) error {
+	if b[0] != 0 {
+		return ErrGatewayUnsupported
+	}
+	if code := binary.BigEndian.Uint16(b[2:]); code != 0 {
+		log.Info(log.Lbl("nat_pmp_result"), code)
+		return ErrGatewayRefused
+	}
+	return nil
+}
+
+func (m *natpmpMapper) request(port rnet.Port, lifetime time.Duration) ([]byte, error) {
+	resp, err := gatewayRequest(m.gateway, func(net.IP) []byte {
+		req := make([]byte, 12)
+		req[1] = natpmpOpUDP
+		binary.BigEndian.PutUint16(req[4:], uint16(port))
+		if lifetime > 0 {
+			binary.BigEndian.PutUint16(req[6:], uint16(port))
+		}
+		binary.BigEndian.PutUint32(req[8:], uint32(lifetime/time.Second))
+		return req
+	}, natpmpResponse(natpmpOpUDP, 16))
+	if err != nil {
+		return nil, err
+	}
+	return resp, natpmpResult(resp)
+}
+
+func (m *natpmpMapper) Map(port rnet.Port, lifetime time.Duration) (*overlaymessages.PortMapping, error) {
+	resp, err := m.request(port, lifetime)
+	if err != nil {
+		return nil, err
+	}
+	pm := &overlaymessages.PortMapping{
+		Internal: uint16(port),
+		External: binary.BigEndian.Uint16(resp[10:]),
+		Expires:  time.Now().Add(time.Duration(binary.BigEndian.Uint32(resp[12:])) * time.Second),
+	}
+
+	resp, err = gatewayRequest(m.gateway, func(net.IP) []byte {
+		return []byte{0, natpmpOpAddr}
+	}, natpmpResponse(natpmpOpAddr, 12))
+	if err != nil {
+		return nil, err
+	}
+	if err = natpmpResult(resp); err != nil {
+		return nil, err
+	}
+	pm.ExternalIP = net.IPv4(resp[8], resp[9], resp[10], resp[11])
+	return pm, nil
+}
+
+func (m *natpmpMapper) Unmap(port rnet.Port) error {
+	_, err := m.request(port, 0)
+	return err
+}
+
+// PCP, RFC 6887
+const (
+	pcpVersion  = 2
+	pcpOpMap    = 1
+	pcpResponse = 0x80
+	pcpMapLen   = 60
+	pcpUDP      = 17
+)
+
+type pcpMapper struct {
+	gateway *net.UDPAddr
+	nonce   [12]byte
+}
+
+// NewPCPMapper returns a PortMapper that uses PCP with the gateway.
+func NewPCPMapper(gateway net.IP) PortMapper {
+	m := &pcpMapper{gateway: &net.UDPAddr{IP: gateway, Port: natpmpPort}}
+	crand.Read(m.nonce[:])
+	return m
+}
+
+func (*pcpMapper) Name() string { return "pcp" }
+
+func (m *pcpMapper) request(port rnet.Port, lifetime time.Duration) ([]byte, error) {
+	resp, err := gatewayRequest(m.gateway, func(local net.IP) []byte {
+		req := make([]byte, pcpMapLen)
+		req[0] = pcpVersion
+		req[1] = pcpOpMap
+		binary.BigEndian.PutUint32(req[4:], uint32(lifetime/time.Second))
+		copy(req[8:24], local.To16())
+		copy(req[24:36], m.nonce[:])
+		req[36] = pcpUDP
+		binary.BigEndian.PutUint16(req[40:], uint16(port))
+		if lifetime > 0 {
+			binary.BigEndian.PutUint16(req[42:], uint16(port))
+		}
+		copy(req[44:60], net.IPv4zero.To16())
+		return req
+	}, func(b []byte) bool {
+		if len(b) >= 4 && b[0] != pcpVersion {
+			return true
+		}
+		return len(b) >= pcpMapLen && b[1] == pcpResponse|pcpOpMap && string(b[24:36]) == string(m.nonce[:])
+	})
+	if err != nil {
+		return nil, err
+	}
+	if resp[0] != pcpVersion {
+		return nil, ErrGatewayUnsupported
+	}
+	if resp[3] != 0 {
+		log.Info(log.Lbl("pcp_result"), resp[3])
+		return nil, ErrGatewayRefused
+	}
+	return resp, nil
+}
+
+func (m *pcpMapper) Map(port rnet.Port, lifetime time.Duration) (*overlaymessages.PortMapping, error) {
+	resp, err := m.request(port, lifetime)
+	if err != nil {
+		return nil, err
+	}
+	ip := net.IP(append([]byte(nil), resp[44:60]...))
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	return &overlaymessages.PortMapping{
+		Internal:   uint16(port),
+		External:   binary.BigEndian.Uint16(resp[42:]),
+		ExternalIP: ip,
+		Expires:    time.Now().Add(time.Duration(binary.BigEndian.Uint32(resp[4:])) * time.Second),
+	}, nil
+}
+
+func (m *pcpMapper) Unmap(port rnet.Port) error {
+	_, err := m.request(port, 0)
+	return err
+}
+
+// portMapManager keeps the overlay port mapped with the first backend that
+// works. The gateway is never asked while holding the lock.
+type portMapManager struct {
+	sync.Mutex
+	port     rnet.Port
+	backends []PortMapper
+	active   PortMapper
+	mapping  *overlaymessages.PortMapping
+	granted  time.Duration // lifetime of the mapping granted by the gateway
+	err      error
+	tried    time.Time
+	busy     bool // set while the gateway is being asked
+}
+
+func newPortMapManager(port rnet.Port) *portMapManager {
+	return &portMapManager{
+		port: port,
+	}
+}
+
+// start sets the backends, in order of preference, and maps the port. It
+// returns the mapping or nil if no backend could map the port.
+func (m *portMapManager) start(backends []PortMapper) *overlaymessages.PortMapping {
+	m.Lock()
+	m.backends = backends
+	m.Unlock()
+	return m.mapPort()
+}
+
+// renew maps the port again if the mapping is half way to expiring, or if
+// there is none and portMapRetry has passed. It returns the current mapping.
+func (m *portMapManager) renew() *overlaymessages.PortMapping {
+	m.Lock()
+	pm := m.mapping
+	due := len(m.backends) > 0
+	if pm != nil {
+		due = due && time.Until(pm.Expires) <= m.granted/2
+	} else {
+		due = due && time.Since(m.tried) >= portMapRetry
+	}
+	m.Unlock()
+	if !due {
+		return pm
+	}
+	return m.mapPort()
+}
+
+// mapPort tries the active backend first, then the rest in order. While the
+// mapping of the active backend has not expired, a failed renewal keeps it and
+// only the active backend is tried again. If another backend takes over, the
+// mapping of the old one is removed. If another call is already asking the
+// gateway, the current mapping is returned.
+func (m *portMapManager) mapPort() *overlaymessages.PortMapping {
+	m.Lock()
+	if m.busy {
+		pm := m.mapping
+		m.Unlock()
+		return pm
+	}
+	m.busy, m.tried = true, time.Now()
+	backends, active, old := m.backends, m.active, m.mapping
+	held := active != nil && old != nil && time.Now().Before(old.Expires)
+	if held {
+		backends = []PortMapper{active}
+	} else if active != nil {
+		backends = []PortMapper{active}
+		for _, b := range m.backends {
+			if b != active {
+				backends = append(backends, b)
+			}
+		}
+	}
+	m.Unlock()
+
+	var pm *overlaymessages.PortMapping
+	var b PortMapper
+	var err error
+	var granted time.Duration
+	for _, b = range backends {
+		start := time.Now()
+		pm, err = b.Map(m.port, portMapLifetime)
+		if err != nil {
+			log.Info(log.Lbl("port_mapping_failed"), b.Name(), err)
+			continue
+		}
+		pm.Backend = b.Name()
+		if old == nil || active != b {
+			log.Info(log.Lbl("port_mapped"), pm.Backend, pm.Internal, pm.External, pm.ExternalIP)
+		}
+		granted = pm.Expires.Sub(start)
+		break
+	}
+
+	m.Lock()
+	m.busy = false
+	closed := m.backends == nil
+	if !closed {
+		switch {
+		case pm != nil:
+			m.active, m.mapping, m.granted, m.err = b, pm, granted, nil
+		case held:
+			// renewal failed, the mapping holds until it expires
+			m.err = err
+			pm = old
+		default:
+			m.active, m.mapping, m.err = nil, nil, err
+		}
+	}
+	m.Unlock()
+	if closed {
+		if pm != nil {
+			// closed while the gateway was being asked
+			log.Error(b.Unmap(m.port))
+		}
+		return nil
+	}
+	if active != nil && pm != nil && b != active {
+		if err := active.Unmap(m.port); err != ErrUnmapUnsupported {
+			log.Error(err)
+		}
+	}
+	return pm
+}
+
+// close removes the mapping from the gateway.
+func (m *portMapManager) close() {
+	m.Lock()
+	active := m.active
+	m.active, m.mapping, m.backends = nil, nil, nil
+	m.Unlock()
+	if active == nil {
+		return
+	}
+	if err := active.Unmap(m.port); err != ErrUnmapUnsupported {
+		log.Error(err)
+	}
+}
+
+// status returns a copy of the mapping or, if there is none, the last error.
+func (m *portMapManager) status() *overlaymessages.PortMapping {
+	m.Lock()
+	defer m.Unlock()
+	if m.mapping != nil {
+		pm := *m.mapping
+		return &pm
+	}
+	pm := &overlaymessages.PortMapping{
+		Internal: uint16(m.port),
+	}
+	if m.err != nil {
+		pm.Err = m.err.Error()
+	}
+	return pm
+}
+
+// mappedAddr returns the external side of a port mapping or nil if there is no
+// mapping.
+func mappedAddr(pm *overlaymessages.PortMapping) *rnet.Addr {
+	if pm == nil || pm.ExternalIP == nil || pm.ExternalIP.IsUnspecified() {
+		return nil
+	}
+	addr := rnet.Port(pm.External).On(pm.ExternalIP.String())
+	if log.Error(addr.Err) {
+		return nil
+	}
+	return addr
+}
+
+func (s *Server) renewPortMapping() {
+	s.setMappedAddr(mappedAddr(s.portMaps.renew()))
+}
@@ -0,0 +1,332 @@
+package overlay
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/dist-ribut-us/ipcrouter"
+	"github.com/dist-ribut-us/overlay/overlaymessages"
+	"github.com/dist-ribut-us/rnet"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeGateway answers NAT-PMP requests and, if pcp is set, PCP requests. The
+// external port is the internal port plus 1000. If maxLifetime is set, no
+// NAT-PMP mapping is granted for longer.
+type fakeGateway struct {
+	conn        *net.UDPConn
+	pcp         bool
+	ip          net.IP
+	maxLifetime uint32
+	sync.Mutex
+	mapped map[uint16]uint32
+}
+
+func newFakeGateway(t *testing.T, pcp bool) *fakeGateway {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	assert.NoError(t, err)
+	g := &fakeGateway{
+		conn:   conn,
+		pcp:    pcp,
+		ip:     net.IPv4(203, 0, 113, 7).To4(),
+		mapped: make(map[uint16]uint32),
+	}
+	go g.serve()
+	return g
+}
+
+func (g *fakeGateway) addr() *net.UDPAddr {
+	return g.conn.LocalAddr().(*net.UDPAddr)
+}
+
+func (g *fakeGateway) lifetime(port uint16) (uint32, bool) {
+	g.Lock()
+	defer g.Unlock()
+	l, ok := g.mapped[port]
+	return l, ok
+}
+
+func (g *fakeGateway) setMapping(port uint16, lifetime uint32) {
+	g.Lock()
+	if lifetime == 0 {
+		delete(g.mapped, port)
+	} else {
+		g.mapped[port] = lifetime
+	}
+	g.Unlock()
+}
+
+func (g *fakeGateway) serve() {
+	buf := make([]byte, 1100)
+	for {
+		n, addr, err := g.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		req := buf[:n]
+		var resp []byte
+		switch {
+		case req[0] == 0 && req[1] == natpmpOpAddr:
+			resp = make([]byte, 12)
+			resp[1] = natpmpRespOffset + natpmpOpAddr
+			copy(resp[8:], g.ip)
+		case req[0] == 0 && req[1] == natpmpOpUDP && n == 12:
+			port := binary.BigEndian.Uint16(req[4:])
+			lifetime := binary.BigEndian.Uint32(req[8:])
+			if g.maxLifetime > 0 && lifetime > g.maxLifetime {
+				lifetime = g.maxLifetime
+			}
+			g.setMapping(port, lifetime)
+			resp = make([]byte, 16)
+			resp[1] = natpmpRespOffset + natpmpOpUDP
+			copy(resp[8:10], req[4:6])
+			if lifetime > 0 {
+				binary.BigEndian.PutUint16(resp[10:], port+1000)
+			}
+			binary.BigEndian.PutUint32(resp[12:], lifetime)
+		case req[0] == pcpVersion && g.pcp && n == pcpMapLen:
+			port := binary.BigEndian.Uint16(req[40:])
+			lifetime := binary.BigEndian.Uint32(req[4:])
+			g.setMapping(port, lifetime)
+			resp = append([]byte(nil), req...)
+			resp[1] |= pcpResponse
+			binary.BigEndian.PutUint16(resp[42:], port+1000)
+			copy(resp[44:], g.ip.To16())
+		default:
+			// unsupported version
+			resp = []byte{0, natpmpRespOffset + req[1], 0, 1, 0, 0, 0, 0}
+		}
+		g.conn.WriteToUDP(resp, addr)
+	}
+}
+
+func TestNATPMPMapper(t *testing.T) {
+	g := newFakeGateway(t, false)
+	defer g.conn.Close()
+	m := &natpmpMapper{gateway: g.addr()}
+
+	pm, err := m.Map(rnet.Port(4000), time.Hour)
+	assert.NoError(t, err)
+	assert.Equal(t, uint16(5000), pm.External)
+	assert.Equal(t, "203.0.113.7", pm.ExternalIP.String())
+	assert.True(t, pm.Expires.After(time.Now().Add(time.Minute*59)))
+	l, ok := g.lifetime(4000)
+	assert.True(t, ok)
+	assert.Equal(t, uint32(3600), l)
+
+	assert.NoError(t, m.Unmap(rnet.Port(4000)))
+	_, ok = g.lifetime(4000)
+	assert.False(t, ok)
+}
+
+func TestPCPMapper(t *testing.T) {
+	g := newFakeGateway(t, true)
+	defer g.conn.Close()
+	m := NewPCPMapper(nil).(*pcpMapper)
+	m.gateway = g.addr()
+
+	pm, err := m.Map(rnet.Port(4000), time.Hour)
+	assert.NoError(t, err)
+	assert.Equal(t, uint16(5000), pm.External)
+	assert.Equal(t, "203.0.113.7", pm.ExternalIP.String())
+
+	assert.NoError(t, m.Unmap(rnet.Port(4000)))
+	_, ok := g.lifetime(4000)
+	assert.False(t, ok)
+
+	g2 := newFakeGateway(t, false)
+	defer g2.conn.Close()
+	m.gateway = g2.addr()
+	_, err = m.Map(rnet.Port(4000), time.Hour)
+	assert.Equal(t, ErrGatewayUnsupported, err)
+}
+
+func TestPortMapRenewGranted(t *testing.T) {
+	g := newFakeGateway(t, false)
+	defer g.conn.Close()
+	g.maxLifetime = 60
+
+	m := newPortMapManager(rnet.Port(4000))
+	pm := m.start([]PortMapper{&natpmpMapper{gateway: g.addr()}})
+	if !assert.NotNil(t, pm) {
+		return
+	}
+	assert.True(t, m.granted <= time.Minute && m.granted > time.Second*55)
+
+	// more than half of the granted minute remains
+	m.mapping.Expires = time.Now().Add(time.Second * 40)
+	g.setMapping(4000, 0)
+	m.renew()
+	_, ok := g.lifetime(4000)
+	assert.False(t, ok)
+
+	m.mapping.Expires = time.Now().Add(time.Second * 20)
+	m.renew()
+	_, ok = g.lifetime(4000)
+	assert.True(t, ok)
+
+	m.close()
+	_, ok = g.lifetime(4000)
+	assert.False(t, ok)
+}
+
+func TestUPnPDeletePortMapping(t *testing.T) {
+	var action, body string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" {
+			fmt.Fprintf(w, `<?xml version="1.0"?><root><device><deviceList><device>
+				<serviceList><service>
+				<serviceType>urn:schemas-upnp-org:service:WANIPConnection:1</serviceType>
+				<controlURL>/ctl/IPConn</controlURL>
+				</service></serviceList></device></deviceList></device></root>`)
+			return
+		}
+		assert.Equal(t, "/ctl/IPConn", r.URL.Path)
+		action = r.Header.Get("SOAPAction")
+		b, _ := ioutil.ReadAll(r.Body)
+		body = string(b)
+	}))
+	defer srv.Close()
+
+	assert.NoError(t, upnpDeletePortMapping(srv.URL+"/rootDesc.xml", rnet.Port(4000)))
+	assert.Equal(t, `"urn:schemas-upnp-org:service:WANIPConnection:1#DeletePortMapping"`, action)
+	assert.True(t, strings.Contains(body, "<NewExternalPort>4000</NewExternalPort>"))
+	assert.True(t, strings.Contains(body, "<NewProtocol>UDP</NewProtocol>"))
+}
+
+func TestPortMapping(t *testing.T) {
+	g := newFakeGateway(t, false)
+	defer g.conn.Close()
+	pcp := NewPCPMapper(nil).(*pcpMapper)
+	pcp.gateway = g.addr()
+
+	s := newTestServer(t)
+	port := uint16(s.net.Port())
+	s.SetupNetwork(pcp, &natpmpMapper{gateway: g.addr()})
+	assert.Equal(t, rnet.Port(port+1000).On("203.0.113.7").String(), s.addr.String())
+
+	// the mapping is renewed once half of the lifetime has passed
+	s.portMaps.mapping.Expires = time.Now().Add(portMapLifetime / 4)
+	g.setMapping(port, 0)
+	s.renewPortMapping()
+	_, ok := g.lifetime(port)
+	assert.True(t, ok)
+
+	router, err := ipcrouter.New(getPort.Next())
+	assert.NoError(t, err)
+	go router.Run()
+	wait := make(chan bool)
+	router.
+		Query(overlaymessages.PortMappingStatus, nil).
+		To(s.router.Port()).
+		SetService(overlaymessages.ServiceID).
+		Send(func(r ipcrouter.Response) {
+			pm, err := overlaymessages.DeserializePortMapping(r.GetBody())
+			if assert.NoError(t, err) {
+				assert.True(t, pm.Mapped())
+				assert.Equal(t, "nat-pmp", pm.Backend)
+				assert.Equal(t, port+1000, pm.External)
+				assert.Equal(t, "203.0.113.7", pm.ExternalIP.String())
+			}
+			wait <- true
+		})
+	select {
+	case <-wait:
+	case <-time.After(time.Millisecond * 100):
+		t.Error("timeout")
+	}
+
+	s.Close()
+	_, ok = g.lifetime(port)
+	assert.False(t, ok)
+}
+
+// fakeMapper is a PortMapper that fails while fail is set and counts the calls.
+type fakeMapper struct {
+	name string
+	sync.Mutex
+	fail  bool
+	maps  int
+	unmap int
+}
+
+func (f *fakeMapper) Name() string { return f.name }
+
+func (f *fakeMapper) Map(port rnet.Port, lifetime time.Duration) (*overlaymessages.PortMapping, error) {
+	f.Lock()
+	defer f.Unlock()
+	f.maps++
+	if f.fail {
+		return nil, ErrGatewayTimeout
+	}
+	return &overlaymessages.PortMapping{
+		Internal:   uint16(port),
+		External:   uint16(port),
+		ExternalIP: net.IPv4(203, 0, 113, 7),
+		Expires:    time.Now().Add(lifetime),
+	}, nil
+}
+
+func (f *fakeMapper) Unmap(port rnet.Port) error {
+	f.Lock()
+	f.unmap++
+	f.Unlock()
+	return nil
+}
+
+func (f *fakeMapper) setFail(fail bool) {
+	f.Lock()
+	f.fail = fail
+	f.Unlock()
+}
+
+func (f *fakeMapper) calls() (maps, unmap int) {
+	f.Lock()
+	defer f.Unlock()
+	return f.maps, f.unmap
+}
+
+func TestPortMapRenewFailed(t *testing.T) {
+	a, b := &fakeMapper{name: "a"}, &fakeMapper{name: "b"}
+	m := newPortMapManager(rnet.Port(4000))
+	pm := m.start([]PortMapper{a, b})
+	if !assert.NotNil(t, pm) {
+		return
+	}
+	assert.Equal(t, "a", pm.Backend)
+
+	// a failed renewal keeps the mapping and only retries the active backend
+	a.setFail(true)
+	m.mapping.Expires = time.Now().Add(time.Minute)
+	got := m.renew()
+	assert.Equal(t, pm, got)
+	assert.Equal(t, ErrGatewayTimeout, m.err)
+	got = m.renew()
+	assert.Equal(t, pm, got)
+	maps, _ := a.calls()
+	assert.Equal(t, 3, maps)
+	maps, _ = b.calls()
+	assert.Equal(t, 0, maps)
+
+	// once the mapping has expired another backend takes over and the old
+	// mapping is removed
+	m.mapping.Expires = time.Now().Add(-time.Second)
+	got = m.renew()
+	if assert.NotNil(t, got) {
+		assert.Equal(t, "b", got.Backend)
+	}
+	assert.Equal(t, PortMapper(b), m.active)
+	_, unmap := a.calls()
+	assert.Equal(t, 1, unmap)
+
+	m.close()
+	_, unmap = b.calls()
+	assert.Equal(t, 1, unmap)
+}
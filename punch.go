@@ -0,0 +1,256 @@
+package overlay
+
+import (
+	"github.com/dist-ribut-us/crypto"
+	"github.com/dist-ribut-us/ipcrouter"
+	"github.com/dist-ribut-us/log"
+	"github.com/dist-ribut-us/overlay/overlaymessages"
+	"github.com/dist-ribut-us/rnet"
+	"sync"
+	"time"
+)
+
+// Hole punching parameters. Every rendezvousRefresh a node asks up to
+// rendezvousNodes live nodes close to it to act as its rendezvous with a
+// RendezvousRegister query and only accepts PunchRequests from the nodes that
+// agreed, at most punchRequestRate per second from each.
+//
+// If a handshake has not completed after punchDelay, up to rendezvousNodes
+// live nodes close to the target are asked to act as a rendezvous with a
+// Rendezvous query. A rendezvous node that has a session with the target sends
+// it a PunchRequest with the address it sees for the requester and responds
+// with the address it sees for the target. Both nodes add the observed address
+// as a path and send handshake requests to it; the handshake retries keep
+// punching until the NAT mappings open. The contact in a PunchRequest is not
+// signed, so its exchange key is never used.
+var (
+	punchDelay        = time.Second * 2
+	rendezvousNodes   = 3
+	rendezvousRefresh = time.Minute * 5
+	punchRequestRate  = 1.0
+)
+
+// rendezvousSet holds the nodes that agreed to act as rendezvous and limits
+// the PunchRequests from each.
+type rendezvousSet struct {
+	sync.Mutex
+	nodes map[crypto.ID]*rendezvousEntry
+}
+
+type rendezvousEntry struct {
+	until  time.Time
+	bucket tokenBucket
+}
+
+func newRendezvousSet() *rendezvousSet {
+	return &rendezvousSet{
+		nodes: make(map[crypto.ID]*rendezvousEntry),
+	}
+}
+
+func (rs *rendezvousSet) add(id *crypto.ID) {
+	now := time.Now()
+	rs.Lock()
+	e, ok := rs.nodes[*id]
+	if !ok {
+		e = &rendezvousEntry{bucket: tokenBucket{tokens: punchRequestRate, filled: now}}
+		rs.nodes[*id] = e
+	}
+	e.until = now.Add(rendezvousRefresh * 2)
+	rs.Unlock()
+}
+
+func (rs *rendezvousSet) has(id *crypto.ID) bool {
+	rs.Lock()
+	defer rs.Unlock()
+	e, ok := rs.nodes[*id]
+	return ok && time.Now().Before(e.until)
+}
+
+// allow returns true if id is a rendezvous and may send another PunchRequest.
+func (rs *rendezvousSet) allow(id *crypto.ID) bool {
+	now := time.Now()
+	rs.Lock()
+	defer rs.Unlock()
+	e, ok := rs.nodes[*id]
+	if !ok || now.After(e.until) {
+		return false
+	}
+	return e.bucket.take(1, punchRequestRate, now)
+}
+
+func (rs *rendezvousSet) expire() {
+	now := time.Now()
+	rs.Lock()
+	for id, e := range rs.nodes {
+		if now.After(e.until) {
+			delete(rs.nodes, id)
+		}
+	}
+	rs.Unlock()
+}
+
+// observedContact is the contact for n with the address its packets come from.
+func observedContact(n *node) *overlaymessages.Contact {
+	return &overlaymessages.Contact{
+		Sign:  n.Pub,
+		Xchng: n.PubX,
+		Addr:  n.fromAddr(),
+	}
+}
+
+// punchTo adds addr as a path for n and sends handshake requests to it until
+// the handshake completes.
+func (s *Server) punchTo(n *node, addr *rnet.Addr) {
+	if addr == nil {
+		return
+	}
+	n.addPath(addr, addrKind(addr))
+	log.Info(log.Lbl("punching"), n.toAddr(), addr)
+	s.startHandshake(n)
+	n.Lock()
+	n.hsPunchAddr = addr
+	n.Unlock()
+	log.Error(s.sendHandshakeRequest(n))
+}
+
+// holePunch asks rendezvous nodes for the observed address of n and punches
+// to the first one returned.
+func (s *Server) holePunch(n *node) {
+	for _, r := range s.table.closest(n.id(), rendezvousNodes+1) {
+		if r == n || !r.hasSession() || !r.live() {
+			continue
+		}
+		if c, ok := s.queryRendezvous(r, n.id(), lookupTimeout); ok {
+			s.punchTo(n, c.Addr)
+			return
+		}
+	}
+	log.Info(log.Lbl("no_rendezvous"), n.toAddr())
+}
+
+// queryRendezvous asks r for the observed address of the node with id.
+func (s *Server) queryRendezvous(r *node, id *crypto.ID, timeout time.Duration) (*overlaymessages.Contact, bool) {
+	resp := make(chan *overlaymessages.Contact, 1)
+	s.router.
+		Query(overlaymessages.Rendezvous, id[:]).
+		SetService(overlaymessages.ServiceID).
+		SendToNet(r.toAddr(), func(r ipcrouter.NetResponse) {
+			cs, err := overlaymessages.DeserializeContacts(r.GetBody())
+			if log.Error(err) || len(cs) != 1 || *cs[0].Sign.ID() != *id {
+				resp <- nil
+				return
+			}
+			resp <- cs[0]
+		})
+	select {
+	case c := <-resp:
+		return c, c != nil
+	case <-time.After(timeout):
+		return nil, false
+	}
+}
+
+// handleRendezvousQuery introduces the requester to the target if this node
+// has a live session with both.
+func (s *Server) handleRendezvousQuery(q ipcrouter.NetQuery) {
+	from, err := crypto.IDFromSlice(q.GetNodeID())
+	if log.Error(err) {
+		return
+	}
+	target, err := crypto.IDFromSlice(q.GetBody())
+	if log.Error(err) {
+		return
+	}
+	a, ok := s.nodeByID(from)
+	b, bok := s.nodeByID(target)
+	if !ok || !bok || a == b || !b.hasSession() || !b.live() || b.fromAddr() == nil {
+		q.Respond([]byte{})
+		return
+	}
+	log.Info(log.Lbl("rendezvous"), a.fromAddr(), b.fromAddr())
+	s.router.
+		Query(overlaymessages.PunchRequest, overlaymessages.SerializeContacts([]*overlaymessages.Contact{observedContact(a)})).
+		SetService(overlaymessages.ServiceID).
+		SendToNet(b.toAddr(), func(ipcrouter.NetResponse) {})
+	q.Respond(overlaymessages.SerializeContacts([]*overlaymessages.Contact{observedContact(b)}))
+}
+
+// handlePunchRequestQuery punches to the node a rendezvous node has
+// introduced. Only nodes that agreed to be a rendezvous for this node may send
+// a PunchRequest. A node that is not known is added without its exchange key.
+func (s *Server) handlePunchRequestQuery(q ipcrouter.NetQuery) {
+	q.Respond([]byte{})
+	from, err := crypto.IDFromSlice(q.GetNodeID())
+	if log.Error(err) {
+		return
+	}
+	if !s.rendezvous.allow(from) {
+		log.Info(log.Lbl("punch_request_from_unasked"), from)
+		return
+	}
+	cs, err := overlaymessages.DeserializeContacts(q.GetBody())
+	if log.Error(err) || len(cs) != 1 || cs[0].Sign == nil || cs[0].Addr == nil {
+		return
+	}
+	id := cs[0].Sign.ID()
+	if *id == *s.key.Pub().ID() {
+		return
+	}
+	n, ok := s.nodeByID(id)
+	if !ok {
+		n = &node{
+			Pub:      cs[0].Sign,
+			cachedID: id,
+			FromAddr: cs[0].Addr,
+			ToAddr:   cs[0].Addr,
+		}
+		s.addNode(n)
+	}
+	if n.hasSession() && n.live() {
+		return
+	}
+	s.punchTo(n, cs[0].Addr)
+}
+
+// registerRendezvous asks the live nodes closest to this node to act as its
+// rendezvous.
+func (s *Server) registerRendezvous() {
+	s.rendezvous.expire()
+	if s.table == nil {
+		return
+	}
+	asked := 0
+	for _, r := range s.table.closest(s.table.self, s.table.len()) {
+		if asked == rendezvousNodes {
+			break
+		}
+		if !r.hasSession() || !r.live() {
+			continue
+		}
+		asked++
+		r := r
+		s.router.
+			Query(overlaymessages.RendezvousRegister, nil).
+			SetService(overlaymessages.ServiceID).
+			SendToNet(r.toAddr(), func(resp ipcrouter.NetResponse) {
+				if b := resp.GetBody(); len(b) == 1 && b[0] == 1 {
+					s.rendezvous.add(r.id())
+				}
+			})
+	}
+}
+
+// handleRendezvousRegisterQuery agrees to act as a rendezvous for a node with
+// a live session.
+func (s *Server) handleRendezvousRegisterQuery(q ipcrouter.NetQuery) {
+	from, err := crypto.IDFromSlice(q.GetNodeID())
+	if log.Error(err) {
+		return
+	}
+	if n, ok := s.nodeByID(from); ok && n.hasSession() && n.live() {
+		q.Respond([]byte{1})
+		return
+	}
+	q.Respond([]byte{0})
+}
@@ -0,0 +1,114 @@
+package overlay
+
+import (
+	"github.com/dist-ribut-us/crypto"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestHolePunch(t *testing.T) {
+	srvs := newTestChain(t, 3)
+	for _, s := range srvs {
+		defer s.Close()
+	}
+	a, r, b := srvs[0], srvs[1], srvs[2]
+
+	// give the rendezvous node a session with both
+	nr, _ := a.nodeByID(r.key.Pub().ID())
+	_, ok := a.queryFindNode(nr, r.key.Pub().ID(), lookupTimeout)
+	assert.True(t, ok)
+	nb, _ := r.nodeByID(b.key.Pub().ID())
+	_, ok = r.queryFindNode(nb, b.key.Pub().ID(), lookupTimeout)
+	assert.True(t, ok)
+
+	// b only takes PunchRequests from nodes it asked to be its rendezvous
+	b.registerRendezvous()
+	for i := 0; i < 20 && !b.rendezvous.has(r.key.Pub().ID()); i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+	assert.True(t, b.rendezvous.has(r.key.Pub().ID()))
+
+	// a only has a stale address for b
+	n := &node{
+		Pub:      b.key.Pub(),
+		PubX:     b.keyX.Pub(),
+		ToAddr:   getPort.Next().On("127.0.0.1"),
+		FromAddr: getPort.Next().On("127.0.0.1"),
+	}
+	a.addNode(n)
+
+	a.holePunch(n)
+	for i := 0; i < 50 && n.Shared == nil; i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+	assert.NotNil(t, n.Shared)
+	assert.Equal(t, b.addr.String(), n.toAddr().String())
+	_, ok = b.nodeByID(a.key.Pub().ID())
+	assert.True(t, ok)
+}
+
+func TestHolePunchStaleAddrs(t *testing.T) {
+	srvs := newTestChain(t, 3)
+	for _, s := range srvs {
+		defer s.Close()
+	}
+	a, r, b := srvs[0], srvs[1], srvs[2]
+
+	nr, _ := a.nodeByID(r.key.Pub().ID())
+	_, ok := a.queryFindNode(nr, r.key.Pub().ID(), lookupTimeout)
+	assert.True(t, ok)
+	nb, _ := r.nodeByID(b.key.Pub().ID())
+	_, ok = r.queryFindNode(nb, b.key.Pub().ID(), lookupTimeout)
+	assert.True(t, ok)
+
+	b.registerRendezvous()
+	for i := 0; i < 20 && !b.rendezvous.has(r.key.Pub().ID()); i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+	assert.True(t, b.rendezvous.has(r.key.Pub().ID()))
+
+	// both sides know each other, but only at stale addresses
+	n := &node{
+		Pub:      b.key.Pub(),
+		PubX:     b.keyX.Pub(),
+		ToAddr:   getPort.Next().On("127.0.0.1"),
+		FromAddr: getPort.Next().On("127.0.0.1"),
+	}
+	a.addNode(n)
+	stale := getPort.Next().On("127.0.0.1")
+	na := &node{
+		Pub:      a.key.Pub(),
+		PubX:     a.keyX.Pub(),
+		ToAddr:   stale,
+		FromAddr: stale,
+	}
+	b.addNode(na)
+
+	a.holePunch(n)
+	for i := 0; i < 50 && (n.sessionKey() == nil || na.sessionKey() == nil); i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+	if assert.NotNil(t, n.sessionKey()) && assert.NotNil(t, na.sessionKey()) {
+		assert.Equal(t, *n.sessionKey(), *na.sessionKey())
+	}
+	assert.Equal(t, b.addr.String(), n.toAddr().String())
+
+	// b moved its node for a to the address the request came from
+	assert.Equal(t, a.addr.String(), na.fromAddr().String())
+	found, ok := b.nodeByAddr(a.addr)
+	assert.True(t, ok)
+	assert.Equal(t, na, found)
+	_, ok = b.nodeByAddr(stale)
+	assert.False(t, ok)
+}
+
+func TestRendezvousSet(t *testing.T) {
+	rs := newRendezvousSet()
+	var asked, other crypto.ID
+	other[0] = 1
+	rs.add(&asked)
+	assert.True(t, rs.allow(&asked))
+	assert.False(t, rs.allow(&asked), "rate limited")
+	assert.False(t, rs.allow(&other), "never asked")
+}
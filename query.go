@@ -0,0 +1,72 @@
+package overlay
+
+import (
+	"github.com/dist-ribut-us/crypto"
+	"github.com/dist-ribut-us/errors"
+	"github.com/dist-ribut-us/log"
+	"github.com/dist-ribut-us/message"
+	"github.com/dist-ribut-us/overlay/overlaymessages"
+	"github.com/dist-ribut-us/rnet"
+	"time"
+)
+
+// queryTimeout is how long Overlay waits for the response to a query sent over
+// the network before notifying the origin service.
+var queryTimeout = time.Second * 10
+
+// ErrQueryTimeout is reported when no response is received for a query
+const ErrQueryTimeout = errors.String("Query timed out")
+
+// pendingQuery is a query sent over the network that is waiting for a
+// response. Only a response from the node the query was sent to is accepted.
+type pendingQuery struct {
+	origin   rnet.Port
+	node     *crypto.ID
+	deadline time.Time
+}
+
+func (s *Server) addQuery(id uint32, origin rnet.Port, n *node) {
+	s.queries.set(id, &pendingQuery{
+		origin:   origin,
+		node:     n.id(),
+		deadline: time.Now().Add(queryTimeout),
+	})
+}
+
+// responseOrigin returns the port of the service that sent the query that h is
+// a response to. The pending query is removed. If there is no pending query
+// with the ID of h from the node that sent h, ok is false.
+func (s *Server) responseOrigin(h *message.Header) (port rnet.Port, ok bool) {
+	s.queries.Lock()
+	defer s.queries.Unlock()
+	q, ok := s.queries.Map[h.Id]
+	if !ok {
+		return 0, false
+	}
+	if string(q.node[:]) != string(h.NodeID) {
+		log.Info(log.Lbl("response_from_wrong_node"), h.Id)
+		return 0, false
+	}
+	delete(s.queries.Map, h.Id)
+	return q.origin, true
+}
+
+// expireQueries removes queries that have passed their deadline and notifies
+// the origin services.
+func (s *Server) expireQueries() {
+	now := time.Now()
+	var expired []uint32
+	var origins []rnet.Port
+	s.queries.Lock()
+	for id, q := range s.queries.Map {
+		if q.deadline.Before(now) {
+			expired = append(expired, id)
+			origins = append(origins, q.origin)
+			delete(s.queries.Map, id)
+		}
+	}
+	s.queries.Unlock()
+	for i, id := range expired {
+		s.nack(origins[i], id, overlaymessages.NackQueryTimeout, ErrQueryTimeout)
+	}
+}
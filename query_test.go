@@ -0,0 +1,68 @@
+package overlay
+
+import (
+	"github.com/dist-ribut-us/crypto"
+	"github.com/dist-ribut-us/message"
+	"github.com/dist-ribut-us/overlay/overlaymessages"
+	"github.com/dist-ribut-us/rnet"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestPendingQueries(t *testing.T) {
+	s := &Server{queries: newpendingQueries()}
+
+	_, priv := crypto.GenerateSignPair()
+	n := &node{Pub: priv.Pub()}
+	_, other := crypto.GenerateSignPair()
+
+	s.addQuery(10, rnet.Port(1234), n)
+
+	// a response with the same ID from a different node is not accepted
+	h := &message.Header{Id: 10, NodeID: other.Pub().ID()[:]}
+	_, ok := s.responseOrigin(h)
+	assert.False(t, ok)
+
+	h.NodeID = n.id()[:]
+	port, ok := s.responseOrigin(h)
+	assert.True(t, ok)
+	assert.Equal(t, rnet.Port(1234), port)
+
+	// the query is removed once the response arrives
+	_, ok = s.responseOrigin(h)
+	assert.False(t, ok)
+
+}
+
+func TestExpireQueries(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+
+	origin := newNackCatcher(t)
+	defer origin.router.Close()
+
+	_, priv := crypto.GenerateSignPair()
+	n := &node{Pub: priv.Pub()}
+	s.addQuery(10, origin.router.Port(), n)
+	s.addQuery(11, origin.router.Port(), n)
+	q, _ := s.queries.get(10)
+	q.deadline = time.Now().Add(-time.Second)
+
+	s.expireQueries()
+	_, ok := s.queries.get(10)
+	assert.False(t, ok)
+	_, ok = s.queries.get(11)
+	assert.True(t, ok)
+
+	if nack := origin.next(t); assert.NotNil(t, nack) {
+		assert.Equal(t, uint32(10), nack.ID)
+		assert.Equal(t, overlaymessages.NackQueryTimeout, nack.Reason)
+		assert.Equal(t, ErrQueryTimeout.Error(), nack.Detail)
+	}
+	select {
+	case nack := <-origin.nacks:
+		t.Errorf("unexpected nack for query %d", nack.ID)
+	case <-time.After(time.Millisecond * 50):
+	}
+}
@@ -0,0 +1,118 @@
+package overlay
+
+import (
+	"github.com/dist-ribut-us/crypto"
+	"github.com/dist-ribut-us/ipcrouter"
+	"github.com/dist-ribut-us/log"
+	"github.com/dist-ribut-us/message"
+	"github.com/dist-ribut-us/overlay/overlaymessages"
+	"github.com/dist-ribut-us/rnet"
+	"sync"
+	"time"
+)
+
+// Reaper parameters. A node is removed reapGrace after its session expires. A
+// node that never completed a handshake is removed unusedNodeTTL after it was
+// added.
+var (
+	reapInterval  = time.Minute
+	reapGrace     = time.Minute
+	unusedNodeTTL = time.Minute * 10
+)
+
+func (n *node) expired(now time.Time) bool {
+	if n.liveTil.IsZero() {
+		return n.added.Add(unusedNodeTTL).Before(now)
+	}
+	return n.liveTil.Add(reapGrace).Before(now)
+}
+
+// clearSession drops the session keys and zeros them once no sender can still
+// be using them.
+func (n *node) clearSession() {
+	n.Lock()
+	keys := []*crypto.Symmetric{n.Shared, n.prevShared, n.nextShared}
+	n.Shared, n.prevShared, n.nextShared, n.rekeyPair = nil, nil, nil, nil
+	n.Unlock()
+	for _, k := range keys {
+		retireKey(k)
+	}
+}
+
+type nodeHooks struct {
+	sync.RWMutex
+	fns []func(*crypto.ID)
+}
+
+// OnNodeRemoved registers fn to be called with the ID of any node that is
+// removed from the node table.
+func (s *Server) OnNodeRemoved(fn func(id *crypto.ID)) {
+	s.removedHooks.Lock()
+	s.removedHooks.fns = append(s.removedHooks.fns, fn)
+	s.removedHooks.Unlock()
+}
+
+// reap removes expired nodes from memory and releases their session keys. The
+// stored copy of a node is kept, see storedNodes. Beacons are kept but their
+// sessions are cleared so a new handshake will be done on the next send.
+func (s *Server) reap() {
+	now := time.Now()
+	for _, n := range s.all() {
+		if !n.expired(now) || n.handshaking() {
+			continue
+		}
+		n.clearSession()
+		if s.isBeacon(n) {
+			continue
+		}
+		s.removeNode(n)
+		s.table.remove(n.id())
+		s.removeCircuitsThrough(n)
+		s.nodeRemoved(n.id())
+	}
+}
+
+func (s *Server) removeCircuitsThrough(n *node) {
+	s.circuits.Lock()
+	for id, c := range s.circuits.Map {
+		for _, hop := range c.hops {
+			if hop == n {
+				delete(s.circuits.Map, id)
+				break
+			}
+		}
+	}
+	s.circuits.Unlock()
+}
+
+// nodeRemoved calls the registered hooks and notifies subscribed services.
+func (s *Server) nodeRemoved(id *crypto.ID) {
+	log.Info(log.Lbl("node_removed"), id)
+	s.removedHooks.RLock()
+	for _, fn := range s.removedHooks.fns {
+		fn(id)
+	}
+	s.removedHooks.RUnlock()
+
+	s.notifySubscribers(overlaymessages.NodeRemoved, id[:])
+}
+
+// notifySubscribers sends a message to every service that has sent a
+// SubscribeNodeEvents command.
+func (s *Server) notifySubscribers(t message.Type, body []byte) {
+	s.nodeSubscribers.RLock()
+	ports := make([]rnet.Port, 0, len(s.nodeSubscribers.Map))
+	for _, port := range s.nodeSubscribers.Map {
+		ports = append(ports, port)
+	}
+	s.nodeSubscribers.RUnlock()
+	for _, port := range ports {
+		s.router.Send(port, message.NewHeader(t, body))
+	}
+}
+
+// handleSubscribeNodeEvents registers the sending service to receive
+// NodeRemoved and JoinStatusUpdate messages.
+func (s *Server) handleSubscribeNodeEvents(c ipcrouter.Command) {
+	s.nodeSubscribers.set(uint32(c.Port()), c.Port())
+}
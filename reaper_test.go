@@ -0,0 +1,69 @@
+package overlay
+
+import (
+	"github.com/dist-ribut-us/crypto"
+	"github.com/dist-ribut-us/rnet"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestReap(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+
+	newNode := func(port int, liveTil time.Time) *node {
+		_, priv := crypto.GenerateSignPair()
+		addr := rnet.Port(port).On("127.0.0.1")
+		n := &node{
+			Pub:      priv.Pub(),
+			Shared:   crypto.RandomSymmetric(),
+			FromAddr: addr,
+			ToAddr:   addr,
+			liveTil:  liveTil,
+		}
+		s.addNode(n)
+		s.table.seen(n)
+		return n
+	}
+
+	past := time.Now().Add(-reapGrace - time.Second)
+	expired := newNode(7001, past)
+	live := newNode(7002, time.Now().Add(time.Minute))
+
+	_, priv := crypto.GenerateSignPair()
+	s.addBeacon(priv.Pub(), s.net.Port().On("127.0.0.1"))
+	beacon, _ := s.nodeByID(priv.Pub().ID())
+	beacon.Shared = crypto.RandomSymmetric()
+	beacon.liveTil = past
+
+	var removed []*crypto.ID
+	s.OnNodeRemoved(func(id *crypto.ID) {
+		removed = append(removed, id)
+	})
+
+	defer func(d time.Duration) { keyWipeDelay = d }(keyWipeDelay)
+	keyWipeDelay = time.Millisecond
+	expiredKey := expired.Shared
+	s.reap()
+
+	_, ok := s.nodeByID(expired.id())
+	assert.False(t, ok)
+	assert.Nil(t, expired.Shared)
+	time.Sleep(time.Millisecond * 20)
+	assert.Equal(t, crypto.Symmetric{}, *expiredKey)
+	if assert.Len(t, removed, 1) {
+		assert.Equal(t, *expired.id(), *removed[0])
+	}
+	for _, n := range s.table.closest(expired.id(), s.table.len()) {
+		assert.NotEqual(t, *expired.id(), *n.id())
+	}
+
+	_, ok = s.nodeByID(live.id())
+	assert.True(t, ok)
+	assert.NotNil(t, live.Shared)
+
+	_, ok = s.nodeByID(beacon.id())
+	assert.True(t, ok)
+	assert.Nil(t, beacon.Shared)
+}
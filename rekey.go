@@ -0,0 +1,220 @@
+package overlay
+
+import (
+	"bytes"
+	"github.com/dist-ribut-us/crypto"
+	"github.com/dist-ribut-us/errors"
+	"github.com/dist-ribut-us/ipcrouter"
+	"github.com/dist-ribut-us/log"
+	"github.com/dist-ribut-us/overlay/overlaymessages"
+	"time"
+)
+
+// Rekey parameters. A session is rekeyed when its key is rekeyInterval old or
+// has sealed rekeyBytes or rekeyPackets. A Rekey query is sent through the
+// session carrying a fresh ephemeral exchange key and the response carries
+// the peer's; the new key is derived from the two.
+//
+// The initiator switches to the new key when the response arrives. The
+// responder keeps sending with the old key until the first packet sealed with
+// the new key arrives, so neither side receives a packet it cannot open. The
+// old key is kept for rekeyGrace to open packets that were in flight and is
+// then dropped. If both sides start a rekey at once the one with the lower ID
+// goes ahead: the other drops its own rekey and answers, and the Rekey query
+// of the higher ID is left unanswered. Keys are never changed in place; a replaced key is zeroed by
+// retireKey once no sender can still hold it.
+var (
+	rekeyInterval = time.Minute * 10
+	rekeyBytes    = uint64(1 << 30)
+	rekeyPackets  = uint64(1 << 20)
+	rekeyGrace    = time.Second * 30
+	rekeyRetry    = time.Second * 30
+)
+
+// ErrNoSession is returned when a packet arrives from a node without a session
+const ErrNoSession = errors.String("No session with node")
+
+// keyWipeDelay is how long a replaced key is kept before it is zeroed. Senders
+// take the key under the lock and seal with it after releasing the lock, so a
+// key may still be in use for a moment after it has been replaced.
+var keyWipeDelay = time.Second * 5
+
+func wipeKey(k *crypto.Symmetric) {
+	if k != nil {
+		*k = crypto.Symmetric{}
+	}
+}
+
+// retireKey zeros k after keyWipeDelay. k must already be unreachable from the
+// node so no new sender can pick it up.
+func retireKey(k *crypto.Symmetric) {
+	if k != nil {
+		time.AfterFunc(keyWipeDelay, func() { wipeKey(k) })
+	}
+}
+
+// sessionKey returns the current session key or nil if there is no session.
+func (n *node) sessionKey() *crypto.Symmetric {
+	n.Lock()
+	defer n.Unlock()
+	return n.Shared
+}
+
+// hasSession returns true if n has a session key.
+func (n *node) hasSession() bool {
+	return n.sessionKey() != nil
+}
+
+// setSession installs a key from a handshake and drops any rekey state.
+func (n *node) setSession(key *crypto.Symmetric) {
+	n.Lock()
+	if n.Shared != key {
+		retireKey(n.Shared)
+	}
+	retireKey(n.prevShared)
+	retireKey(n.nextShared)
+	n.Shared = key
+	n.prevShared, n.nextShared, n.rekeyPair = nil, nil, nil
+	n.keyAt = time.Now()
+	n.sentBytes, n.sentPackets = 0, 0
+	n.sendCtr, n.recvWindow = 0, replayWindow{}
+	n.Unlock()
+}
+
+// rotateKey makes key the current key, keeping the current key for
+// rekeyGrace. It must be called with the lock held.
+func (n *node) rotateKey(key *crypto.Symmetric) {
+	retireKey(n.prevShared)
+	n.prevShared, n.prevUntil = n.Shared, time.Now().Add(rekeyGrace)
+	n.Shared = key
+	n.keyAt = time.Now()
+	n.sentBytes, n.sentPackets = 0, 0
+}
+
+// countSent records packets sealed with the current key and returns true if a
+// rekey should be started.
+func (n *node) countSent(packets [][]byte) bool {
+	n.Lock()
+	defer n.Unlock()
+	n.sentPackets += uint64(len(packets))
+	for _, p := range packets {
+		n.sentBytes += uint64(len(p))
+	}
+	return n.startRekey()
+}
+
+// startRekey returns true if the key is due to be replaced and no rekey is
+// already in progress. It must be called with the lock held.
+func (n *node) startRekey() bool {
+	now := time.Now()
+	due := now.Sub(n.keyAt) > rekeyInterval || n.sentBytes > rekeyBytes || n.sentPackets > rekeyPackets
+	if !due || !n.features.has(featRekey) || now.Sub(n.rekeyAt) < rekeyRetry {
+		return false
+	}
+	n.rekeyAt = now
+	return true
+}
+
+// open decrypts a packet with the current key, the next key set up by a
+// Rekey query or, during the grace period, the previous key. The first packet
+// opened with the next key makes it the current key.
+func (n *node) open(c []byte) ([]byte, error) {
+	n.Lock()
+	defer n.Unlock()
+	if n.Shared == nil {
+		return nil, ErrNoSession
+	}
+	p, err := n.Shared.Open(c)
+	if err == nil {
+		return p, nil
+	}
+	if n.nextShared != nil {
+		if p, nerr := n.nextShared.Open(c); nerr == nil {
+			n.rotateKey(n.nextShared)
+			n.nextShared = nil
+			return p, nil
+		}
+	}
+	if n.prevShared != nil && time.Now().Before(n.prevUntil) {
+		if p, perr := n.prevShared.Open(c); perr == nil {
+			return p, nil
+		}
+	}
+	return nil, err
+}
+
+// rekeying returns true if a Rekey query to n is waiting for a response. A
+// query that has not been answered within rekeyRetry is given up on.
+func (n *node) rekeying() bool {
+	n.Lock()
+	defer n.Unlock()
+	return n.rekeyPair != nil && time.Since(n.rekeyAt) < rekeyRetry
+}
+
+// rekey sends a Rekey query to n and switches to the new key when the
+// response arrives.
+func (s *Server) rekey(n *node) {
+	eph := crypto.GenerateXchgPair()
+	n.Lock()
+	n.rekeyPair, n.rekeyAt = eph, time.Now()
+	n.Unlock()
+	log.Info(log.Lbl("rekeying_session"), n.toAddr())
+	s.router.
+		Query(overlaymessages.Rekey, eph.Pub().Slice()).
+		SetService(overlaymessages.ServiceID).
+		SendToNet(n.toAddr(), func(r ipcrouter.NetResponse) {
+			b := r.GetBody()
+			if len(b) != crypto.KeyLength {
+				log.Info(log.Lbl("bad_rekey_response"), n.toAddr())
+				return
+			}
+			n.Lock()
+			if n.rekeyPair == eph {
+				n.rotateKey(eph.Shared(crypto.XchgPubFromSlice(b)))
+				n.rekeyPair = nil
+			}
+			n.Unlock()
+		})
+}
+
+func (s *Server) handleRekeyQuery(q ipcrouter.NetQuery) {
+	nodeID, err := crypto.IDFromSlice(q.GetNodeID())
+	if log.Error(err) {
+		return
+	}
+	n, ok := s.nodeByID(nodeID)
+	b := q.GetBody()
+	if !ok || len(b) != crypto.KeyLength {
+		return
+	}
+	if n.rekeying() && bytes.Compare(s.key.Pub().ID()[:], nodeID[:]) < 0 {
+		log.Info(log.Lbl("rekey_collision_ignored"), nodeID)
+		return
+	}
+	eph := crypto.GenerateXchgPair()
+	n.Lock()
+	// if both sides are rekeying the peer has the lower ID, so its rekey wins
+	n.rekeyPair = nil
+	retireKey(n.nextShared)
+	n.nextShared = eph.Shared(crypto.XchgPubFromSlice(b))
+	n.Unlock()
+	q.Respond(eph.Pub().Slice())
+}
+
+// rekeySessions starts a rekey for live sessions whose key is too old and zeros
+// previous keys once the grace period is over.
+func (s *Server) rekeySessions() {
+	now := time.Now()
+	for _, n := range s.all() {
+		n.Lock()
+		if n.prevShared != nil && now.After(n.prevUntil) {
+			retireKey(n.prevShared)
+			n.prevShared = nil
+		}
+		start := n.Shared != nil && n.live() && n.startRekey()
+		n.Unlock()
+		if start {
+			go s.rekey(n)
+		}
+	}
+}
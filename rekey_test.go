@@ -0,0 +1,130 @@
+package overlay
+
+import (
+	"bytes"
+	"github.com/dist-ribut-us/crypto"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func seal(key *crypto.Symmetric, msg string) []byte {
+	return key.SealPackets([]byte{encSymmetric}, [][]byte{[]byte(msg)}, nil, 0)[0][1:]
+}
+
+func TestRekeyKeys(t *testing.T) {
+	k0 := crypto.RandomSymmetric()
+	k0b := *k0
+	a, b := &node{}, &node{}
+	a.setSession(k0)
+	b.setSession(&k0b)
+
+	ea, eb := crypto.GenerateXchgPair(), crypto.GenerateXchgPair()
+	b.Lock()
+	b.nextShared = eb.Shared(ea.Pub())
+	b.Unlock()
+	// in flight from b with the old key
+	old := seal(b.Shared, "old")
+	a.Lock()
+	a.rotateKey(ea.Shared(eb.Pub()))
+	a.Unlock()
+
+	p, err := b.open(seal(a.Shared, "new"))
+	assert.NoError(t, err)
+	assert.Equal(t, "new", string(p))
+	assert.Nil(t, b.nextShared)
+	assert.NotNil(t, b.prevShared)
+
+	p, err = a.open(old)
+	assert.NoError(t, err)
+	assert.Equal(t, "old", string(p))
+
+	p, err = a.open(seal(b.Shared, "reply"))
+	assert.NoError(t, err)
+	assert.Equal(t, "reply", string(p))
+
+	a.prevUntil = time.Now().Add(-time.Second)
+	_, err = a.open(old)
+	assert.Error(t, err)
+}
+
+func TestRekeyTrigger(t *testing.T) {
+	defer func(p uint64) { rekeyPackets = p }(rekeyPackets)
+	rekeyPackets = 2
+
+	n := &node{features: featRekey}
+	n.setSession(crypto.RandomSymmetric())
+	pkts := [][]byte{{1}, {2}}
+	assert.False(t, n.countSent(pkts))
+	assert.True(t, n.countSent(pkts))
+	assert.False(t, n.countSent(pkts))
+
+	n.features = 0
+	n.setSession(crypto.RandomSymmetric())
+	n.rekeyAt = time.Time{}
+	n.countSent(pkts)
+	assert.False(t, n.countSent(pkts))
+}
+
+func TestRekey(t *testing.T) {
+	srvs := newTestChain(t, 2)
+	for _, s := range srvs {
+		defer s.Close()
+	}
+	n, _ := srvs[0].nodeByID(srvs[1].key.Pub().ID())
+	_, ok := srvs[0].queryFindNode(n, srvs[1].key.Pub().ID(), lookupTimeout)
+	assert.True(t, ok)
+
+	before := n.Shared
+	srvs[0].rekey(n)
+	for i := 0; i < 20 && n.Shared == before; i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+	assert.True(t, n.Shared != before)
+
+	for i := 0; i < 2; i++ {
+		_, ok = srvs[0].queryFindNode(n, srvs[1].key.Pub().ID(), lookupTimeout)
+		assert.True(t, ok)
+	}
+}
+
+func TestSimultaneousRekey(t *testing.T) {
+	srvs := newTestChain(t, 2)
+	for _, s := range srvs {
+		defer s.Close()
+	}
+	a, _ := srvs[0].nodeByID(srvs[1].key.Pub().ID())
+	_, ok := srvs[0].queryFindNode(a, srvs[1].key.Pub().ID(), lookupTimeout)
+	assert.True(t, ok)
+	b, ok := srvs[1].nodeByID(srvs[0].key.Pub().ID())
+	if !assert.True(t, ok) {
+		return
+	}
+
+	// both sides have a Rekey query out when the other one arrives
+	for _, n := range []*node{a, b} {
+		n.Lock()
+		n.rekeyPair, n.rekeyAt = crypto.GenerateXchgPair(), time.Now()
+		n.Unlock()
+	}
+	beforeA, beforeB := a.sessionKey(), b.sessionKey()
+	go srvs[0].rekey(a)
+	go srvs[1].rekey(b)
+
+	// only the side with the lower ID switches key
+	winner, before := a, beforeA
+	if bytes.Compare(srvs[1].key.Pub().ID()[:], srvs[0].key.Pub().ID()[:]) < 0 {
+		winner, before = b, beforeB
+	}
+	for i := 0; i < 20 && winner.sessionKey() == before; i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+	assert.True(t, winner.sessionKey() != before)
+	assert.False(t, a.rekeying() && b.rekeying())
+
+	_, ok = srvs[0].queryFindNode(a, srvs[1].key.Pub().ID(), lookupTimeout)
+	assert.True(t, ok)
+	_, ok = srvs[1].queryFindNode(b, srvs[0].key.Pub().ID(), lookupTimeout)
+	assert.True(t, ok)
+	assert.Equal(t, *a.sessionKey(), *b.sessionKey())
+}
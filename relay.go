@@ -0,0 +1,376 @@
+package overlay
+
+import (
+	"github.com/dist-ribut-us/crypto"
+	"github.com/dist-ribut-us/log"
+	"github.com/dist-ribut-us/message"
+	"github.com/dist-ribut-us/overlay/overlaymessages"
+	"github.com/dist-ribut-us/rnet"
+	"sync"
+	"time"
+)
+
+// Relay parameters. If a handshake has not completed after relayDelay, the
+// nodes closest to the target that advertise RoleRelay and support featRelay
+// are asked for a Rendezvous. The first one with a live session to the target
+// is added as a relayed path and every packet to the node is wrapped in a
+// relayForward packet and sent to the relay until a better path works. The
+// relay passes the packet on in a relayDeliver packet with the ID and address
+// of the sender. Only handshake and session packets are relayed, so the relay
+// never sees a key it could use to open them.
+//
+// A relay forwards at most relayRate bytes per second from one node and
+// relayTotalRate bytes per second in total. The target of a relayed handshake
+// accepts at most relayHandshakeRate handshakes per second from one relay
+// instead of asking for a cookie.
+var (
+	relayDelay         = punchDelay * 2
+	relayRate          = float64(64 << 10)
+	relayTotalRate     = float64(1 << 20)
+	relayHandshakeRate = 5.0
+	relayIdle          = time.Minute
+)
+
+const relayIDLen = len(crypto.ID{})
+
+var relayable = map[byte]bool{
+	handshakeRequest:        true,
+	handshakeResponse:       true,
+	hiddenHandshakeRequest:  true,
+	hiddenHandshakeResponse: true,
+	encSymmetric:            true,
+}
+
+// EnableRelay makes the server forward packets for other nodes and advertise
+// RoleRelay in its node record.
+func (s *Server) EnableRelay() {
+	s.selfRecordLock.Lock()
+	s.roles |= overlaymessages.RoleRelay
+	s.selfRec = nil
+	s.selfRecordLock.Unlock()
+}
+
+// getRoles returns the roles advertised in the node record.
+func (s *Server) getRoles() overlaymessages.Role {
+	s.selfRecordLock.Lock()
+	defer s.selfRecordLock.Unlock()
+	return s.roles
+}
+
+type tokenBucket struct {
+	tokens float64
+	filled time.Time
+}
+
+// take removes size tokens if they are available. The bucket fills at rate
+// tokens per second and holds at most one second worth.
+func (b *tokenBucket) take(size, rate float64, now time.Time) bool {
+	b.tokens += now.Sub(b.filled).Seconds() * rate
+	if b.tokens > rate {
+		b.tokens = rate
+	}
+	b.filled = now
+	if b.tokens < size {
+		return false
+	}
+	b.tokens -= size
+	return true
+}
+
+type relayLimiter struct {
+	sync.Mutex
+	total      tokenBucket
+	bySource   map[crypto.ID]*tokenBucket
+	handshakes map[crypto.ID]*tokenBucket
+}
+
+func newRelayLimiter() *relayLimiter {
+	now := time.Now()
+	return &relayLimiter{
+		total:      tokenBucket{tokens: relayTotalRate, filled: now},
+		bySource:   make(map[crypto.ID]*tokenBucket),
+		handshakes: make(map[crypto.ID]*tokenBucket),
+	}
+}
+
+// allow returns true if size bytes from the node may be forwarded.
+func (l *relayLimiter) allow(id *crypto.ID, size int) bool {
+	now := time.Now()
+	l.Lock()
+	defer l.Unlock()
+	b, ok := l.bySource[*id]
+	if !ok {
+		b = &tokenBucket{tokens: relayRate, filled: now}
+		l.bySource[*id] = b
+	}
+	if !b.take(float64(size), relayRate, now) {
+		return false
+	}
+	return l.total.take(float64(size), relayTotalRate, now)
+}
+
+// allowHandshake returns true if a handshake passed on by the relay may be
+// answered.
+func (l *relayLimiter) allowHandshake(id *crypto.ID) bool {
+	now := time.Now()
+	l.Lock()
+	defer l.Unlock()
+	b, ok := l.handshakes[*id]
+	if !ok {
+		b = &tokenBucket{tokens: relayHandshakeRate, filled: now}
+		l.handshakes[*id] = b
+	}
+	return b.take(1, relayHandshakeRate, now)
+}
+
+// expire forgets nodes that have not sent anything for relayIdle.
+func (l *relayLimiter) expire() {
+	cutoff := time.Now().Add(-relayIdle)
+	l.Lock()
+	for _, m := range []map[crypto.ID]*tokenBucket{l.bySource, l.handshakes} {
+		for id, b := range m {
+			if b.filled.Before(cutoff) {
+				delete(m, id)
+			}
+		}
+	}
+	l.Unlock()
+}
+
+// isRelay returns true if n advertises RoleRelay and supports featRelay.
+func (n *node) isRelay() bool {
+	if !n.features.has(featRelay) {
+		return false
+	}
+	rec := n.getRecord()
+	return rec != nil && rec.Roles.Has(overlaymessages.RoleRelay)
+}
+
+func (n *node) getRelay() *node {
+	n.Lock()
+	defer n.Unlock()
+	return n.relay
+}
+
+// addRelayPath records r as a relayed path to n.
+func (n *node) addRelayPath(r *node) {
+	addr := r.toAddr()
+	n.Lock()
+	if n.relayPath(r) == nil {
+		n.addPathLocked(addr, pathRelay)
+		if p := n.findPath(addr); p != nil && p.kind == pathRelay {
+			p.relay = r
+		}
+	}
+	n.Unlock()
+}
+
+// relayPath returns the path through r. It must be called with the lock held.
+func (n *node) relayPath(r *node) *path {
+	for _, p := range n.paths {
+		if p.relay == r {
+			return p
+		}
+	}
+	return nil
+}
+
+// relayed returns true if r was selected as a relay for n.
+func (n *node) relayed(r *node) bool {
+	n.Lock()
+	defer n.Unlock()
+	return n.relayPath(r) != nil
+}
+
+// relaySeen records an authenticated packet from n passed on by r.
+func (n *node) relaySeen(r *node) {
+	n.Lock()
+	if p := n.relayPath(r); p != nil {
+		p.lastOK, p.failures = time.Now(), 0
+	}
+	n.Unlock()
+}
+
+// tryRelay adds a relayed path through r and sends through it until
+// selectPath finds a working path.
+func (n *node) tryRelay(r *node) {
+	n.addRelayPath(r)
+	n.Lock()
+	n.relay = r
+	n.Unlock()
+}
+
+// relayFor returns the relay to reach n through. A relay that is no longer
+// live is dropped along with its path.
+func (n *node) relayFor() *node {
+	r := n.getRelay()
+	if r != nil && (!r.hasSession() || !r.live()) {
+		log.Info(log.Lbl("relay_lost"), r.toAddr())
+		n.Lock()
+		if n.relay == r {
+			n.relay = nil
+		}
+		if p := n.relayPath(r); p != nil {
+			p.failures = pathMaxFailures
+		}
+		n.Unlock()
+		return nil
+	}
+	return r
+}
+
+// sendTo sends a packet to n, through its relay if it has one.
+func (s *Server) sendTo(n *node, pkt []byte) error {
+	if r := n.relayFor(); r != nil {
+		return s.net.Send(forwardPacket(n.id(), pkt), r.toAddr())
+	}
+	return s.net.Send(pkt, n.toAddr())
+}
+
+// sendAllTo sends packets to n, through its relay if it has one.
+func (s *Server) sendAllTo(n *node, pkts [][]byte) []error {
+	r := n.relayFor()
+	if r == nil {
+		return s.net.SendAll(pkts, n.toAddr())
+	}
+	id := n.id()
+	wrapped := make([][]byte, len(pkts))
+	for i, pkt := range pkts {
+		wrapped[i] = forwardPacket(id, pkt)
+	}
+	return s.net.SendAll(wrapped, r.toAddr())
+}
+
+// forwardPacket wraps pkt for a relay: type | target ID | packet
+func forwardPacket(to *crypto.ID, pkt []byte) []byte {
+	b := make([]byte, 1, 1+relayIDLen+len(pkt))
+	b[0] = relayForward
+	b = append(b, to[:]...)
+	return append(b, pkt...)
+}
+
+// deliverPacket wraps pkt for the target of a relay:
+// type | sender ID | address length | sender address | packet
+func deliverPacket(from *crypto.ID, addr *rnet.Addr, pkt []byte) []byte {
+	a := message.FromAddr(addr).Marshal()
+	if len(a) > 255 {
+		return nil
+	}
+	b := make([]byte, 1, 2+relayIDLen+len(a)+len(pkt))
+	b[0] = relayDeliver
+	b = append(b, from[:]...)
+	b = append(b, byte(len(a)))
+	b = append(b, a...)
+	return append(b, pkt...)
+}
+
+// handleRelayForward passes a packet from one node with a live session to
+// another.
+func (s *Server) handleRelayForward(pkt []byte, addr *rnet.Addr) {
+	if !s.getRoles().Has(overlaymessages.RoleRelay) || len(pkt) < 2+relayIDLen || !relayable[pkt[1+relayIDLen]] {
+		return
+	}
+	from, ok := s.nodeByAddr(addr)
+	if !ok || !from.hasSession() || !from.live() {
+		log.Info(log.Lbl("relay_from_unknown"), addr)
+		return
+	}
+	id, err := crypto.IDFromSlice(pkt[1 : 1+relayIDLen])
+	if log.Error(err) {
+		return
+	}
+	to, ok := s.nodeByID(id)
+	if !ok || to == from || !to.hasSession() || !to.live() || !to.features.has(featRelay) {
+		log.Info(log.Lbl("relay_to_unknown"), addr, id)
+		return
+	}
+	inner := pkt[1+relayIDLen:]
+	if !s.relayLimit.allow(from.id(), len(inner)) {
+		log.Info(log.Lbl("relay_rate_limited"), addr)
+		return
+	}
+	if out := deliverPacket(from.id(), addr, inner); out != nil {
+		log.Error(s.net.Send(out, to.toAddr()))
+	}
+}
+
+// handleRelayDeliver handles a packet passed on by a relay. Session packets
+// and handshake responses are only accepted from a relay that was selected for
+// the sender.
+func (s *Server) handleRelayDeliver(pkt []byte, addr *rnet.Addr) {
+	r, ok := s.nodeByAddr(addr)
+	if !ok || !r.hasSession() || !r.live() || len(pkt) < 2+relayIDLen {
+		log.Info(log.Lbl("relay_deliver_from_unknown"), addr)
+		return
+	}
+	al := int(pkt[1+relayIDLen])
+	if len(pkt) < 3+relayIDLen+al {
+		log.Info(log.Lbl("short_relay_packet"), addr)
+		return
+	}
+	from := message.UnmarshalAddrpb(pkt[2+relayIDLen : 2+relayIDLen+al]).GetAddr()
+	inner := pkt[2+relayIDLen+al:]
+	if from == nil || from.Err != nil || !relayable[inner[0]] {
+		return
+	}
+
+	switch inner[0] {
+	case encSymmetric:
+		s.openMessage(inner, addr, r)
+	case handshakeRequest, hiddenHandshakeRequest:
+		s.acceptRelayedHandshake(inner, from, r)
+	case handshakeResponse:
+		s.completeHandshake(inner, from, r)
+	case hiddenHandshakeResponse:
+		s.completeHiddenHandshake(inner, from, r)
+	}
+}
+
+// acceptRelayedHandshake answers a handshake request passed on by r. Only
+// relays that advertise RoleRelay are accepted and the per relay rate limit
+// takes the place of the cookie check. The address is chosen by the relay, so
+// the response is sent back through r to the ID that signed the request.
+func (s *Server) acceptRelayedHandshake(pkt []byte, from *rnet.Addr, r *node) {
+	if !r.isRelay() {
+		log.Info(log.Lbl("relayed_handshake_from_non_relay"), r.toAddr())
+		return
+	}
+	if !s.relayLimit.allowHandshake(r.id()) {
+		log.Info(log.Lbl("relayed_handshake_rate_limited"), r.toAddr())
+		return
+	}
+	var resp []byte
+	var id *crypto.ID
+	if pkt[0] == handshakeRequest {
+		resp, id = s.acceptHandshake(pkt, from, nil, r)
+	} else if s.validMAC1(pkt, from) {
+		resp, id = s.acceptHiddenHandshake(pkt, from, r)
+	}
+	if resp == nil {
+		return
+	}
+	log.Info(log.Lbl("sending_relayed_handshake_resp"), from, r.toAddr())
+	log.Error(s.net.Send(forwardPacket(id, resp), r.toAddr()))
+}
+
+// useRelay asks up to rendezvousNodes relays close to n for a Rendezvous and
+// retries the handshake through the first one that has a live session with it.
+func (s *Server) useRelay(n *node) {
+	tried := 0
+	for _, r := range s.table.closest(n.id(), s.table.len()) {
+		if tried == rendezvousNodes {
+			break
+		}
+		if r == n || !r.hasSession() || !r.live() || !r.isRelay() {
+			continue
+		}
+		tried++
+		if _, ok := s.queryRendezvous(r, n.id(), lookupTimeout); ok {
+			log.Info(log.Lbl("using_relay"), n.toAddr(), r.toAddr())
+			n.tryRelay(r)
+			log.Error(s.sendHandshakeRequest(n))
+			return
+		}
+	}
+	log.Info(log.Lbl("no_relay"), n.toAddr())
+}
@@ -0,0 +1,68 @@
+package overlay
+
+import (
+	"github.com/dist-ribut-us/crypto"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestRelayLimiter(t *testing.T) {
+	l := newRelayLimiter()
+	var id, id2 crypto.ID
+	id2[0] = 1
+	assert.True(t, l.allow(&id, int(relayRate)))
+	assert.False(t, l.allow(&id, 1))
+	assert.True(t, l.allow(&id2, 1))
+
+	for i := 0; i < int(relayHandshakeRate); i++ {
+		assert.True(t, l.allowHandshake(&id))
+	}
+	assert.False(t, l.allowHandshake(&id))
+	assert.True(t, l.allowHandshake(&id2))
+}
+
+func TestRelay(t *testing.T) {
+	srvs := newTestChain(t, 3)
+	for _, s := range srvs {
+		defer s.Close()
+	}
+	a, r, b := srvs[0], srvs[1], srvs[2]
+	r.EnableRelay()
+
+	nr, _ := a.nodeByID(r.key.Pub().ID())
+	_, ok := a.queryFindNode(nr, r.key.Pub().ID(), lookupTimeout)
+	assert.True(t, ok)
+	nb, _ := r.nodeByID(b.key.Pub().ID())
+	_, ok = r.queryFindNode(nb, b.key.Pub().ID(), lookupTimeout)
+	assert.True(t, ok)
+	assert.True(t, nr.setRecord(r.selfRecord()))
+	rb, _ := b.nodeByID(r.key.Pub().ID())
+	assert.True(t, rb.setRecord(r.selfRecord()))
+
+	// a cannot reach b directly
+	n := &node{
+		Pub:      b.key.Pub(),
+		PubX:     b.keyX.Pub(),
+		ToAddr:   getPort.Next().On("127.0.0.1"),
+		FromAddr: getPort.Next().On("127.0.0.1"),
+	}
+	a.addNode(n)
+	n.tryRelay(nr)
+	assert.NoError(t, a.sendHandshakeRequest(n))
+	for i := 0; i < 50 && n.Shared == nil; i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+	assert.NotNil(t, n.Shared)
+
+	na, ok := b.nodeByID(a.key.Pub().ID())
+	if assert.True(t, ok) {
+		if rb := na.getRelay(); assert.NotNil(t, rb) {
+			assert.Equal(t, r.key.Pub(), rb.Pub)
+		}
+	}
+
+	_, ok = a.queryFindNode(n, b.key.Pub().ID(), lookupTimeout)
+	assert.True(t, ok)
+	assert.Equal(t, nr, n.getRelay())
+}
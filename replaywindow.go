@@ -0,0 +1,97 @@
+package overlay
+
+import (
+	"encoding/binary"
+	"github.com/dist-ribut-us/errors"
+	"sync/atomic"
+)
+
+// Every encSymmetric packet starts with a counter inside the sealed payload.
+// The counter is per session and is not reset by a rekey. Counters are checked
+// against a sliding window of the last replayWindowSize counters so packets
+// may be reordered but not replayed.
+const (
+	replayWindowSize = 1024
+	packetCounterLen = 8
+)
+
+// Errors for packets dropped by the replay window
+const (
+	ErrReplayedPacket = errors.String("Packet has been replayed")
+	ErrShortPacket    = errors.String("Packet too short for counter")
+)
+
+type replayWindow struct {
+	started bool
+	top     uint64
+	bits    [replayWindowSize / 64]uint64
+}
+
+func (w *replayWindow) bit(ctr uint64) (int, uint64) {
+	i := ctr % replayWindowSize
+	return int(i / 64), 1 << (i % 64)
+}
+
+// check returns false if ctr has been seen or is too old for the window,
+// otherwise it records ctr.
+func (w *replayWindow) check(ctr uint64) bool {
+	if !w.started || ctr > w.top {
+		if !w.started || ctr-w.top >= replayWindowSize {
+			w.bits = [replayWindowSize / 64]uint64{}
+		} else {
+			for c := w.top + 1; c < ctr; c++ {
+				i, b := w.bit(c)
+				w.bits[i] &^= b
+			}
+		}
+		w.started, w.top = true, ctr
+		i, b := w.bit(ctr)
+		w.bits[i] |= b
+		return true
+	}
+	if w.top-ctr >= replayWindowSize {
+		return false
+	}
+	i, b := w.bit(ctr)
+	if w.bits[i]&b != 0 {
+		return false
+	}
+	w.bits[i] |= b
+	return true
+}
+
+// addCounters prefixes each packet with the next counter for the session.
+func (n *node) addCounters(packets [][]byte) [][]byte {
+	n.Lock()
+	defer n.Unlock()
+	for i, p := range packets {
+		c := make([]byte, packetCounterLen, packetCounterLen+len(p))
+		binary.BigEndian.PutUint64(c, n.sendCtr)
+		n.sendCtr++
+		packets[i] = append(c, p...)
+	}
+	return packets
+}
+
+// checkCounter removes the counter from an opened packet and checks it
+// against the replay window. newest is true if the counter is the highest
+// seen in the session.
+func (n *node) checkCounter(p []byte) (b []byte, newest bool, err error) {
+	if len(p) < packetCounterLen {
+		return nil, false, ErrShortPacket
+	}
+	ctr := binary.BigEndian.Uint64(p)
+	n.Lock()
+	newest = !n.recvWindow.started || ctr > n.recvWindow.top
+	ok := n.recvWindow.check(ctr)
+	n.Unlock()
+	if !ok {
+		return nil, false, ErrReplayedPacket
+	}
+	return p[packetCounterLen:], newest, nil
+}
+
+// ReplayedPackets returns the number of packets dropped by the replay window.
+func (s *Server) ReplayedPackets() uint64 {
+	return atomic.LoadUint64(&s.replayed)
+}
@@ -0,0 +1,64 @@
+package overlay
+
+import (
+	"github.com/dist-ribut-us/crypto"
+	"github.com/dist-ribut-us/rnet"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestReplayWindow(t *testing.T) {
+	var w replayWindow
+	assert.True(t, w.check(5))
+	assert.False(t, w.check(5))
+	assert.True(t, w.check(3))
+	assert.True(t, w.check(10))
+	assert.True(t, w.check(4))
+	assert.False(t, w.check(3))
+
+	assert.True(t, w.check(10+replayWindowSize))
+	assert.False(t, w.check(10))
+	assert.True(t, w.check(11))
+	assert.False(t, w.check(11))
+
+	assert.True(t, w.check(100*replayWindowSize))
+	assert.True(t, w.check(100*replayWindowSize-1))
+	assert.False(t, w.check(99*replayWindowSize))
+}
+
+func TestReplayedPacket(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+
+	addr := rnet.Port(7667).On("127.0.0.1")
+	_, priv := crypto.GenerateSignPair()
+	n := &node{
+		Pub:      priv.Pub(),
+		ToAddr:   addr,
+		FromAddr: addr,
+	}
+	n.setSession(crypto.RandomSymmetric())
+	s.addNode(n)
+	// packets sent to n are addressed to the connection ID s receives on
+	connID := randomConnID()
+	s.setConnIDs(n, connID, connID)
+	tag := n.packetTag(encSymmetric)
+
+	pkt := n.Shared.SealPackets(tag, n.addCounters([][]byte{[]byte("test")}), nil, 0)[0]
+	s.message(pkt, addr)
+	assert.Equal(t, uint64(0), s.ReplayedPackets())
+	s.message(pkt, addr)
+	assert.Equal(t, uint64(1), s.ReplayedPackets())
+
+	p, err := n.open(pkt[len(tag):])
+	assert.NoError(t, err)
+	_, _, err = n.checkCounter(p)
+	assert.Equal(t, ErrReplayedPacket, err)
+
+	p, err = n.open(n.Shared.SealPackets(tag, n.addCounters([][]byte{[]byte("next")}), nil, 0)[0][len(tag):])
+	assert.NoError(t, err)
+	p, newest, err := n.checkCounter(p)
+	assert.NoError(t, err)
+	assert.True(t, newest)
+	assert.Equal(t, "next", string(p))
+}
@@ -0,0 +1,138 @@
+package overlay
+
+import (
+	"github.com/dist-ribut-us/errors"
+	"github.com/dist-ribut-us/log"
+	"github.com/dist-ribut-us/message"
+	"github.com/dist-ribut-us/overlay/overlaymessages"
+	"github.com/dist-ribut-us/rnet"
+	"time"
+)
+
+// pendingSend is a message waiting for a handshake to complete.
+type pendingSend struct {
+	msg         *message.Header
+	compression bool
+	origin      rnet.Port
+}
+
+// Handshake retry parameters. A handshake request is retransmitted after
+// handshakeRetry, doubling each time up to handshakeRetryMax. If no session is
+// established by handshakeTimeout, the queued messages are dropped and the
+// originating services are notified.
+var (
+	maxQueuedSends    = 64
+	handshakeRetry    = time.Millisecond * 500
+	handshakeRetryMax = time.Second * 8
+	handshakeTimeout  = time.Second * 30
+)
+
+// Errors reported when a queued send fails
+const (
+	ErrHandshakeTimeout = errors.String("Handshake timed out")
+	ErrSendQueueFull    = errors.String("Send queue for node is full")
+)
+
+func (n *node) handshaking() bool {
+	n.Lock()
+	defer n.Unlock()
+	return n.hsTimer != nil
+}
+
+// queueSend adds a message to the queue for a node and starts a handshake if
+// one is not already in flight. Both happen under one lock so the message
+// cannot miss a handshake that completes or times out in between.
+func (s *Server) queueSend(n *node, ps *pendingSend) {
+	n.Lock()
+	if len(n.queue) >= maxQueuedSends {
+		n.Unlock()
+		s.nack(ps.origin, ps.msg.Id, overlaymessages.NackQueueFull, ErrSendQueueFull)
+		return
+	}
+	n.queue = append(n.queue, ps)
+	start := s.startHandshakeLocked(n)
+	n.Unlock()
+	if start {
+		log.Error(s.sendHandshakeRequest(n))
+	}
+}
+
+// startHandshake sets up the retries for a handshake with n. It returns false
+// if a handshake is already in flight.
+func (s *Server) startHandshake(n *node) bool {
+	n.Lock()
+	defer n.Unlock()
+	return s.startHandshakeLocked(n)
+}
+
+func (s *Server) startHandshakeLocked(n *node) bool {
+	if n.hsTimer != nil {
+		return false
+	}
+	n.hsRetry = handshakeRetry
+	n.hsDeadline = time.Now().Add(handshakeTimeout)
+	n.hsPunched, n.hsRelayed = false, false
+	n.hsPunchAddr = nil
+	n.relay = nil
+	n.hsTimer = time.AfterFunc(n.hsRetry, func() { s.retryHandshake(n) })
+	return true
+}
+
+// retryHandshake retransmits the handshake request with exponential backoff
+// until the deadline passes, then fails everything in the queue.
+func (s *Server) retryHandshake(n *node) {
+	n.Lock()
+	if n.hsTimer == nil {
+		n.Unlock()
+		return
+	}
+	if time.Now().After(n.hsDeadline) {
+		q := n.queue
+		n.queue, n.hsTimer = nil, nil
+		n.contacted(false)
+		n.Unlock()
+		log.Info(log.Lbl("handshake_timeout"), n.toAddr(), len(q))
+		for _, ps := range q {
+			s.nack(ps.origin, ps.msg.Id, overlaymessages.NackHandshakeTimeout, ErrHandshakeTimeout)
+		}
+		return
+	}
+	n.hsRetry *= 2
+	if n.hsRetry > handshakeRetryMax {
+		n.hsRetry = handshakeRetryMax
+	}
+	n.hsTimer = time.AfterFunc(n.hsRetry, func() { s.retryHandshake(n) })
+	punch := !n.hsPunched && time.Until(n.hsDeadline) < handshakeTimeout-punchDelay
+	n.hsPunched = n.hsPunched || punch
+	relay := !n.hsRelayed && time.Until(n.hsDeadline) < handshakeTimeout-relayDelay
+	n.hsRelayed = n.hsRelayed || relay
+	n.Unlock()
+	if punch {
+		go s.holePunch(n)
+	}
+	if relay {
+		go s.useRelay(n)
+	}
+	log.Info(log.Lbl("retrying_handshake"), n.toAddr())
+	log.Error(s.sendHandshakeRequest(n))
+}
+
+// handshakeComplete stops any retries and sends everything in the queue.
+func (s *Server) handshakeComplete(n *node) {
+	n.Lock()
+	if n.hsTimer != nil {
+		n.hsTimer.Stop()
+		n.hsTimer = nil
+	}
+	n.hsPunchAddr = nil
+	q := n.queue
+	n.queue = nil
+	n.contacted(true)
+	n.Unlock()
+	if len(q) > 0 {
+		log.Info(log.Lbl("handshake_complete:resuming"), len(q))
+	}
+	for _, ps := range q {
+		s.netSend(ps.msg, n, ps.compression, ps.origin)
+	}
+}
@@ -0,0 +1,133 @@
+package overlay
+
+import (
+	"github.com/dist-ribut-us/crypto"
+	"github.com/dist-ribut-us/ipcrouter"
+	"github.com/dist-ribut-us/ipcrouter/testservice"
+	"github.com/dist-ribut-us/message"
+	"github.com/dist-ribut-us/overlay/overlaymessages"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestQueuedSends(t *testing.T) {
+	serviceA, err := testservice.New(314159, getPort.Next())
+	assert.NoError(t, err)
+	go serviceA.Run()
+	defer serviceA.Close()
+	overlaySrvA := newTestServer(t)
+	defer overlaySrvA.Close()
+	serviceA.NetSenderPort = overlaySrvA.router.Port()
+
+	serviceB, err := testservice.New(265358, getPort.Next())
+	assert.NoError(t, err)
+	go serviceB.Run()
+	defer serviceB.Close()
+	overlaySrvB := newTestServer(t)
+	defer overlaySrvB.Close()
+	serviceB.RegisterWithOverlay(serviceB.ServiceID(), overlaySrvB.router.Port())
+
+	nodeB := &node{
+		Pub:      overlaySrvB.key.Pub(),
+		FromAddr: overlaySrvB.addr,
+		ToAddr:   overlaySrvB.addr,
+	}
+	overlaySrvA.addNode(nodeB)
+
+	// both queries are sent before the handshake completes, neither should be
+	// lost
+	for _, body := range []string{"first", "second"} {
+		serviceA.Router.
+			Query(message.Test, body).
+			SetService(serviceB.ServiceID()).
+			SendToNet(nodeB.ToAddr, func(ipcrouter.NetResponse) {})
+	}
+
+	got := make(map[string]bool)
+	for i := 0; i < 2; i++ {
+		select {
+		case nq := <-serviceB.Chan.NetQuery:
+			got[nq.BodyString()] = true
+		case <-time.After(time.Millisecond * 100):
+			t.Error("time out")
+		}
+	}
+	assert.True(t, got["first"])
+	assert.True(t, got["second"])
+}
+
+// nackCatcher is a service that collects the Nacks sent to it.
+type nackCatcher struct {
+	router *ipcrouter.Router
+	nacks  chan *overlaymessages.Nack
+}
+
+func newNackCatcher(t *testing.T) *nackCatcher {
+	router, err := ipcrouter.New(getPort.Next())
+	assert.NoError(t, err)
+	nc := &nackCatcher{
+		router: router,
+		nacks:  make(chan *overlaymessages.Nack, 8),
+	}
+	router.Register(nc)
+	go router.Run()
+	return nc
+}
+
+func (nc *nackCatcher) CommandHandler(c ipcrouter.Command) {
+	if c.GetType() != overlaymessages.Nack {
+		return
+	}
+	n, err := overlaymessages.DeserializeNack(c.GetBody())
+	if err == nil {
+		nc.nacks <- n
+	}
+}
+
+func (nc *nackCatcher) next(t *testing.T) *overlaymessages.Nack {
+	select {
+	case n := <-nc.nacks:
+		return n
+	case <-time.After(time.Millisecond * 200):
+		t.Error("timed out waiting for nack")
+		return nil
+	}
+}
+
+func TestHandshakeGiveUp(t *testing.T) {
+	defer func(retry, timeout time.Duration) {
+		handshakeRetry, handshakeTimeout = retry, timeout
+	}(handshakeRetry, handshakeTimeout)
+	handshakeRetry = time.Millisecond * 5
+	handshakeTimeout = time.Millisecond * 30
+
+	s := newTestServer(t)
+	defer s.Close()
+
+	// nothing is listening on this port
+	addr := getPort.Next().On("127.0.0.1")
+	_, priv := crypto.GenerateSignPair()
+	n := &node{
+		Pub:      priv.Pub(),
+		FromAddr: addr,
+		ToAddr:   addr,
+	}
+	origin := newNackCatcher(t)
+	defer origin.router.Close()
+
+	h := message.NewHeader(message.Test, "lost")
+	h.Id = 1
+	s.netSend(h, n, false, origin.router.Port())
+	assert.True(t, n.handshaking())
+
+	if nack := origin.next(t); assert.NotNil(t, nack) {
+		assert.Equal(t, uint32(1), nack.ID)
+		assert.Equal(t, overlaymessages.NackHandshakeTimeout, nack.Reason)
+		assert.Equal(t, ErrHandshakeTimeout.Error(), nack.Detail)
+	}
+	assert.False(t, n.handshaking())
+	n.Lock()
+	assert.Len(t, n.queue, 0)
+	n.Unlock()
+}
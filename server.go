@@ -6,28 +6,56 @@ import (
 	"github.com/dist-ribut-us/ipcrouter"
 	"github.com/dist-ribut-us/log"
 	"github.com/dist-ribut-us/merkle"
-	"github.com/dist-ribut-us/natt/igdp"
 	"github.com/dist-ribut-us/overlay/overlaymessages"
 	"github.com/dist-ribut-us/packeter"
 	"github.com/dist-ribut-us/rnet"
+	"sync"
+	"time"
 )
 
 // Server represents an overlay server.
 type Server struct {
+	replayed uint64 // packets dropped by the replay window, first for alignment
 	*nodes
-	net         *rnet.Server
-	key         *crypto.SignPriv
-	keyX        *crypto.XchgPair // Temporary until github.com/golang/go/issues/20504
-	packeter    *packeter.Packeter
-	router      *ipcrouter.Router
-	loss        float64
-	reliability float64
-	addr        *rnet.Addr
-	services    *portmap
-	callbacks   *portmap
-	forest      *merkle.Forest
-	xchgCache   *xchgPairs
-	NodeTTL     uint32 // default TTL in seconds
+	net             *rnet.Server
+	key             *crypto.SignPriv
+	keyX            *crypto.XchgPair // Temporary until github.com/golang/go/issues/20504
+	packeter        *packeter.Packeter
+	router          *ipcrouter.Router
+	loss            float64
+	reliability     float64
+	addrLock        sync.Mutex // guards addr, mappedAddr, observedAddr and nat
+	addr            *rnet.Addr
+	mappedAddr      *rnet.Addr
+	observedAddr    *rnet.Addr
+	services        *portmap
+	queries         *pendingQueries
+	probes          *pendingProbes
+	forest          *merkle.Forest
+	dhtCounts       *recordCounts
+	hsCache         *pendingHandshakes
+	hsHidden        *hiddenHandshakes // by ephemeral key
+	replayCache     *replayCache
+	cookies         *cookieJar
+	pex             *pexLimiter
+	roles           overlaymessages.Role // guarded by selfRecordLock
+	relayLimit      *relayLimiter
+	rendezvous      *rendezvousSet
+	portMaps        *portMapManager
+	lan             *lanDiscovery
+	lanLock         sync.Mutex // guards lan
+	selfRec         *overlaymessages.NodeRecord
+	selfRecordLock  sync.Mutex
+	table           *routingTable
+	circuits        *circuits
+	hopCircuits     *hopCircuits
+	createLimit     circuitBucket // guarded by hopCircuits
+	removedHooks    nodeHooks
+	nodeSubscribers *portmap
+	nat             NATType
+	closed          chan struct{}
+	closeOnce       sync.Once
+	NodeTTL         uint32 // default TTL in seconds
 }
 
 // NewServer initilizes part of the Overlay Server.
@@ -36,15 +64,30 @@ func NewServer(router *ipcrouter.Router, netPort rnet.Port) (*Server, error) {
 	// is setup so that pool should send a message telling it how to load a key
 	// before any network communication starts.
 	s := &Server{
-		nodes:       newNodes(),
-		packeter:    packeter.New(),
-		router:      router,
-		loss:        0.01,
-		reliability: 0.999,
-		services:    newportmap(),
-		callbacks:   newportmap(),
-		xchgCache:   newxchgPairs(),
-		NodeTTL:     60 * 60, // one hour
+		nodes:           newNodes(),
+		packeter:        packeter.New(),
+		router:          router,
+		loss:            0.01,
+		reliability:     0.999,
+		services:        newportmap(),
+		queries:         newpendingQueries(),
+		probes:          newpendingProbes(),
+		hsCache:         newpendingHandshakes(),
+		hsHidden:        newhiddenHandshakes(),
+		replayCache:     newreplayCache(),
+		cookies:         newCookieJar(),
+		pex:             newPexLimiter(),
+		roles:           nodeRoles,
+		relayLimit:      newRelayLimiter(),
+		rendezvous:      newRendezvousSet(),
+		portMaps:        newPortMapManager(netPort),
+		dhtCounts:       newRecordCounts(),
+		circuits:        newcircuits(),
+		hopCircuits:     newhopCircuits(),
+		createLimit:     circuitBucket{tokens: circuitCreateRate, filled: time.Now()},
+		nodeSubscribers: newportmap(),
+		closed:          make(chan struct{}),
+		NodeTTL:         60 * 60, // one hour
 	}
 	s.services.set(overlaymessages.ServiceID, router.Port())
 	s.packeter.Handler = s.handleNetMessage
@@ -82,6 +125,7 @@ func (s *Server) SetKey() error {
 func (s *Server) RandomKey() {
 	_, s.key = crypto.GenerateSignPair()
 	s.keyX = crypto.GenerateXchgPair()
+	s.resetTable()
 }
 
 // Port returns the ipc router port for Overlay
@@ -161,6 +205,7 @@ func (s *Server) LoadKey() error {
 
 	s.key = crypto.SignPrivFromSlice(keyB)
 	s.keyX = crypto.XchgPairFromSlice(keyXB)
+	s.resetTable()
 
 	return nil
 }
@@ -168,35 +213,73 @@ func (s *Server) LoadKey() error {
 // Run the overlay server
 func (s *Server) Run() {
 	go s.net.Run()
+	go s.every(refreshInterval, s.refreshBuckets)
+	go s.every(republishInterval, s.republish)
+	go s.every(expireInterval, s.expireRecords)
+	go s.every(reapInterval, s.reap)
+	go s.every(handshakeMaxSkew, s.expireReplayCache)
+	go s.every(cookieRotation, s.cookies.rotate)
+	go s.every(queryTimeout/2, s.expireQueries)
+	go s.every(saveNodesInterval, s.saveNodes)
+	go s.every(pexInterval, s.pexRound)
+	go s.every(rekeyGrace, s.rekeySessions)
+	go s.every(probeInterval, s.probePaths)
+	go s.every(observeInterval, s.discoverAddr)
+	go s.every(relayIdle, s.relayLimit.expire)
+	go s.every(rendezvousRefresh, s.registerRendezvous)
+	go s.every(portMapCheck, s.renewPortMapping)
+	go s.every(circuitIdle/2, s.expireCircuits)
 	s.router.Run()
 }
 
+// every calls fn every d until the server is closed.
+func (s *Server) every(d time.Duration, fn func()) {
+	t := time.NewTicker(d)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			fn()
+		case <-s.closed:
+			return
+		}
+	}
+}
+
 // Forest opens the merkle forest for the overlay server.
 func (s *Server) Forest(key *crypto.Symmetric, dir string) (err error) {
 	s.forest, err = merkle.Open(dir, key)
-	s.forest.MakeBuckets(configBkt)
+	if err != nil {
+		return
+	}
+	s.forest.MakeBuckets(configBkt, dhtBkt, dhtPubBkt, beaconBkt, nodeBkt)
+	s.loadNodes()
+	s.loadBeacons()
 	return
 }
 
-// SetupNetwork tries to connect to the network.
-func (s *Server) SetupNetwork() {
-	if err := igdp.Setup(); err == nil {
-		_, err = igdp.AddPortMapping(s.net.Port(), s.net.Port())
-		log.Error(err)
+// SetupNetwork tries to connect to the network. The port is mapped on the
+// gateway with the first of the port mappers that works, DefaultPortMappers if
+// none are given. If the port cannot be mapped, the address is left unset
+// until peers report the address they see.
+func (s *Server) SetupNetwork(pms ...PortMapper) {
+	if len(pms) == 0 {
+		pms = DefaultPortMappers()
 	}
-	ip, err := igdp.GetExternalIP()
-	log.Error(err)
-
-	addr := s.net.Port().On(ip)
-	log.Error(addr.Err)
-	s.addr = addr
+	s.setMappedAddr(mappedAddr(s.portMaps.start(pms)))
 
-	log.Info(log.Lbl("IPC>"), s.router.Port().On("127.0.0.1"), log.Lbl("Net>"), addr, s.key.Pub())
+	log.Info(log.Lbl("IPC>"), s.router.Port().On("127.0.0.1"), log.Lbl("Net>"), s.getAddr(), s.key.Pub())
 }
 
-// Close stop all processes for the overlay server
+// Close stop all processes for the overlay server. It is safe to call more than
+// once.
 func (s *Server) Close() {
-	log.Info(log.Lbl("closing_overlay_server"), log.KV{"net", s.net.Port()}, log.KV{"local", s.router.Port()})
-	s.net.Close()
-	s.router.Close()
+	s.closeOnce.Do(func() {
+		log.Info(log.Lbl("closing_overlay_server"), log.KV{"net", s.net.Port()}, log.KV{"local", s.router.Port()})
+		close(s.closed)
+		s.saveNodes()
+		s.portMaps.close()
+		s.net.Close()
+		s.router.Close()
+	})
 }
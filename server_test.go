@@ -70,3 +70,9 @@ func TestGetPBuffer(t *testing.T) {
 	assert.Equal(t, message.Test, h.GetType())
 	assert.Equal(t, "this is a test", string(h.Body))
 }
+
+func TestCloseTwice(t *testing.T) {
+	s := newTestServer(t)
+	s.Close()
+	assert.NotPanics(t, s.Close)
+}
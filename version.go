@@ -0,0 +1,85 @@
+package overlay
+
+import (
+	"encoding/binary"
+	"github.com/dist-ribut-us/errors"
+	"github.com/dist-ribut-us/overlay/overlaymessages"
+)
+
+// feature is a set of optional capabilities offered in a handshake
+type feature uint32
+
+// Features
+const (
+	featGZip = feature(1 << iota)
+	featRelay
+	featRekey
+)
+
+func (f feature) has(f2 feature) bool {
+	return f&f2 == f2
+}
+
+// The versions and features offered in a handshake. The highest version both
+// nodes support and the features both nodes offer are used for the session.
+var (
+	supportedVersions = []uint16{overlaymessages.ProtocolVersion}
+	supportedFeatures = featGZip | featRelay | featRekey
+)
+
+// maxHandshakeVersions limits the version list in a handshake
+const maxHandshakeVersions = 8
+
+// ErrNoCommonVersion is logged when a handshake fails because the nodes do not
+// share a protocol version.
+const ErrNoCommonVersion = errors.String("No common protocol version")
+
+// appendOffer appends the version count, versions and features to b.
+func appendOffer(b []byte, versions []uint16, features feature) []byte {
+	b = append(b, byte(len(versions)))
+	for _, v := range versions {
+		var vb [2]byte
+		binary.BigEndian.PutUint16(vb[:], v)
+		b = append(b, vb[:]...)
+	}
+	var fb [4]byte
+	binary.BigEndian.PutUint32(fb[:], uint32(features))
+	return append(b, fb[:]...)
+}
+
+// offerLen returns the length of the offer at the start of b.
+func offerLen(b []byte) (int, bool) {
+	if len(b) < 1 || int(b[0]) > maxHandshakeVersions {
+		return 0, false
+	}
+	l := 1 + int(b[0])*2 + 4
+	return l, len(b) >= l
+}
+
+// readOffer decodes an offer written by appendOffer. The length must already
+// have been checked with offerLen.
+func readOffer(b []byte) ([]uint16, feature) {
+	n := int(b[0])
+	versions := make([]uint16, n)
+	for i := range versions {
+		versions[i] = binary.BigEndian.Uint16(b[1+i*2:])
+	}
+	return versions, feature(binary.BigEndian.Uint32(b[1+n*2:]))
+}
+
+// negotiate returns the highest version and the features offered in both
+// handshakes. Because each offer is covered by the signature of the node that
+// made it, both sides compute the same result and an attacker cannot remove
+// versions or features to force a downgrade.
+func negotiate(a, b *handshake) (uint16, feature, bool) {
+	var version uint16
+	found := false
+	for _, av := range a.versions {
+		for _, bv := range b.versions {
+			if av == bv && (!found || av > version) {
+				version, found = av, true
+			}
+		}
+	}
+	return version, a.features & b.features, found
+}